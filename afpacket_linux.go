@@ -0,0 +1,132 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"os"
+
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+var afpacketFanoutTypes = map[string]afpacket.FanoutType{
+	"hash":     afpacket.FanoutHash,
+	"lb":       afpacket.FanoutLoadBalance,
+	"cpu":      afpacket.FanoutCPU,
+	"rollover": afpacket.FanoutRollover,
+	"random":   afpacket.FanoutRandom,
+}
+
+// afpacketCapture is the AF_PACKET backend: the kernel writes packets to a
+// TPACKET_V3 ring buffer shared with rps, without a copy per packet.
+type afpacketCapture struct {
+	*afpacket.TPacket
+}
+
+const afpacketBlockSize = 1 << 20
+
+// Returns the frame size, block size and number of blocks of a ring of
+// about ringSize MiB, given the snapshot length, the default one if it is
+// not positive
+func afpacketRingLayout(ringSize int, snapLen int) (frameSize int, blockSize int, numBlocks int) {
+	if snapLen <= 0 {
+		snapLen = defaultSnapLen
+	}
+	pageSize := os.Getpagesize()
+	if snapLen < pageSize {
+		// A power of two, so that the frames are aligned and fill the pages
+		frameSize = 1 << bits.Len(uint(max(snapLen, 16)-1))
+	} else {
+		frameSize = (snapLen/pageSize + 1) * pageSize
+	}
+	// Blocks of about 1 MiB, so that a big snapshot length still gives many
+	// blocks for the kernel to fill while rps reads the others
+	blockSize = frameSize * max(1, afpacketBlockSize/frameSize)
+	numBlocks = ringSize * 1024 * 1024 / blockSize
+	if numBlocks < 1 {
+		numBlocks = 1
+	}
+	return
+}
+
+func openAfpacketCapture(iface string, filter string) (liveCapture, error) {
+	fanoutType, ok := afpacketFanoutTypes[*afpacketFanoutType]
+	if !ok {
+		return nil, fmt.Errorf("unknown fanout type %q", *afpacketFanoutType)
+	}
+
+	frameSize, blockSize, numBlocks := afpacketRingLayout(*afpacketRingSize, captureSnapLen())
+	log.Printf("Starting afpacket capture on interface %q, %d blocks of %d bytes", iface, numBlocks, blockSize)
+	tpacket, err := afpacket.NewTPacket(
+		afpacket.OptInterface(iface),
+		afpacket.OptFrameSize(frameSize),
+		afpacket.OptBlockSize(blockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		// Not blocking forever, so that the capture can be closed on shutdown
+		afpacket.OptPollTimeout(liveReadTimeout),
+		afpacket.TPacketVersion3,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not open interface - %v - %s", iface, err)
+	}
+
+	// The kernel truncates the packets to the length the filter returns, so
+	// without a filter they are captured whole, as far as the frames allow
+	if filter != "" {
+		instructions, err := compileBPF(filter, captureSnapLen())
+		if err == nil {
+			err = tpacket.SetBPF(instructions)
+		}
+		if err != nil {
+			tpacket.Close()
+			return nil, fmt.Errorf("could not apply filter %v to capture - %s", filter, err)
+		}
+	}
+
+	if *afpacketFanoutId != 0 {
+		if err = tpacket.SetFanout(fanoutType, uint16(*afpacketFanoutId)); err != nil {
+			tpacket.Close()
+			return nil, fmt.Errorf("could not join fanout group %d - %s", *afpacketFanoutId, err)
+		}
+		log.Printf("Joined fanout group %d (%s)", *afpacketFanoutId, *afpacketFanoutType)
+	}
+	return afpacketCapture{tpacket}, nil
+}
+
+// Compiles a BPF filter with libpcap, for the kernel
+func compileBPF(filter string, snapLen int) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snapLen, filter)
+	if err != nil {
+		return nil, err
+	}
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	return raw, nil
+}
+
+func (ac afpacketCapture) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (ac afpacketCapture) Counters() (captureCounters, error) {
+	_, socketStats, err := ac.SocketStats()
+	if err != nil {
+		return captureCounters{}, err
+	}
+	return captureCounters{
+		Received: int(socketStats.Packets()),
+		Dropped:  int(socketStats.Drops()),
+	}, nil
+}
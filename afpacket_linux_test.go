@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAfpacketRingLayout(t *testing.T) {
+	pageSize := os.Getpagesize()
+	defaultFrame, _, _ := afpacketRingLayout(64, defaultSnapLen)
+	tests := []struct {
+		name     string
+		ringSize int
+		snapLen  int
+		frame    int
+	}{
+		{"default", 64, defaultSnapLen, defaultFrame},
+		{"zero snaplen", 64, 0, defaultFrame},
+		{"negative snaplen", 64, -1, defaultFrame},
+		{"small snaplen", 64, 100, 128},
+		{"power of two snaplen", 64, 512, 512},
+		{"page snaplen", 64, pageSize, 2 * pageSize},
+		{"tiny ring", 0, defaultSnapLen, defaultFrame},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frameSize, blockSize, numBlocks := afpacketRingLayout(test.ringSize, test.snapLen)
+			if frameSize != test.frame {
+				t.Errorf("frame size %d, want %d", frameSize, test.frame)
+			}
+			if frameSize%16 != 0 || blockSize%frameSize != 0 || blockSize%pageSize != 0 {
+				t.Errorf("frame size %d and block size %d not aligned", frameSize, blockSize)
+			}
+			if numBlocks < 1 {
+				t.Errorf("%d blocks", numBlocks)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func openAfpacketCapture(iface string, filter string) (liveCapture, error) {
+	return nil, errors.New("the afpacket backend is only available on Linux")
+}
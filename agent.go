@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var collectorAddr = flag.String("collector", "127.0.0.1:5556", "Agent: address of the collector to stream messages to")
+var agentName = flag.String("agent-name", defaultAgentName(), "Agent: name identifying this machine on the collector")
+var agentBuffer = flag.Int("agent-buffer", 10000, "Agent: messages kept in memory while the collector is unreachable, more are spilled to -spill-dir")
+
+// Set by rps agent, enables the agent module
+var agentMode bool
+
+func init() {
+	registerCommand("agent", func(args []string) int {
+		agentMode = true
+		return run(args)
+	})
+	registerModule("agent", func() Module { return new(agentModule) })
+}
+
+func defaultAgentName() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "agent"
+	}
+	return hostname
+}
+
+// Agents and collectors exchange JSON lines over TCP. The agent first sends
+// an agentHello, then one remoteMsg per message in the order they were
+// published. The collector answers with collectorAcks.
+type agentHello struct {
+	Agent    string `json:"agent"`
+	Instance string `json:"instance"` // Tells runs of the agent apart, the IDs start over
+}
+
+// collectorAck tells the agent that the collector published its messages up
+// to Ack, the messages after it are sent again on the next connection
+type collectorAck struct {
+	Ack uint64 `json:"ack"`
+}
+
+// remoteMsg is a message with its session metadata, as streamed to the
+// collector. The body is sent raw, the collector decodes it.
+type remoteMsg struct {
+	ID         uint64       `json:"id"` // Numbers the messages of an agent instance, from 1
+	ProtocolId uint16       `json:"protocolId"`
+	Name       string       `json:"name"`
+	LenSize    uint8        `json:"lenSize"`
+	InstanceId uint32       `json:"instanceId"`
+	MsgLen     uint32       `json:"msgLen"`
+	Body       []byte       `json:"body"`
+	Timestamp  time.Time    `json:"timestamp"`
+	Direction  msgDirection `json:"direction"`
+	Client     string       `json:"client"`
+	Server     string       `json:"server"`
+	Stream     string       `json:"stream"`
+	Seq        uint64       `json:"seq"`
+	Attached   bool         `json:"attached"`
+	Closed     bool         `json:"closed,omitempty"`
+	Ending     string       `json:"ending,omitempty"`
+}
+
+func newRemoteMsg(msg *dofusMsg) remoteMsg {
+	return remoteMsg{
+		ProtocolId: msg.ProtocolId,
+		Name:       msg.Name(),
+		LenSize:    msg.LenSize,
+		InstanceId: msg.InstanceId,
+		MsgLen:     msg.MsgLen,
+		Body:       msg.body,
+		Timestamp:  msg.Timestamp,
+		Direction:  msg.Direction,
+		Client:     msg.Client,
+		Server:     msg.Server,
+		Stream:     msg.Stream,
+		Seq:        msg.Seq,
+		Attached:   msg.Attached,
+		Closed:     msg.Closed,
+		Ending:     msg.Ending,
+	}
+}
+
+// Rebuilds the message received from the agent source
+func (rM *remoteMsg) message(source string) dofusMsg {
+	return dofusMsg{
+		ProtocolId: rM.ProtocolId,
+		LenSize:    rM.LenSize,
+		InstanceId: rM.InstanceId,
+		MsgLen:     rM.MsgLen,
+		body:       rM.Body,
+		Timestamp:  rM.Timestamp,
+		Direction:  rM.Direction,
+		Client:     rM.Client,
+		Server:     rM.Server,
+		Stream:     rM.Stream,
+		Seq:        rM.Seq,
+		Attached:   rM.Attached,
+		Closed:     rM.Closed,
+		Ending:     rM.Ending,
+		Source:     source,
+		decoded:    new(decodedBody),
+	}
+}
+
+// Delay between two connection attempts to the collector, doubled after
+// each failure
+const (
+	agentMinBackoff = time.Second
+	agentMaxBackoff = 30 * time.Second
+)
+
+// How long a write to the collector may block
+const agentWriteTimeout = 10 * time.Second
+
+// How long the agent keeps trying to send its buffer on shutdown
+const agentDrainTimeout = 5 * time.Second
+
+// Messages the agent sends ahead of the acknowledgments of the collector
+const agentWindow = 1000
+
+// agentModule streams every message to the collector. Messages are
+// buffered while the collector is unreachable and sent once reconnected,
+// the ones sent are kept until the collector acknowledges them.
+type agentModule struct {
+	baseModule
+	queue    *boundedQueue[dofusMsg]
+	instance string
+	ctx      context.Context
+	cancel   context.CancelFunc
+	sent     chan struct{}
+	unsent   atomic.Uint64 // Popped from the queue but never acknowledged
+}
+
+func (am *agentModule) Name() string {
+	return "agent"
+}
+
+func (am *agentModule) Subscriptions() []messageFilter {
+	return nil
+}
+
+// The collector gets the end of the sessions of the agent too
+func (am *agentModule) subscribeSessionEnds() {}
+
+func (am *agentModule) Start(ctx context.Context, env *moduleEnv) error {
+	if *collectorAddr == "" {
+		return fmt.Errorf("missing -collector address")
+	}
+	// The agent outlives ctx to send what is left on shutdown
+	am.ctx, am.cancel = context.WithCancel(context.Background())
+	am.queue = newBoundedQueue[dofusMsg](pipelineStage("agent"), queueOptions{size: *agentBuffer, policy: policySpill})
+	am.instance = strconv.FormatInt(time.Now().UnixNano(), 36)
+	am.sent = make(chan struct{})
+	go am.send(env.Log)
+	am.run(env, func(msg dofusMsg) {
+		am.queue.Push(msg)
+	})
+	return nil
+}
+
+func (am *agentModule) Stop() error {
+	am.baseModule.Stop()
+	am.queue.Close()
+	select {
+	case <-am.sent:
+	case <-time.After(agentDrainTimeout):
+		am.cancel()
+		<-am.sent
+	}
+	am.cancel()
+	if left := uint64(am.queue.Len()) + am.unsent.Load(); left > 0 {
+		return fmt.Errorf("collector unreachable, %d messages not sent", left)
+	}
+	return nil
+}
+
+// sendWindow holds the messages sent, or about to be, that the collector
+// has not acknowledged yet
+type sendWindow struct {
+	messages []remoteMsg
+	written  int // Messages written on the current connection
+	nextID   uint64
+}
+
+func (sw *sendWindow) add(msg *dofusMsg) {
+	sw.nextID++
+	remote := newRemoteMsg(msg)
+	remote.ID = sw.nextID
+	sw.messages = append(sw.messages, remote)
+}
+
+// Forgets the messages acknowledged
+func (sw *sendWindow) acknowledge(acked uint64) {
+	n := 0
+	for n < len(sw.messages) && sw.messages[n].ID <= acked {
+		n++
+	}
+	sw.messages = sw.messages[n:]
+	sw.written = max(sw.written-n, 0)
+}
+
+// Writes the messages not written yet on conn
+func (sw *sendWindow) write(conn net.Conn, logger *log.Logger) error {
+	for sw.written < len(sw.messages) {
+		line, err := json.Marshal(sw.messages[sw.written])
+		if err != nil {
+			logger.Printf("could not encode %s - %s", idNameMap[sw.messages[sw.written].ProtocolId], err)
+			sw.messages = append(sw.messages[:sw.written], sw.messages[sw.written+1:]...)
+			continue
+		}
+		conn.SetWriteDeadline(time.Now().Add(agentWriteTimeout))
+		if _, err = conn.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		sw.written++
+	}
+	return nil
+}
+
+// agentConn is a connection to the collector, reading its acknowledgments
+type agentConn struct {
+	net.Conn
+	acked  atomic.Uint64
+	broken atomic.Bool
+	events chan struct{} // Signaled on acknowledgments and when the connection breaks
+}
+
+func (ac *agentConn) signal() {
+	select {
+	case ac.events <- struct{}{}:
+	default:
+	}
+}
+
+func (ac *agentConn) readAcks() {
+	scanner := bufio.NewScanner(ac)
+	for scanner.Scan() {
+		var ack collectorAck
+		if json.Unmarshal(scanner.Bytes(), &ack) == nil && ack.Ack > ac.acked.Load() {
+			ac.acked.Store(ack.Ack)
+			ac.signal()
+		}
+	}
+	ac.broken.Store(true)
+	ac.signal()
+}
+
+// Sends the queued messages until the queue is closed and every message is
+// acknowledged, or the module is cancelled. Messages are sent again on the
+// next connection until acknowledged, so the collector may get some twice
+// if it is restarted.
+func (am *agentModule) send(logger *log.Logger) {
+	defer close(am.sent)
+	var conn *agentConn
+	backoff := agentMinBackoff
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	// Pops the queue while the loop waits for the collector
+	messages := make(chan dofusMsg)
+	go func() {
+		defer close(messages)
+		for {
+			msg, ok := am.queue.Pop()
+			if !ok {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-am.ctx.Done():
+				am.unsent.Add(1)
+				return
+			}
+		}
+	}()
+
+	var window sendWindow
+	closed := false
+	for {
+		if conn != nil {
+			window.acknowledge(conn.acked.Load())
+			if conn.broken.Load() {
+				logger.Printf("lost connection to %s, %d messages to send again", *collectorAddr, len(window.messages))
+				conn.Close()
+				conn = nil
+			}
+		}
+		if closed && len(window.messages) == 0 {
+			return
+		}
+
+		if conn == nil && len(window.messages) > 0 {
+			var err error
+			conn, err = am.connect()
+			if err != nil {
+				logger.Printf("could not connect to %s, retrying in %v - %s", *collectorAddr, backoff, err)
+				select {
+				case <-am.ctx.Done():
+					am.unsent.Add(uint64(len(window.messages)))
+					return
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, agentMaxBackoff)
+				continue
+			}
+			logger.Printf("connected to %s", *collectorAddr)
+			backoff = agentMinBackoff
+			window.written = 0
+		}
+		if conn != nil && window.written < len(window.messages) {
+			if err := window.write(conn, logger); err != nil {
+				logger.Printf("lost connection to %s - %s", *collectorAddr, err)
+				conn.Close()
+				conn = nil
+			}
+			continue
+		}
+
+		// Wait for a message, while the window has room, or for the
+		// collector
+		var incoming chan dofusMsg
+		if !closed && len(window.messages) < agentWindow {
+			incoming = messages
+		}
+		var events chan struct{}
+		if conn != nil {
+			events = conn.events
+		}
+		select {
+		case msg, ok := <-incoming:
+			if !ok {
+				closed = true
+				continue
+			}
+			window.add(&msg)
+		case <-events:
+		case <-am.ctx.Done():
+			am.unsent.Add(uint64(len(window.messages)))
+			return
+		}
+	}
+}
+
+// Connects to the collector and introduces the agent
+func (am *agentModule) connect() (*agentConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(am.ctx, "tcp", *collectorAddr)
+	if err != nil {
+		return nil, err
+	}
+	hello, _ := json.Marshal(agentHello{Agent: *agentName, Instance: am.instance})
+	if _, err = conn.Write(append(hello, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ac := &agentConn{Conn: conn, events: make(chan struct{}, 1)}
+	go ac.readAcks()
+	return ac, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+// Starts an agent module streaming to address, returns its inbox
+func startAgent(t *testing.T, address string) (*agentModule, chan dofusMsg) {
+	t.Helper()
+	addr, name := *collectorAddr, *agentName
+	*collectorAddr, *agentName = address, "test-agent"
+	t.Cleanup(func() { *collectorAddr, *agentName = addr, name })
+
+	inbox := make(chan dofusMsg)
+	am := new(agentModule)
+	if err := am.Start(context.Background(), &moduleEnv{Inbox: inbox, Log: log.New(io.Discard, "", 0)}); err != nil {
+		t.Fatal(err)
+	}
+	return am, inbox
+}
+
+func agentMessages(n int) []dofusMsg {
+	messages := make([]dofusMsg, n)
+	for i := range messages {
+		messages[i] = dofusMsg{ProtocolId: nameIdMap["BasicPingMessage"], body: []byte{1}, Client: "10.0.0.1:4001", Seq: uint64(i + 1)}
+	}
+	return messages
+}
+
+// Messages go through the collector once, in order
+func TestAgentCollector(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus = newMessageBus()
+	sub := bus.Subscribe("test", queueOptions{size: 16, policy: policyBlock})
+	ctx, cancel := context.WithCancel(context.Background())
+	collected := make(chan error)
+	go func() { collected <- serveCollector(ctx, listener) }()
+
+	published := make(chan []dofusMsg)
+	go func() {
+		var received []dofusMsg
+		for msg := range sub.C {
+			received = append(received, msg)
+		}
+		published <- received
+	}()
+
+	am, inbox := startAgent(t, listener.Addr().String())
+	messages := agentMessages(50)
+	for _, msg := range messages {
+		inbox <- msg
+	}
+	close(inbox)
+	if err := am.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-collected; err != nil {
+		t.Fatal(err)
+	}
+	bus.Close()
+
+	received := <-published
+	if len(received) != len(messages) {
+		t.Fatalf("collector published %d messages, want %d", len(received), len(messages))
+	}
+	for i, msg := range received {
+		if msg.Seq != messages[i].Seq || msg.Source != "test-agent" {
+			t.Errorf("message %d: seq %d from %q", i, msg.Seq, msg.Source)
+		}
+	}
+}
+
+// Messages written on a connection that breaks before they are acknowledged
+// are sent again
+func TestAgentResend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	const total, beforeBreak = 10, 4
+	received := make(chan []uint64)
+	go func() {
+		var ids []uint64
+		for connection := 0; len(ids) < total; connection++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			scanner := bufio.NewScanner(conn)
+			scanner.Scan() // hello
+			for scanner.Scan() {
+				var remote remoteMsg
+				json.Unmarshal(scanner.Bytes(), &remote)
+				if connection == 0 {
+					// Broken before acknowledging anything
+					if remote.ID == beforeBreak {
+						break
+					}
+					continue
+				}
+				ids = append(ids, remote.ID)
+				ack, _ := json.Marshal(collectorAck{Ack: remote.ID})
+				conn.Write(append(ack, '\n'))
+				if len(ids) == total {
+					break
+				}
+			}
+			conn.Close()
+		}
+		received <- ids
+	}()
+
+	am, inbox := startAgent(t, listener.Addr().String())
+	for _, msg := range agentMessages(total) {
+		inbox <- msg
+	}
+	var ids []uint64
+	select {
+	case ids = <-received:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the messages were not sent again")
+	}
+	close(inbox)
+	if err := am.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range ids {
+		if id != uint64(i+1) {
+			t.Fatalf("second connection got %v, want every message in order", ids)
+		}
+	}
+}
+
+func TestStartModulesTwice(t *testing.T) {
+	config := &rpsConfig{}
+	if _, err := startModules(context.Background(), newMessageBus(), []string{"timeline", "timeline"}, config); err == nil {
+		t.Error("a module enabled twice was started")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+var apiAddr = flag.String("api", "", "Address of the HTTP API (e.g. localhost:8555), disabled if empty")
+
+// Routes of the HTTP API. Features register theirs from an init function.
+var apiMux = http.NewServeMux()
+
+func init() {
+	apiMux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, stats.Snapshot())
+	})
+}
+
+// Writes v as the JSON body of the response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("api: %s", err)
+	}
+}
+
+// Writes an error as a JSON body
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+// startAPI serves the API on -api until ctx is done. The returned function
+// waits for the server to be shut down.
+func startAPI(ctx context.Context) (wait func(), err error) {
+	if *apiAddr == "" {
+		return func() {}, nil
+	}
+	listener, err := net.Listen("tcp", *apiAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: apiMux}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		log.Printf("api listening on http://%s", listener.Addr())
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("api: %s", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	return func() { <-done }, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+func init() {
+	registerModule("archive", func() Module { return new(archiveModule) })
+}
+
+// Default file of the archive, relative to the working directory
+const defaultArchivePath = "rps-archive.sqlite"
+
+// Messages are inserted by transactions of at most archiveBatchSize
+// messages, committed at least every archiveFlushInterval
+const (
+	archiveBatchSize     = 500
+	archiveFlushInterval = time.Second
+)
+
+const archiveSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	id          INTEGER PRIMARY KEY,
+	time        INTEGER NOT NULL, -- Capture time, Unix nanoseconds
+	session     TEXT NOT NULL,    -- Client endpoint, prefixed by the agent if any
+	character   TEXT NOT NULL,    -- Character played in the session, if known
+	server      TEXT NOT NULL,
+	seq         INTEGER NOT NULL, -- Position in the session timeline
+	direction   TEXT NOT NULL,    -- client->server or server->client
+	protocol_id INTEGER NOT NULL,
+	name        TEXT NOT NULL,
+	namespace   TEXT NOT NULL,
+	body        TEXT,             -- Decoded fields as JSON, NULL if decoding failed
+	error       TEXT,             -- Why decoding failed
+	raw         BLOB NOT NULL     -- Message body as captured
+);
+CREATE INDEX IF NOT EXISTS messages_name ON messages (name, time);
+CREATE INDEX IF NOT EXISTS messages_time ON messages (time);
+CREATE INDEX IF NOT EXISTS messages_session ON messages (session, time);
+CREATE INDEX IF NOT EXISTS messages_character ON messages (character, time);
+`
+
+const archiveInsert = `INSERT INTO messages
+	(time, session, character, server, seq, direction, protocol_id, name, namespace, body, error, raw)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+type archiveOptions struct {
+	Path string `json:"path"`
+}
+
+// Opens the SQLite archive at path, creating it if needed
+func openArchive(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(archiveSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create the archive schema in %s - %w", path, err)
+	}
+	return db, nil
+}
+
+// Opens the existing SQLite archive at path read-only, as is, for the queries
+func openArchiveReadOnly(path string) (*sql.DB, error) {
+	return sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+}
+
+// archiveModule stores every decoded message in a SQLite database
+type archiveModule struct {
+	env        *moduleEnv
+	db         *sql.DB
+	characters *characterTracker
+	done       chan struct{}
+	err        error
+}
+
+func (am *archiveModule) Name() string {
+	return "archive"
+}
+
+func (am *archiveModule) Subscriptions() []messageFilter {
+	return nil
+}
+
+// The character of a session is forgotten at its end
+func (am *archiveModule) subscribeSessionEnds() {}
+
+func (am *archiveModule) Start(ctx context.Context, env *moduleEnv) error {
+	options := archiveOptions{Path: defaultArchivePath}
+	if err := env.decodeOptions(&options); err != nil {
+		return err
+	}
+	db, err := openArchive(options.Path)
+	if err != nil {
+		return err
+	}
+	env.Log.Printf("archiving to %s", options.Path)
+
+	am.env = env
+	am.db = db
+	am.characters = newCharacterTracker()
+	am.done = make(chan struct{})
+	go am.archive()
+	return nil
+}
+
+func (am *archiveModule) Stop() error {
+	<-am.done
+	if err := am.db.Close(); err != nil && am.err == nil {
+		am.err = err
+	}
+	return am.err
+}
+
+// Inserts the messages of the inbox by batches until it is closed
+func (am *archiveModule) archive() {
+	defer close(am.done)
+	ticker := time.NewTicker(archiveFlushInterval)
+	defer ticker.Stop()
+
+	var batch []dofusMsg
+	for {
+		select {
+		case msg, ok := <-am.env.Inbox:
+			if !ok {
+				am.insert(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) < archiveBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		am.insert(batch)
+		batch = batch[:0]
+	}
+}
+
+// Inserts a batch of messages in a single transaction. Failures are logged
+// and the batch dropped.
+func (am *archiveModule) insert(batch []dofusMsg) {
+	if len(batch) == 0 {
+		return
+	}
+	err := func() error {
+		tx, err := am.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(archiveInsert)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		for i := range batch {
+			msg := &batch[i]
+			if msg.Closed {
+				am.characters.Forget(msg.Session())
+				continue
+			}
+			var body, decodeErr interface{}
+			if fields, err := msg.JSON(); err != nil {
+				decodeErr = err.Error()
+			} else {
+				body = string(fields)
+			}
+			raw := msg.body
+			if raw == nil {
+				raw = []byte{}
+			}
+			_, err = stmt.Exec(msg.Timestamp.UnixNano(), msg.Session(), am.characters.Observe(msg),
+				msg.Server, msg.Seq, msg.Direction.String(), msg.ProtocolId, msg.Name(), msg.Namespace(),
+				body, decodeErr, raw)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		am.env.Log.Printf("could not archive %d messages - %s", len(batch), err)
+		am.err = err
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Messages are inserted by batches and read back as written
+func TestArchiveBatches(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	messages := []dofusMsg{characterSelected(t, game, "Aled")}
+	count := 2*archiveBatchSize + 3
+	for i := 1; i < count; i++ {
+		msg := testMessage(t, "KamasUpdateMessage", dirServerToClient, game, 0, new(bodyEncoder).varint(uint64(i)))
+		msg.Timestamp = testEpoch.Add(time.Duration(i) * time.Millisecond)
+		msg.Seq = uint64(i)
+		messages = append(messages, msg)
+	}
+	// Not decoded
+	truncated := chatReceived(t, game, 10, 0, "Bob", "hello", testEpoch, "f1")
+	truncated.body = truncated.body[:5]
+	messages = append(messages, truncated, dofusMsg{Timestamp: testEpoch.Add(11 * time.Second), Client: game, Closed: true, Ending: endClosed})
+
+	path := filepath.Join(t.TempDir(), "archive.sqlite")
+	runModule(t, new(archiveModule), `{"path": "`+path+`"}`, messages)
+
+	db, err := openArchiveReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT time, character, seq, name, body, error, raw FROM messages ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	read := 0
+	for ; rows.Next(); read++ {
+		var nanos int64
+		var seq uint64
+		var character, name string
+		var body, decodeErr sql.NullString
+		var raw []byte
+		if err := rows.Scan(&nanos, &character, &seq, &name, &body, &decodeErr, &raw); err != nil {
+			t.Fatal(err)
+		}
+		if read >= count+1 {
+			continue
+		}
+		msg := &messages[read]
+		if nanos != msg.Timestamp.UnixNano() || seq != msg.Seq || name != msg.Name() || !bytes.Equal(raw, msg.body) {
+			t.Errorf("row %d: %s at %d, seq %d, want %s at %d, seq %d", read, name, nanos, seq, msg.Name(), msg.Timestamp.UnixNano(), msg.Seq)
+		}
+		if character != "Aled" {
+			t.Errorf("row %d of %q", read, character)
+		}
+		if _, err := msg.JSON(); (err != nil) != (decodeErr.Valid && !body.Valid) {
+			t.Errorf("row %d: body %v, error %v", read, body, decodeErr)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// The end of the session is not stored
+	if read != count+1 {
+		t.Errorf("%d rows, want %d", read, count+1)
+	}
+
+	if _, err := db.Exec("DELETE FROM messages"); err == nil {
+		t.Error("archive opened read-write")
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// messageFilter selects the messages a subscriber is interested in
+type messageFilter func(msg *dofusMsg) bool
+
+// Matches messages by protocol name (e.g. "ChatServerMessage")
+func byName(names ...string) messageFilter {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(msg *dofusMsg) bool {
+		return set[msg.Name()]
+	}
+}
+
+// Matches messages by protocol id
+func byProtocolId(ids ...uint16) messageFilter {
+	set := make(map[uint16]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return func(msg *dofusMsg) bool {
+		return set[msg.ProtocolId]
+	}
+}
+
+// Matches messages living in a namespace or one of its children, e.g.
+// "game.context.fight" matches "game.context.fight.challenge"
+func byNamespace(prefix string) messageFilter {
+	return func(msg *dofusMsg) bool {
+		namespace := msg.Namespace()
+		return namespace == prefix || strings.HasPrefix(namespace, prefix+".")
+	}
+}
+
+// Matches messages for which the predicate returns true
+func byPredicate(predicate func(msg *dofusMsg) bool) messageFilter {
+	return messageFilter(predicate)
+}
+
+// Matches messages for which the filter expression holds
+func byExpression(expr *filterExpr) messageFilter {
+	return func(msg *dofusMsg) bool {
+		return expr.Match(msg)
+	}
+}
+
+// Matches messages matching all the filters
+func matchAll(filters ...messageFilter) messageFilter {
+	return func(msg *dofusMsg) bool {
+		for _, filter := range filters {
+			if !filter(msg) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Matches messages matching any of the filters, everything if there is none
+func matchAny(filters ...messageFilter) messageFilter {
+	return func(msg *dofusMsg) bool {
+		if len(filters) == 0 {
+			return true
+		}
+		for _, filter := range filters {
+			if filter(msg) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// A subscription receives the messages matching any of its filters (all
+// of them if there is none) on its own channel, fed from a bounded queue
+// whose policy decides what happens when the subscriber does not keep up.
+type subscription struct {
+	id      int
+	name    string
+	filters []messageFilter
+	C       chan dofusMsg
+
+	sessionEnds bool // Receives the messages marking the end of sessions
+
+	queue     *boundedQueue[dofusMsg]
+	delivered atomic.Uint64
+}
+
+// Moves queued messages to the channel, closing it once the queue is
+// closed and drained
+func (sub *subscription) pump() {
+	defer close(sub.C)
+	for {
+		msg, ok := sub.queue.Pop()
+		if !ok {
+			return
+		}
+		sub.C <- msg
+		sub.delivered.Add(1)
+	}
+}
+
+func (sub *subscription) matches(msg *dofusMsg) bool {
+	if len(sub.filters) == 0 {
+		return true
+	}
+	for _, filter := range sub.filters {
+		if filter(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dropped returns the number of messages lost because the subscriber did
+// not keep up
+func (sub *subscription) Dropped() uint64 {
+	return sub.queue.Dropped()
+}
+
+// Pending returns the number of messages waiting in the queue
+func (sub *subscription) Pending() int {
+	return sub.queue.Len()
+}
+
+// Delivered returns the number of messages sent to the subscriber
+func (sub *subscription) Delivered() uint64 {
+	return sub.delivered.Load()
+}
+
+// messageBus dispatches decoded messages to subscribers
+type messageBus struct {
+	mu     sync.RWMutex
+	subs   map[int]*subscription
+	nextId int
+	closed bool
+}
+
+func newMessageBus() *messageBus {
+	return &messageBus{
+		subs: make(map[int]*subscription),
+	}
+}
+
+// Subscribe registers a new subscriber, the options set the size and
+// policy of its queue. The subscriber must read C until it is closed.
+func (mb *messageBus) Subscribe(name string, options queueOptions, filters ...messageFilter) *subscription {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.nextId++
+	sub := &subscription{
+		id:      mb.nextId,
+		name:    name,
+		filters: filters,
+		C:       make(chan dofusMsg),
+		queue:   newBoundedQueue[dofusMsg](pipelineStage("modules"), options),
+	}
+	go sub.pump()
+	if mb.closed {
+		sub.queue.Close()
+		return sub
+	}
+	mb.subs[sub.id] = sub
+	return sub
+}
+
+// SubscribeSessionEnds has the end of every session delivered to sub, see
+// dofusMsg.Closed
+func (mb *messageBus) SubscribeSessionEnds(sub *subscription) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	sub.sessionEnds = true
+}
+
+// Unsubscribe removes a subscriber. Its channel is closed once the
+// messages already queued are delivered.
+func (mb *messageBus) Unsubscribe(sub *subscription) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if _, ok := mb.subs[sub.id]; !ok {
+		return
+	}
+	delete(mb.subs, sub.id)
+	sub.queue.Close()
+}
+
+// Publish hands a message to every matching subscriber. The end of a
+// session only goes to the subscribers asking for it. The bus is not locked
+// while the message is pushed, as a full queue may block.
+func (mb *messageBus) Publish(msg dofusMsg) {
+	mb.mu.RLock()
+	subs := make([]*subscription, 0, len(mb.subs))
+	for _, sub := range mb.subs {
+		if !msg.Closed || sub.sessionEnds {
+			subs = append(subs, sub)
+		}
+	}
+	mb.mu.RUnlock()
+
+	for _, sub := range subs {
+		if msg.Closed || sub.matches(&msg) {
+			sub.queue.Push(msg)
+		}
+	}
+}
+
+// Subscriptions returns the current subscribers
+func (mb *messageBus) Subscriptions() []*subscription {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+
+	subs := make([]*subscription, 0, len(mb.subs))
+	for _, sub := range mb.subs {
+		subs = append(subs, sub)
+	}
+	return subs
+}
+
+// Close unsubscribes everyone, subscribers see their channel closed once
+// they have drained it
+func (mb *messageBus) Close() {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for id, sub := range mb.subs {
+		delete(mb.subs, id)
+		sub.queue.Close()
+	}
+	mb.closed = true
+}
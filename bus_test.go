@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A Publish blocked on a full queue does not hold the bus back
+func TestPublishBlockedQueue(t *testing.T) {
+	mb := newMessageBus()
+	defer mb.Close()
+	// Nobody reads C: the pump holds one message, the queue another one
+	mb.Subscribe("slow", queueOptions{size: 1, policy: policyBlock})
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			mb.Publish(dofusMsg{ProtocolId: uint16(i)})
+		}
+		close(published)
+	}()
+
+	subscribed := make(chan struct{})
+	go func() {
+		mb.Unsubscribe(mb.Subscribe("other", queueOptions{size: 1, policy: policyBlock}))
+		mb.Subscriptions()
+		close(subscribed)
+	}()
+	select {
+	case <-subscribed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Subscribe blocked behind a blocked Publish")
+	}
+	select {
+	case <-published:
+		t.Fatal("Publish did not block on the full queue")
+	default:
+	}
+}
+
+func TestPublishSessionEnds(t *testing.T) {
+	mb := newMessageBus()
+	all := mb.Subscribe("all", queueOptions{size: 8, policy: policyBlock})
+	ends := mb.Subscribe("ends", queueOptions{size: 8, policy: policyBlock}, byProtocolId(1))
+	mb.SubscribeSessionEnds(ends)
+
+	mb.Publish(dofusMsg{ProtocolId: 1})
+	mb.Publish(dofusMsg{ProtocolId: 2})
+	mb.Publish(dofusMsg{Closed: true})
+	mb.Close()
+
+	var gotAll, gotEnds []dofusMsg
+	for msg := range all.C {
+		gotAll = append(gotAll, msg)
+	}
+	for msg := range ends.C {
+		gotEnds = append(gotEnds, msg)
+	}
+	if len(gotAll) != 2 || gotAll[1].ProtocolId != 2 {
+		t.Errorf("all received %v, want the messages without the end", gotAll)
+	}
+	if len(gotEnds) != 2 || gotEnds[0].ProtocolId != 1 || !gotEnds[1].Closed {
+		t.Errorf("ends received %v, want message 1 and the end", gotEnds)
+	}
+}
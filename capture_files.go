@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+// captureFiles is the value of -r: capture files given by repeating the
+// flag, as globs, or "-" for stdin
+type captureFiles []string
+
+func (cf *captureFiles) String() string {
+	return strings.Join(*cf, ",")
+}
+
+func (cf *captureFiles) Set(value string) error {
+	if value == "-" || !strings.ContainsAny(value, "*?[") {
+		*cf = append(*cf, value)
+		return nil
+	}
+	paths, err := filepath.Glob(value)
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("no file matches %q", value)
+	}
+	*cf = append(*cf, paths...)
+	return nil
+}
+
+// Opens a capture file, "-" being stdin
+func openCaptureFile(path string) (*pcap.Handle, error) {
+	if path == "-" {
+		return pcap.OpenOfflineFile(os.Stdin)
+	}
+	return pcap.OpenOffline(path)
+}
+
+// pendingPacket is the next packet of one of the files of a mergedCapture
+type pendingPacket struct {
+	data   []byte
+	ci     gopacket.CaptureInfo
+	handle int
+}
+
+type pendingHeap []pendingPacket
+
+func (ph pendingHeap) Len() int { return len(ph) }
+func (ph pendingHeap) Less(i, j int) bool {
+	if !ph[i].ci.Timestamp.Equal(ph[j].ci.Timestamp) {
+		return ph[i].ci.Timestamp.Before(ph[j].ci.Timestamp)
+	}
+	return ph[i].handle < ph[j].handle
+}
+func (ph pendingHeap) Swap(i, j int)       { ph[i], ph[j] = ph[j], ph[i] }
+func (ph *pendingHeap) Push(x interface{}) { *ph = append(*ph, x.(pendingPacket)) }
+func (ph *pendingHeap) Pop() interface{} {
+	old := *ph
+	packet := old[len(old)-1]
+	*ph = old[:len(old)-1]
+	return packet
+}
+
+// mergedCapture reads several capture files as a single one, their packets
+// ordered by capture time. Implements gopacket.PacketDataSource.
+type mergedCapture struct {
+	paths    []string
+	handles  []*pcap.Handle
+	linkType layers.LinkType
+	pending  pendingHeap
+	started  bool
+}
+
+// Opens the files and applies the BPF filter to each of them. They must all
+// have the same link type.
+func openCaptureFiles(paths []string, bpf string) (*mergedCapture, error) {
+	mc := &mergedCapture{paths: paths}
+	for _, path := range paths {
+		handle, err := openCaptureFile(path)
+		if err != nil {
+			mc.Close()
+			return nil, fmt.Errorf("could not open filename - %v - %s", path, err)
+		}
+		mc.handles = append(mc.handles, handle)
+
+		if len(mc.handles) == 1 {
+			mc.linkType = handle.LinkType()
+		} else if handle.LinkType() != mc.linkType {
+			mc.Close()
+			return nil, fmt.Errorf("%v has link type %v, %v has %v", path, handle.LinkType(), paths[0], mc.linkType)
+		}
+		if bpf != "" {
+			if err = handle.SetBPFFilter(bpf); err != nil {
+				mc.Close()
+				return nil, fmt.Errorf("could not apply filter %v to %v - %s", bpf, path, err)
+			}
+		}
+	}
+	return mc, nil
+}
+
+func (mc *mergedCapture) LinkType() layers.LinkType {
+	return mc.linkType
+}
+
+// Largest snapshot length of the files
+func (mc *mergedCapture) SnapLen() int {
+	snapLen := 0
+	for _, handle := range mc.handles {
+		if handle.SnapLen() > snapLen {
+			snapLen = handle.SnapLen()
+		}
+	}
+	return snapLen
+}
+
+// Reads the next packet of a file into the heap. A file stops at its first
+// error, which is logged unless it is the end of the file.
+func (mc *mergedCapture) fill(index int) {
+	data, ci, err := mc.handles[index].ReadPacketData()
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("%v: %s", mc.paths[index], err)
+		}
+		return
+	}
+	heap.Push(&mc.pending, pendingPacket{data: data, ci: ci, handle: index})
+}
+
+// ReadPacketData returns the oldest packet not read yet among all files
+func (mc *mergedCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if !mc.started {
+		mc.started = true
+		for i := range mc.handles {
+			mc.fill(i)
+		}
+	}
+	if len(mc.pending) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	packet := heap.Pop(&mc.pending).(pendingPacket)
+	mc.fill(packet.handle)
+	return packet.data, packet.ci, nil
+}
+
+func (mc *mergedCapture) Close() {
+	for _, handle := range mc.handles {
+		handle.Close()
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The files are read as one capture, their packets interleaved by time
+func TestMergedCapture(t *testing.T) {
+	const client, server = "192.168.1.5:50000", "172.65.0.1:5555"
+	segment := func(at time.Duration, payload string) testSegment {
+		return testSegment{at: at, src: client, dst: server, seq: 1000, ack: true, payload: []byte(payload)}
+	}
+	tests := []struct {
+		name  string
+		files [][]testSegment
+		want  []string // Payloads in reading order
+	}{
+		{"interleaved", [][]testSegment{
+			{segment(0, "a1"), segment(2*time.Second, "a2"), segment(4*time.Second, "a3")},
+			{segment(time.Second, "b1"), segment(3*time.Second, "b2"), segment(5*time.Second, "b3")},
+		}, []string{"a1", "b1", "a2", "b2", "a3", "b3"}},
+		{"one after the other", [][]testSegment{
+			{segment(3*time.Second, "a1"), segment(4*time.Second, "a2")},
+			{segment(time.Second, "b1"), segment(2*time.Second, "b2")},
+		}, []string{"b1", "b2", "a1", "a2"}},
+		// By file order on ties
+		{"same time", [][]testSegment{
+			{segment(time.Second, "a1"), segment(2*time.Second, "a2")},
+			{segment(time.Second, "b1"), segment(2*time.Second, "b2")},
+		}, []string{"a1", "b1", "a2", "b2"}},
+		{"empty file", [][]testSegment{
+			{},
+			{segment(time.Second, "b1")},
+		}, []string{"b1"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			var paths []string
+			for i, segments := range test.files {
+				path := filepath.Join(dir, string(rune('a'+i))+".pcap")
+				writeTestCapture(t, path, segments)
+				paths = append(paths, path)
+			}
+			files, err := openCaptureFiles(paths, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer files.Close()
+
+			var got []string
+			var last time.Time
+			for {
+				data, ci, err := files.ReadPacketData()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+				got = append(got, string(packet.ApplicationLayer().Payload()))
+				if ci.Timestamp.Before(last) {
+					t.Errorf("%v read after %v", ci.Timestamp, last)
+				}
+				last = ci.Timestamp
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("read %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"sync"
+
+	"github.com/tidwall/gjson"
+)
+
+// characterTracker follows the character played in each session, from the
+// CharacterSelectedSuccessMessage sent by the server once a character is
+// chosen
+type characterTracker struct {
+	mu    sync.Mutex
+	names map[string]string // By session
+}
+
+func newCharacterTracker() *characterTracker {
+	return &characterTracker{names: make(map[string]string)}
+}
+
+// Observe updates the tracker with msg and returns the character of its
+// session, empty if not known yet
+func (ct *characterTracker) Observe(msg *dofusMsg) string {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	if msg.Name() == "CharacterSelectedSuccessMessage" {
+		if body, err := msg.JSON(); err == nil {
+			if name := gjson.GetBytes(body, "infos.name").String(); name != "" {
+				ct.names[msg.Session()] = name
+			}
+		}
+	}
+	return ct.names[msg.Session()]
+}
+
+// Forget drops what is known of session, once it has ended
+func (ct *characterTracker) Forget(session string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	delete(ct.names, session)
+}
+
+// gameServerTracker follows the game server of each session. The server is
+// chosen on the login connection (ServerSelectionMessage, then
+// SelectedServerDataMessage), after which the client opens a new connection
+// to the game server: a session gets the server last chosen from its host
+// when it is first seen.
+type gameServerTracker struct {
+	mu       sync.Mutex
+	hosts    map[string]string // Last server chosen, by agent and client IP
+	sessions map[string]string
+}
+
+func newGameServerTracker() *gameServerTracker {
+	return &gameServerTracker{hosts: make(map[string]string), sessions: make(map[string]string)}
+}
+
+// Observe updates the tracker with msg and returns the id of the game server
+// of its session, empty if not known
+func (gst *gameServerTracker) Observe(msg *dofusMsg) string {
+	gst.mu.Lock()
+	defer gst.mu.Unlock()
+
+	host := msg.Client
+	if ip, _, err := net.SplitHostPort(msg.Client); err == nil {
+		host = ip
+	}
+	host = msg.Source + "/" + host
+
+	switch msg.Name() {
+	case "ServerSelectionMessage", "SelectedServerDataMessage":
+		if body, err := msg.JSON(); err == nil {
+			if id := gjson.GetBytes(body, "serverId"); id.Exists() {
+				gst.hosts[host] = id.String()
+				gst.sessions[msg.Session()] = id.String()
+			}
+		}
+	}
+
+	server, ok := gst.sessions[msg.Session()]
+	if !ok {
+		server = gst.hosts[host]
+		if server != "" {
+			gst.sessions[msg.Session()] = server
+		}
+	}
+	return server
+}
+
+// Forget drops what is known of session, once it has ended. The server last
+// chosen from its host is kept for the sessions to come.
+func (gst *gameServerTracker) Forget(session string) {
+	gst.mu.Lock()
+	defer gst.mu.Unlock()
+	delete(gst.sessions, session)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestTrackers(t *testing.T) {
+	const login, game = "192.168.1.142:50000", "192.168.1.142:50001"
+	selection := testMessage(t, "ServerSelectionMessage", dirClientToServer, login, 0, new(bodyEncoder).varint(291))
+	character := characterSelected(t, game, "Aled")
+	other := testMessage(t, "BasicAckMessage", dirServerToClient, game, 2, new(bodyEncoder).varint(1).varint(2))
+
+	servers := newGameServerTracker()
+	characters := newCharacterTracker()
+	tests := []struct {
+		name          string
+		msg           *dofusMsg
+		forget        string
+		wantServer    string
+		wantCharacter string
+	}{
+		{"server chosen", &selection, "", "291", ""},
+		{"game session on the same host", &character, "", "291", "Aled"},
+		{"later message", &other, "", "291", "Aled"},
+		{"session ended", &other, game, "291", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.forget != "" {
+				servers.Forget(test.forget)
+				characters.Forget(test.forget)
+				if len(servers.sessions) != 1 || len(characters.names) != 0 {
+					t.Errorf("%d server sessions and %d characters left", len(servers.sessions), len(characters.names))
+				}
+			}
+			// The server last chosen from the host outlives its sessions
+			if server := servers.Observe(test.msg); server != test.wantServer {
+				t.Errorf("server %q, want %q", server, test.wantServer)
+			}
+			if name := characters.Observe(test.msg); name != test.wantCharacter {
+				t.Errorf("character %q, want %q", name, test.wantCharacter)
+			}
+		})
+	}
+}
+
+func TestModulesForgetEndedSessions(t *testing.T) {
+	const login, game = "192.168.1.142:50000", "192.168.1.142:50001"
+	messages := func() []dofusMsg {
+		return []dofusMsg{
+			testMessage(t, "ServerSelectionMessage", dirClientToServer, login, 0, new(bodyEncoder).varint(291)),
+			characterSelected(t, game, "Aled"),
+			testMessage(t, "AccountCapabilitiesMessage", dirServerToClient, game, 2,
+				new(bodyEncoder).byte(0).int(42).byte(0)),
+			testMessage(t, "CurrentMapMessage", dirServerToClient, game, 3, new(bodyEncoder).double(154010883)),
+			{Timestamp: testEpoch.Add(10e9), Client: login, Closed: true, Ending: endClosed},
+			{Timestamp: testEpoch.Add(10e9), Client: game, Closed: true, Ending: endClosed},
+		}
+	}
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		module  Module
+		options string
+		// Sessions still known once they all ended
+		left func(module Module) int
+	}{
+		{"prices", new(pricesModule), `{"path": "` + filepath.Join(dir, "prices.json") + `"}`, func(m Module) int {
+			pm := m.(*pricesModule)
+			return len(pm.lots) + len(pm.listings) + len(pm.servers.sessions) + len(pm.characters.names)
+		}},
+		{"inventory", new(inventoryModule), `{"path": ""}`, func(m Module) int {
+			im := m.(*inventoryModule)
+			return len(im.accounts) + len(im.maps) + len(im.elements) + len(im.storages) + len(im.servers.sessions) + len(im.characters.names)
+		}},
+		{"ledger", new(ledgerModule), `{"path": "` + filepath.Join(dir, "ledger.ndjson") + `"}`, func(m Module) int {
+			lm := m.(*ledgerModule)
+			return len(lm.sellers) + len(lm.servers.sessions) + len(lm.characters.names)
+		}},
+		{"chat", new(chatModule), `{"path": "", "digest": false}`, func(m Module) int {
+			cm := m.(*chatModule)
+			return len(cm.servers.sessions) + len(cm.characters.names)
+		}},
+		{"summary", new(summaryModule), `{"path": "", "print": false}`, func(m Module) int {
+			sm := m.(*summaryModule)
+			return len(sm.sessions) + len(sm.servers.sessions)
+		}},
+		{"ndjson", new(ndjsonModule), `{"dir": "` + filepath.Join(dir, "logs") + `"}`, func(m Module) int {
+			return len(m.(*ndjsonModule).characters.names)
+		}},
+		{"archive", new(archiveModule), `{"path": "` + filepath.Join(dir, "archive.sqlite") + `"}`, func(m Module) int {
+			return len(m.(*archiveModule).characters.names)
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, ok := test.module.(sessionEndSubscriber); !ok {
+				t.Fatal("not told of session ends")
+			}
+			runModule(t, test.module, test.options, messages())
+			if left := test.left(test.module); left != 0 {
+				t.Errorf("%d entries left", left)
+			}
+		})
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerModule("chat", func() Module { return new(chatModule) })
+}
+
+// Names of the chat channels (ChatActivableChannelsEnum)
+var chatChannels = map[int64]string{
+	0: "global", 1: "team", 2: "guild", 3: "alliance", 4: "party", 5: "sales", 6: "seek", 7: "noob",
+	8: "admin", 9: "private", 10: "info", 11: "fight", 12: "ads", 13: "arena", 14: "community",
+}
+
+func chatChannelName(channel int64) string {
+	if name, ok := chatChannels[channel]; ok {
+		return name
+	}
+	return strconv.FormatInt(channel, 10)
+}
+
+// Resolves channel names or numbers to channel names
+func parseChatChannels(channels []string) (map[string]bool, error) {
+	if len(channels) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		if id, err := strconv.ParseInt(channel, 10, 64); err == nil {
+			channel = chatChannelName(id)
+		} else if !chatChannelKnown(channel) {
+			return nil, fmt.Errorf("unknown chat channel %q", channel)
+		}
+		set[channel] = true
+	}
+	return set, nil
+}
+
+func chatChannelKnown(name string) bool {
+	for _, known := range chatChannels {
+		if known == name {
+			return true
+		}
+	}
+	return false
+}
+
+// chatLine is a chat message as logged
+type chatLine struct {
+	Time      time.Time `json:"time"`
+	Session   string    `json:"session"`
+	Server    string    `json:"server"`
+	Character string    `json:"character"` // Who received it
+	Channel   string    `json:"channel"`
+	Sender    string    `json:"sender"`
+	SenderId  uint64    `json:"senderId,omitempty"`
+	Account   uint64    `json:"senderAccountId,omitempty"`
+	Receiver  string    `json:"receiver,omitempty"` // Of the private messages we sent
+	Text      string    `json:"text"`
+	Objects   []uint64  `json:"objects,omitempty"` // GIDs of the items shown
+}
+
+// chatWatch notifies the chat messages matching keywords or a regular
+// expression, e.g. {"name": "aled", "keywords": ["ALED"], "channels": ["global"]}
+type chatWatch struct {
+	Name     string   `json:"name"`
+	Keywords []string `json:"keywords"` // Matched without case
+	Pattern  string   `json:"regexp"`
+	Channels []string `json:"channels"` // Names or numbers, all if empty
+	Notify   *bool    `json:"notify"`   // Notify every match, true if not set
+
+	pattern  *regexp.Regexp
+	channels map[string]bool
+}
+
+// compile checks the watch and records its name in names, the watches are
+// told apart by name in the notifications
+func (cw *chatWatch) compile(index int, names map[string]bool) error {
+	if cw.Name == "" {
+		cw.Name = fmt.Sprintf("watch %d", index+1)
+	}
+	if names[cw.Name] {
+		return fmt.Errorf("%s: watch defined twice", cw.Name)
+	}
+	names[cw.Name] = true
+	if len(cw.Keywords) == 0 && cw.Pattern == "" {
+		return fmt.Errorf("%s: needs keywords or a regexp", cw.Name)
+	}
+	for i, keyword := range cw.Keywords {
+		cw.Keywords[i] = strings.ToLower(keyword)
+	}
+	if cw.Pattern != "" {
+		pattern, err := regexp.Compile(cw.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s: %w", cw.Name, err)
+		}
+		cw.pattern = pattern
+	}
+	channels, err := parseChatChannels(cw.Channels)
+	if err != nil {
+		return fmt.Errorf("%s: %w", cw.Name, err)
+	}
+	cw.channels = channels
+	return nil
+}
+
+func (cw *chatWatch) matches(line *chatLine) bool {
+	if cw.channels != nil && !cw.channels[line.Channel] {
+		return false
+	}
+	text := strings.ToLower(line.Text)
+	for _, keyword := range cw.Keywords {
+		if strings.Contains(text, keyword) {
+			return true
+		}
+	}
+	return cw.pattern != nil && cw.pattern.MatchString(line.Text)
+}
+
+// chatDigest sums up a day of chat
+type chatDigest struct {
+	Day      string                    `json:"day"`
+	Messages map[string]int            `json:"messages"` // By channel
+	Watches  map[string]map[string]int `json:"watches"`  // Matches by watch, then sender
+}
+
+func newChatDigest(day string) *chatDigest {
+	return &chatDigest{Day: day, Messages: make(map[string]int), Watches: make(map[string]map[string]int)}
+}
+
+func (cd *chatDigest) notification(watches []chatWatch, partial bool) notification {
+	title := "Chat digest of " + cd.Day
+	if partial {
+		title += " so far"
+	}
+	var total int
+	channels := make([]string, 0, len(cd.Messages))
+	for channel, count := range cd.Messages {
+		total += count
+		channels = append(channels, channel)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if cd.Messages[channels[i]] != cd.Messages[channels[j]] {
+			return cd.Messages[channels[i]] > cd.Messages[channels[j]]
+		}
+		return channels[i] < channels[j]
+	})
+	parts := make([]string, len(channels))
+	for i, channel := range channels {
+		parts[i] = fmt.Sprintf("%s %d", channel, cd.Messages[channel])
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d messages (%s)", total, strings.Join(parts, ", "))
+	for _, watch := range watches {
+		senders := cd.Watches[watch.Name]
+		fmt.Fprintf(&b, "; %s: %s", watch.Name, formatChatSenders(senders))
+	}
+	return notification{
+		Time:    time.Now(),
+		Kind:    "chat-digest",
+		Title:   title,
+		Message: b.String(),
+		Fields:  map[string]interface{}{"day": cd.Day, "messages": cd.Messages, "watches": cd.Watches},
+	}
+}
+
+// Formats the matches of a watch as "12 by 3 players (Foo 8, Bar 3, Baz 1)"
+func formatChatSenders(senders map[string]int) string {
+	if len(senders) == 0 {
+		return "none"
+	}
+	names := make([]string, 0, len(senders))
+	var total int
+	for name, count := range senders {
+		names = append(names, name)
+		total += count
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if senders[names[i]] != senders[names[j]] {
+			return senders[names[i]] > senders[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = fmt.Sprintf("%s %d", name, senders[name])
+	}
+	return fmt.Sprintf("%d by %d players (%s)", total, len(names), strings.Join(parts, ", "))
+}
+
+type chatOptions struct {
+	Path     string           `json:"path"`     // Chat log, JSON lines, not stored if empty
+	Print    bool             `json:"print"`    // Print the messages on the standard output, false by default
+	Channels []string         `json:"channels"` // Channels to log, all if empty
+	Watches  []chatWatch      `json:"watches"`
+	Digest   bool             `json:"digest"` // Send a digest of every day
+	Notify   []notifierConfig `json:"notify"`
+}
+
+// How long a message is remembered to drop it when another of our
+// characters receives it too
+const chatDuplicateWindow = 10 * time.Minute
+
+// chatModule logs the chat messages received by every character, notifies
+// those matching the watch lists and sends a digest of every day, e.g. with
+// the options
+//
+//	{"channels": ["global", "sales", "community"],
+//	 "watches": [{"name": "aled", "keywords": ["ALED"], "channels": ["global"], "notify": false}],
+//	 "notify": [{"type": "webhook", "url": "http://127.0.0.1:8099/"}]}
+type chatModule struct {
+	baseModule
+	options    chatOptions
+	channels   map[string]bool
+	file       *os.File
+	writer     *bufio.Writer
+	notifiers  *notifierSet
+	servers    *gameServerTracker
+	characters *characterTracker
+	recent     map[string]time.Time // Messages logged lately, to drop duplicates
+	pruned     time.Time
+	digest     *chatDigest
+}
+
+func (cm *chatModule) Name() string {
+	return "chat"
+}
+
+func (cm *chatModule) Subscriptions() []messageFilter {
+	return []messageFilter{byName(
+		"ServerSelectionMessage", "SelectedServerDataMessage", "CharacterSelectedSuccessMessage",
+		"ChatServerMessage", "ChatServerWithObjectMessage", "ChatServerCopyMessage", "ChatServerCopyWithObjectMessage",
+	)}
+}
+
+// The character and server of a session are forgotten at its end
+func (cm *chatModule) subscribeSessionEnds() {}
+
+func (cm *chatModule) Start(ctx context.Context, env *moduleEnv) error {
+	cm.options = chatOptions{Path: "rps-chat.ndjson", Digest: true}
+	if err := env.decodeOptions(&cm.options); err != nil {
+		return err
+	}
+	channels, err := parseChatChannels(cm.options.Channels)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(cm.options.Watches))
+	for i := range cm.options.Watches {
+		if err := cm.options.Watches[i].compile(i, names); err != nil {
+			return err
+		}
+	}
+	if cm.options.Path != "" {
+		file, err := os.OpenFile(cm.options.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		cm.file = file
+		cm.writer = bufio.NewWriter(file)
+	}
+	notifiers, err := newNotifierSet(cm.options.Notify, env.Log)
+	if err != nil {
+		if cm.file != nil {
+			cm.file.Close()
+		}
+		return err
+	}
+
+	cm.channels = channels
+	cm.notifiers = notifiers
+	cm.servers = newGameServerTracker()
+	cm.characters = newCharacterTracker()
+	cm.recent = make(map[string]time.Time)
+	cm.run(env, cm.observe)
+	return nil
+}
+
+func (cm *chatModule) Stop() error {
+	cm.baseModule.Stop()
+	if cm.digest != nil && cm.options.Digest {
+		cm.notifiers.Notify(cm.digest.notification(cm.options.Watches, true))
+	}
+	cm.notifiers.Close()
+	if cm.file == nil {
+		return nil
+	}
+	err := cm.writer.Flush()
+	if closeErr := cm.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (cm *chatModule) observe(msg dofusMsg) {
+	if msg.Closed {
+		cm.servers.Forget(msg.Session())
+		cm.characters.Forget(msg.Session())
+		return
+	}
+	server := cm.servers.Observe(&msg)
+	character := cm.characters.Observe(&msg)
+	if !strings.HasPrefix(msg.Name(), "ChatServer") {
+		return
+	}
+	body, err := msg.JSON()
+	if err != nil {
+		return
+	}
+	fields := gjson.ParseBytes(body)
+
+	line := chatLine{
+		Time:      msg.Timestamp,
+		Session:   msg.Session(),
+		Server:    server,
+		Character: character,
+		Channel:   chatChannelName(fields.Get("channel").Int()),
+		Sender:    fields.Get("senderName").String(),
+		SenderId:  fields.Get("senderId").Uint(),
+		Account:   fields.Get("senderAccountId").Uint(),
+		Receiver:  fields.Get("receiverName").String(),
+		Text:      fields.Get("content").String(),
+	}
+	if timestamp := fields.Get("timestamp").Int(); timestamp > 0 {
+		line.Time = time.Unix(timestamp, 0)
+	}
+	if strings.HasPrefix(msg.Name(), "ChatServerCopy") {
+		// A message we sent
+		line.Sender = character
+	}
+	for _, object := range fields.Get("objects").Array() {
+		line.Objects = append(line.Objects, object.Get("objectGID").Uint())
+	}
+	if cm.channels != nil && !cm.channels[line.Channel] {
+		return
+	}
+	key := fmt.Sprintf("%s/%s/%s/%s/%d", server, line.Channel, line.Sender, fields.Get("fingerprint").String(), line.Time.Unix())
+	if cm.duplicate(key, msg.Timestamp) {
+		return
+	}
+
+	if cm.options.Print {
+		sender := line.Sender
+		if line.Receiver != "" {
+			sender += " -> " + line.Receiver
+		}
+		fmt.Printf("%s [%s] %s: %s\n", line.Time.Local().Format(time.TimeOnly), line.Channel, sender, line.Text)
+	}
+	if cm.writer != nil {
+		cm.write(&line)
+	}
+	cm.count(&line)
+}
+
+// Tells if the message was already logged, e.g. received by another of our
+// characters
+func (cm *chatModule) duplicate(key string, now time.Time) bool {
+	if now.Sub(cm.pruned) > chatDuplicateWindow {
+		for recentKey, at := range cm.recent {
+			if now.Sub(at) > chatDuplicateWindow {
+				delete(cm.recent, recentKey)
+			}
+		}
+		cm.pruned = now
+	}
+	if _, ok := cm.recent[key]; ok {
+		return true
+	}
+	cm.recent[key] = now
+	return false
+}
+
+func (cm *chatModule) write(line *chatLine) {
+	bytes, err := json.Marshal(line)
+	if err == nil {
+		_, err = cm.writer.Write(append(bytes, '\n'))
+	}
+	if err == nil {
+		err = cm.writer.Flush()
+	}
+	if err != nil {
+		cm.env.Log.Printf("could not write to %s - %s", cm.options.Path, err)
+	}
+}
+
+// Notifies the watches matched and counts the message in the digest of its
+// day, sending the digest of the day before once the day changes
+func (cm *chatModule) count(line *chatLine) {
+	day := line.Time.Local().Format(time.DateOnly)
+	if cm.digest == nil || day > cm.digest.Day {
+		if cm.digest != nil && cm.options.Digest {
+			cm.notifiers.Notify(cm.digest.notification(cm.options.Watches, false))
+		}
+		cm.digest = newChatDigest(day)
+	}
+	cm.digest.Messages[line.Channel]++
+
+	for i := range cm.options.Watches {
+		watch := &cm.options.Watches[i]
+		if !watch.matches(line) {
+			continue
+		}
+		senders, ok := cm.digest.Watches[watch.Name]
+		if !ok {
+			senders = make(map[string]int)
+			cm.digest.Watches[watch.Name] = senders
+		}
+		senders[line.Sender]++
+		if watch.Notify != nil && !*watch.Notify {
+			continue
+		}
+		cm.notifiers.Notify(notification{
+			Time:    line.Time,
+			Kind:    "chat",
+			Title:   watch.Name,
+			Message: fmt.Sprintf("[%s] %s: %s", line.Channel, line.Sender, line.Text),
+			Fields: map[string]interface{}{
+				"server": line.Server, "character": line.Character, "channel": line.Channel,
+				"sender": line.Sender, "text": line.Text,
+			},
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Returns a ChatServerMessage received by the character of client
+func chatReceived(t *testing.T, client string, second int, channel byte, sender string, text string, sent time.Time, fingerprint string) dofusMsg {
+	t.Helper()
+	body := new(bodyEncoder).byte(channel).utf(text).int(int32(sent.Unix())).utf(fingerprint)
+	body.double(1234).utf(sender).utf("").int(5678)
+	return testMessage(t, "ChatServerMessage", dirServerToClient, client, second, body)
+}
+
+// Runs the chat module with options, a JSON object, and returns the
+// notifications it sent
+func runChat(t *testing.T, options string, messages []dofusMsg) []notification {
+	t.Helper()
+	var mu sync.Mutex
+	var sent []notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		sent = append(sent, n)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(options), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	decoded["notify"] = []notifierConfig{{Type: "webhook", URL: server.URL}}
+	withNotify, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runModule(t, new(chatModule), string(withNotify), messages)
+	return sent
+}
+
+func TestChatWatches(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	const watches = `{"path": "", "digest": false, "watches": [
+		{"name": "aled", "keywords": ["ALED", "yokoo"]},
+		{"name": "price", "regexp": "\\d+k\\b"},
+		{"name": "sales", "keywords": ["sell"], "channels": ["sales", "6"]},
+		{"name": "quiet", "keywords": ["quiet"], "notify": false}]}`
+	sent := testEpoch.Add(-time.Second)
+	tests := []struct {
+		name    string
+		channel byte
+		text    string
+		want    []string // Watches notified
+	}{
+		{"keyword of another case", 0, "anyone seen aled?", []string{"aled"}},
+		{"second keyword", 0, "YOKOO is back", []string{"aled"}},
+		{"regexp", 0, "buying gelano 250k", []string{"price"}},
+		{"regexp is case sensitive", 0, "buying gelano 250K", nil},
+		{"watched channel", 5, "selling a gelano", []string{"sales"}},
+		{"channel given by number", 6, "sell me a gelano", []string{"sales"}},
+		{"other channel", 0, "selling a gelano", nil},
+		{"several watches", 5, "selling aled's gelano 250k", []string{"aled", "price", "sales"}},
+		{"counted but not notified", 0, "quiet please", nil},
+		{"no match", 0, "hello", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			notifications := runChat(t, watches, []dofusMsg{
+				characterSelected(t, game, "Aled"),
+				chatReceived(t, game, 1, test.channel, "Bob", test.text, sent, "f1"),
+			})
+			var got []string
+			for _, n := range notifications {
+				if n.Kind != "chat" {
+					t.Fatalf("%s notification", n.Kind)
+				}
+				got = append(got, n.Title)
+				if n.Fields["sender"] != "Bob" || n.Fields["character"] != "Aled" || n.Fields["text"] != test.text {
+					t.Errorf("fields %v", n.Fields)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("notified %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChatLog(t *testing.T) {
+	const first, second = "10.0.0.1:4001", "10.0.0.1:4002"
+	sent := testEpoch.Add(-time.Second)
+	selected := []dofusMsg{characterSelected(t, first, "Aled"), characterSelected(t, second, "Yokoo")}
+	// A private message sent by Aled to Bob
+	copied := testMessage(t, "ChatServerCopyMessage", dirServerToClient, first, 1,
+		new(bodyEncoder).byte(9).utf("hi Bob").int(int32(sent.Unix())).utf("f9").varint(4321).utf("Bob"))
+	type logged struct {
+		character string
+		sender    string
+		receiver  string
+		text      string
+	}
+	tests := []struct {
+		name     string
+		messages []dofusMsg
+		want     []logged
+	}{
+		{"received by both our characters", []dofusMsg{
+			chatReceived(t, first, 1, 0, "Bob", "hello", sent, "f1"),
+			chatReceived(t, second, 2, 0, "Bob", "hello", sent, "f1"),
+		}, []logged{{"Aled", "Bob", "", "hello"}}},
+		{"said twice", []dofusMsg{
+			chatReceived(t, first, 1, 0, "Bob", "hello", sent, "f1"),
+			chatReceived(t, second, 2, 0, "Bob", "hello", sent.Add(time.Second), "f2"),
+		}, []logged{{"Aled", "Bob", "", "hello"}, {"Yokoo", "Bob", "", "hello"}}},
+		{"received again after the window", []dofusMsg{
+			chatReceived(t, first, 1, 0, "Bob", "hello", sent, "f1"),
+			chatReceived(t, second, 1+int(chatDuplicateWindow/time.Second)+1, 0, "Bob", "hello", sent, "f1"),
+		}, []logged{{"Aled", "Bob", "", "hello"}, {"Yokoo", "Bob", "", "hello"}}},
+		{"copy of a message sent", []dofusMsg{copied}, []logged{{"Aled", "Aled", "Bob", "hi Bob"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "chat.ndjson")
+			runChat(t, `{"path": "`+path+`", "digest": false}`, append(selected[:2:2], test.messages...))
+
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			var got []logged
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				var line chatLine
+				if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+					t.Fatal(err)
+				}
+				if !line.Time.Equal(sent) && !line.Time.Equal(sent.Add(time.Second)) {
+					t.Errorf("sent at %v", line.Time)
+				}
+				got = append(got, logged{line.Character, line.Sender, line.Receiver, line.Text})
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("logged %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestChatDigest(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	day := time.Date(2024, 4, 7, 12, 0, 0, 0, time.Local)
+	notifications := runChat(t, `{"path": "", "watches": [{"name": "aled", "keywords": ["aled"], "notify": false}]}`, []dofusMsg{
+		characterSelected(t, game, "Yokoo"),
+		chatReceived(t, game, 1, 0, "Bob", "aled?", day, "f1"),
+		chatReceived(t, game, 2, 5, "Bob", "selling aled", day.Add(time.Minute), "f2"),
+		chatReceived(t, game, 3, 0, "Carl", "ALED!", day.Add(2*time.Minute), "f3"),
+		chatReceived(t, game, 4, 0, "Carl", "hello", day.Add(3*time.Minute), "f4"),
+		// The next day
+		chatReceived(t, game, 5, 0, "Bob", "hello", day.Add(24*time.Hour), "f5"),
+	})
+	want := []struct{ title, message string }{
+		{"Chat digest of 2024-04-07", "4 messages (global 3, sales 1); aled: 3 by 2 players (Bob 2, Carl 1)"},
+		{"Chat digest of 2024-04-08 so far", "1 messages (global 1); aled: none"},
+	}
+	if len(notifications) != len(want) {
+		t.Fatalf("%d notifications: %+v", len(notifications), notifications)
+	}
+	for i, n := range notifications {
+		if n.Kind != "chat-digest" || n.Title != want[i].title || n.Message != want[i].message {
+			t.Errorf("%s notification %q: %q, want %q: %q", n.Kind, n.Title, n.Message, want[i].title, want[i].message)
+		}
+	}
+}
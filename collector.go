@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var collectorListen = flag.String("collector-listen", "127.0.0.1:5556", "Collector: address the agents connect to, e.g. :5556 to accept other machines")
+
+// Set by rps collector, messages come from agents instead of a capture
+var collectorMode bool
+
+func init() {
+	registerCommand("collector", func(args []string) int {
+		collectorMode = true
+		return run(args)
+	})
+}
+
+// Longest line accepted from an agent, a message body is base64 encoded
+const collectorMaxLine = 2*maxMsgLen + 4096
+
+// How often the collector acknowledges the messages of an agent
+const collectorAckInterval = 200 * time.Millisecond
+
+// Last message published for each agent instance, so that the messages an
+// agent sends again after a reconnection are only published once
+var agentProgress = struct {
+	sync.Mutex
+	acked map[string]uint64
+}{acked: make(map[string]uint64)}
+
+// runCollector accepts agent connections on -collector-listen and publishes
+// the messages they stream until ctx is cancelled
+func runCollector(ctx context.Context) error {
+	listener, err := net.Listen("tcp", *collectorListen)
+	if err != nil {
+		return fmt.Errorf("could not listen on %v - %s", *collectorListen, err)
+	}
+	return serveCollector(ctx, listener)
+}
+
+// serveCollector publishes the messages of the agents connecting to
+// listener until ctx is cancelled, see runCollector
+func serveCollector(ctx context.Context, listener net.Listener) error {
+	log.Printf("Collecting messages from agents on %s", listener.Addr())
+	stopListening := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stopListening()
+
+	var agents sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Printf("collector: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		agents.Add(1)
+		go func() {
+			defer agents.Done()
+			collectAgent(ctx, conn)
+		}()
+	}
+
+	log.Println("collector closed")
+	agents.Wait()
+	return nil
+}
+
+// Publishes the messages of an agent connection until it is closed or ctx is
+// cancelled
+func collectAgent(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), collectorMaxLine)
+	if !scanner.Scan() {
+		return
+	}
+	var hello agentHello
+	if err := json.Unmarshal(scanner.Bytes(), &hello); err != nil || hello.Agent == "" {
+		log.Printf("collector: %s is not an agent", conn.RemoteAddr())
+		return
+	}
+	log.Printf("collector: agent %q connected from %s", hello.Agent, conn.RemoteAddr())
+	stats.streams.Add(1)
+	stats.streamsTotal.Add(1)
+	defer stats.streams.Add(-1)
+
+	instance := hello.Agent + "/" + hello.Instance
+	agentProgress.Lock()
+	acked := agentProgress.acked[instance]
+	agentProgress.Unlock()
+	var published atomic.Uint64
+	published.Store(acked)
+	done := make(chan struct{})
+	defer close(done)
+	go acknowledgeAgent(conn, &published, acked, done)
+
+	count := 0
+	for scanner.Scan() {
+		var remote remoteMsg
+		if err := json.Unmarshal(scanner.Bytes(), &remote); err != nil {
+			log.Printf("collector: agent %q sent an invalid message - %s", hello.Agent, err)
+			continue
+		}
+		if remote.ID != 0 && remote.ID <= published.Load() {
+			continue // Sent again, the acknowledgment was lost
+		}
+		msg := remote.message(hello.Agent)
+		if !msg.Closed {
+			stats.frames[msg.Direction].Add(1)
+			stats.bytes[msg.Direction].Add(uint64(len(msg.body)))
+		}
+		bus.Publish(msg)
+		count++
+		if remote.ID != 0 {
+			published.Store(remote.ID)
+			agentProgress.Lock()
+			agentProgress.acked[instance] = remote.ID
+			agentProgress.Unlock()
+		}
+	}
+	if err := scanner.Err(); err != nil && ctx.Err() == nil {
+		log.Printf("collector: agent %q - %s", hello.Agent, err)
+	}
+	log.Printf("collector: agent %q disconnected after %d messages", hello.Agent, count)
+}
+
+// Tells the agent what was published every collectorAckInterval, starting
+// with acked, until done is closed
+func acknowledgeAgent(conn net.Conn, published *atomic.Uint64, acked uint64, done chan struct{}) {
+	ticker := time.NewTicker(collectorAckInterval)
+	defer ticker.Stop()
+	send := func(id uint64) error {
+		line, _ := json.Marshal(collectorAck{Ack: id})
+		conn.SetWriteDeadline(time.Now().Add(agentWriteTimeout))
+		_, err := conn.Write(append(line, '\n'))
+		return err
+	}
+	if err := send(acked); err != nil {
+		return
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if id := published.Load(); id != acked {
+			if err := send(id); err != nil {
+				return
+			}
+			acked = id
+		}
+	}
+}
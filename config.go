@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var configFile = flag.String("config", "", "JSON configuration file")
+var modulesList = flag.String("modules", "", "Comma separated list of modules to enable, overrides the configuration")
+var whereFilter = flag.String("where", "", "Filter expression selecting the messages handed to the modules, e.g. 'name == \"ChatServerMessage\" && channel in [5,6]'")
+
+// Modules enabled when neither the configuration nor -modules says otherwise
+var defaultModules = []string{"inventory"}
+
+// rpsConfig is the content of the -config file, e.g.
+//
+//	{
+//		"modules": ["chat", "inventory"],
+//		"options": {
+//			"chat": { ... }
+//		},
+//		"filters": {
+//			"chat": "channel in [5, 6] && content ~ \"vends\""
+//		}
+//	}
+//
+// A module only receives the messages matching its filter expression.
+type rpsConfig struct {
+	Modules []string                   `json:"modules"`
+	Options map[string]json.RawMessage `json:"options"`
+	Filters map[string]string          `json:"filters"`
+
+	filters map[string]*filterExpr // Parsed Filters, and -where under ""
+}
+
+func loadConfig(path string) (*rpsConfig, error) {
+	config := &rpsConfig{Modules: defaultModules}
+	if path == "" {
+		return config, config.parseFilters()
+	}
+
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(bytes, config); err != nil {
+		return nil, err
+	}
+	return config, config.parseFilters()
+}
+
+// Parses the filter expressions of the modules
+func (c *rpsConfig) parseFilters() error {
+	c.filters = make(map[string]*filterExpr)
+	for module, source := range c.Filters {
+		expr, err := parseFilterExpr(source)
+		if err != nil {
+			return fmt.Errorf("filter of module %q: %w", module, err)
+		}
+		c.filters[module] = expr
+	}
+	return nil
+}
+
+// Sets the filter expression applying to all the modules
+func (c *rpsConfig) setWhere(source string) error {
+	expr, err := parseFilterExpr(source)
+	if err != nil {
+		return err
+	}
+	c.filters[""] = expr
+	return nil
+}
+
+// Restricts the subscriptions of a module to the messages matching -where
+// and its filter expression
+func (c *rpsConfig) moduleSubscriptions(module string, subscriptions []messageFilter) []messageFilter {
+	// The subscriptions come first: they only look at the message id, and
+	// reject most messages before the expressions decode them.
+	filters := []messageFilter{matchAny(subscriptions...)}
+	for _, key := range []string{"", module} {
+		if expr, ok := c.filters[key]; ok {
+			filters = append(filters, byExpression(expr))
+		}
+	}
+	if len(filters) == 1 {
+		return subscriptions
+	}
+	return []messageFilter{matchAll(filters...)}
+}
+
+// Returns the modules to enable, from -modules or the configuration
+func (c *rpsConfig) enabledModules() []string {
+	if *modulesList == "" {
+		return c.Modules
+	}
+
+	var names []string
+	for _, name := range strings.Split(*modulesList, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "none" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 )
 
 var data map[string][]Object
@@ -14,6 +15,12 @@ var idNameMap map[uint16]string
 // Create a "MessageName"= ProtocolID map
 var nameIdMap map[string]uint16
 
+// Create a ProtocolID = "namespace" map for messages, relative to
+// messagesNamespace (e.g. "game.context.fight")
+var idNamespaceMap map[uint16]string
+
+const messagesNamespace = "com.ankamagames.dofus.network.messages."
+
 type Bounds struct {
 	Low string `json:"low"`
 	Up  string `json:"up"`
@@ -68,6 +75,14 @@ func superRecurse(object Object, root string) (fieldSlice []map[string]interface
 				fieldMap["readFunc"] = "read" + field.Write_method[5:]
 			}
 
+			if field.Write_length_method != "" {
+				fieldMap["lengthFunc"] = "read" + field.Write_length_method[5:]
+			}
+
+			if field.Use_boolean_byte_wrapper {
+				fieldMap["booleanWrapperPosition"] = field.Boolean_byte_wrapper_position
+			}
+
 			if field.Constant_length != 0 {
 				fieldMap["constantLength"] = field.Constant_length
 			}
@@ -96,6 +111,7 @@ func json_epurate(jsonBytes []byte) ([]byte, []byte, error) {
 
 	nameIdMap = make(map[string]uint16)
 	idNameMap = make(map[uint16]string)
+	idNamespaceMap = make(map[uint16]string)
 	messages := make(map[string]map[string]interface{})
 	types := make(map[string]map[string]interface{})
 
@@ -106,6 +122,9 @@ func json_epurate(jsonBytes []byte) ([]byte, []byte, error) {
 			idNameMap[obj.ProtocolID] = obj.Name
 			// Fill the "Name"=ProtocolID map
 			nameIdMap[obj.Name] = obj.ProtocolID
+			if root == "messages" {
+				idNamespaceMap[obj.ProtocolID] = strings.TrimPrefix(obj.Namespace, messagesNamespace)
+			}
 
 			// Make objects without the unnecessary data
 			messageMap := make(map[string]interface{})
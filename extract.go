@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	registerCommand("extract", runExtract)
+}
+
+// extractSelection tells which messages to keep. Empty criteria match
+// everything.
+type extractSelection struct {
+	names   map[string]bool
+	ids     map[uint16]bool
+	from    string
+	to      string
+	session string
+	where   *filterExpr
+}
+
+// Parses a -from/-to bound, either an RFC 3339 time or an offset from the
+// first message (e.g. "+30s")
+func parseTimeBound(s string, first time.Time) (time.Time, error) {
+	if strings.HasPrefix(s, "+") {
+		offset, err := time.ParseDuration(s[1:])
+		if err != nil {
+			return time.Time{}, err
+		}
+		return first.Add(offset), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// Returns the predicate selecting the messages, first is the timestamp of
+// the first decoded message
+func (es *extractSelection) predicate(first time.Time) (func(msg *dofusMsg) bool, error) {
+	var from, to time.Time
+	var err error
+	if es.from != "" {
+		if from, err = parseTimeBound(es.from, first); err != nil {
+			return nil, fmt.Errorf("invalid -from: %w", err)
+		}
+	}
+	if es.to != "" {
+		if to, err = parseTimeBound(es.to, first); err != nil {
+			return nil, fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+
+	return func(msg *dofusMsg) bool {
+		if len(es.names) > 0 || len(es.ids) > 0 {
+			if !es.names[msg.Name()] && !es.ids[msg.ProtocolId] {
+				return false
+			}
+		}
+		if !from.IsZero() && msg.Timestamp.Before(from) {
+			return false
+		}
+		if !to.IsZero() && msg.Timestamp.After(to) {
+			return false
+		}
+		if es.session != "" && msg.Client != es.session && !strings.HasSuffix(msg.Client, ":"+es.session) {
+			return false
+		}
+		if es.where != nil && !es.where.Match(msg) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// rps extract: writes the packets carrying the selected messages to a
+// pcapng file, each packet commented with the messages it carries
+func runExtract(args []string) int {
+	flags := flag.NewFlagSet("extract", flag.ExitOnError)
+	var inputs captureFiles
+	flags.Var(&inputs, "r", "Pcap file to read from, can be repeated or a glob like for capturing")
+	output := flags.String("w", "", "Pcapng file to write")
+	bpf := flags.String("f", *filter, "BPF filter for pcap")
+	names := flags.String("name", "", "Comma separated message names to keep")
+	ids := flags.String("id", "", "Comma separated message protocol ids to keep")
+	from := flags.String("from", "", "Keep messages captured from this time, RFC 3339 or offset from the first message (e.g. +30s)")
+	to := flags.String("to", "", "Keep messages captured until this time, same format as -from")
+	session := flags.String("session", "", "Keep the messages of this session, by client endpoint (ip:port) or client port")
+	whereExpr := flags.String("where", "", "Keep the messages matching this filter expression, e.g. 'channel in [5,6]'")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s extract -r capture.pcap -w extract.pcapng [filters]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(inputs) == 0 || *output == "" {
+		flags.Usage()
+		return 2
+	}
+	for _, input := range inputs {
+		// Packets are read twice
+		if input == "-" {
+			log.Println("extract cannot read from stdin")
+			return 2
+		}
+	}
+
+	selection := &extractSelection{
+		names:   make(map[string]bool),
+		ids:     make(map[uint16]bool),
+		from:    *from,
+		to:      *to,
+		session: *session,
+	}
+	for _, name := range strings.Split(*names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			selection.names[name] = true
+		}
+	}
+	if *whereExpr != "" {
+		expr, err := parseFilterExpr(*whereExpr)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		selection.where = expr
+	}
+	for _, id := range strings.Split(*ids, ",") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		value, err := strconv.ParseUint(id, 10, 16)
+		if err != nil {
+			log.Printf("invalid message id %q", id)
+			return 2
+		}
+		selection.ids[uint16(value)] = true
+	}
+
+	if err := loadProtocol(); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	messages, err := decodeCapture(ctx, inputs, *bpf)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if len(messages) == 0 {
+		log.Printf("no message decoded from %s", inputs.String())
+		return 1
+	}
+
+	keep, err := selection.predicate(messages[0].Timestamp)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	// Every packet is annotated with all the messages it carries, selected
+	// or not, to help understanding what was decoded around a bug
+	selected := make(map[uint64]bool)
+	comments := make(map[uint64][]string)
+	kept := 0
+	for i := range messages {
+		msg := &messages[i]
+		if keep(msg) {
+			kept++
+			for _, packet := range msg.Packets {
+				selected[packet] = true
+			}
+		}
+		for part, packet := range msg.Packets {
+			comments[packet] = append(comments[packet], describePart(msg, part))
+		}
+	}
+
+	written, err := writeExtract(inputs, *bpf, *output, selected, comments)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("%d of %d messages selected, %d packets written to %s", kept, len(messages), written, *output)
+	return 0
+}
+
+// Describes the part of a message carried by one of its packets
+func describePart(msg *dofusMsg, part int) string {
+	name := msg.Name()
+	if name == "" {
+		name = fmt.Sprintf("<unknown %v>", msg.ProtocolId)
+	}
+	description := fmt.Sprintf("%s id=%d len=%d %s #%d", name, msg.ProtocolId, msg.MsgLen, msg.Direction, msg.Seq)
+	if len(msg.Packets) > 1 {
+		description += fmt.Sprintf(" (part %d/%d)", part+1, len(msg.Packets))
+	}
+	return description
+}
+
+// Runs the decoding pipeline over capture files and returns all the
+// messages in timeline order
+func decodeCapture(ctx context.Context, inputs []string, bpf string) ([]dofusMsg, error) {
+	pcapfiles = inputs
+	*filter = bpf
+
+	bus = newMessageBus()
+	sub := bus.Subscribe("extract", queueOptions{size: *moduleQueueSize, policy: policyBlock})
+	done := make(chan []dofusMsg)
+	go func() {
+		var messages []dofusMsg
+		for msg := range sub.C {
+			messages = append(messages, msg)
+		}
+		done <- messages
+	}()
+
+	err := handlePackets(ctx)
+	bus.Close()
+	messages := <-done
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return messages, err
+}
+
+// Copies the selected packets of the inputs to a pcapng file. Packets are
+// numbered like handlePackets does, after the BPF filter and the merge of
+// the files.
+func writeExtract(inputs []string, bpf string, output string, selected map[uint64]bool, comments map[uint64][]string) (int, error) {
+	files, err := openCaptureFiles(inputs, bpf)
+	if err != nil {
+		return 0, err
+	}
+	defer files.Close()
+
+	file, err := os.Create(output)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	writer, err := newPcapngWriter(file, files.LinkType(), files.SnapLen())
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for index := uint64(1); ; index++ {
+		data, ci, err := files.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+		if !selected[index] {
+			continue
+		}
+		if err = writer.WritePacket(ci, data, strings.Join(comments[index], "\n")); err != nil {
+			return written, err
+		}
+		written++
+	}
+	if err = writer.Flush(); err != nil {
+		return written, err
+	}
+	return written, file.Close()
+}
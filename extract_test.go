@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Returns the comment of each packet of a pcapng file written by
+// pcapngWriter, which pcapgo does not read
+func pcapngComments(t *testing.T, data []byte) []string {
+	t.Helper()
+	var comments []string
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block of %d bytes", len(data))
+		}
+		blockType, length := binary.LittleEndian.Uint32(data), int(binary.LittleEndian.Uint32(data[4:]))
+		if length < 12 || length > len(data) || binary.LittleEndian.Uint32(data[length-4:]) != uint32(length) {
+			t.Fatalf("block of %d bytes out of %d", length, len(data))
+		}
+		if blockType == pcapngEnhancedPacket {
+			body := data[8 : length-4]
+			captured := int(binary.LittleEndian.Uint32(body[12:]))
+			options := body[20+captured+pcapngPadding(captured):]
+			comment := ""
+			for len(options) >= 4 {
+				code, size := binary.LittleEndian.Uint16(options), int(binary.LittleEndian.Uint16(options[2:]))
+				if code == pcapngOptEnd {
+					break
+				}
+				if code == pcapngOptComment {
+					comment = string(options[4 : 4+size])
+				}
+				options = options[4+size+pcapngPadding(size):]
+			}
+			comments = append(comments, comment)
+		}
+		data = data[length:]
+	}
+	return comments
+}
+
+// The packets selected are copied with their comments
+func TestWriteExtract(t *testing.T) {
+	const client, server = "192.168.1.5:50000", "172.65.0.1:5555"
+	dir := t.TempDir()
+	input, output := filepath.Join(dir, "capture.pcap"), filepath.Join(dir, "extract.pcapng")
+	writeTestCapture(t, input, []testSegment{
+		{at: 0, src: server, dst: client, seq: 1000, ack: true, payload: []byte("one")},
+		{at: 1500 * time.Millisecond, src: client, dst: server, seq: 5000, ack: true, payload: []byte("two")},
+		{at: 2 * time.Second, src: server, dst: client, seq: 1003, ack: true, payload: []byte("three")},
+		{at: 3 * time.Second, src: client, dst: server, seq: 5003, ack: true},
+	})
+
+	written, err := writeExtract([]string{input}, "tcp port 5555", output,
+		map[uint64]bool{2: true, 3: true, 4: true}, map[uint64][]string{2: {"first", "second"}, 4: {"last"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 3 {
+		t.Errorf("%d packets written", written)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := pcapgo.NewNgReader(bytes.NewReader(data), pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if application := reader.SectionInfo().Application; application != "rps" {
+		t.Errorf("written by %q", application)
+	}
+	if reader.LinkType() != layers.LinkTypeEthernet || reader.Resolution() != gopacket.TimestampResolutionNanosecond {
+		t.Errorf("link type %s, resolution %v", reader.LinkType(), reader.Resolution())
+	}
+	want := []struct {
+		at      time.Duration
+		payload string
+	}{{1500 * time.Millisecond, "two"}, {2 * time.Second, "three"}, {3 * time.Second, ""}}
+	for i := 0; ; i++ {
+		packetData, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			if i != len(want) {
+				t.Errorf("%d packets read, want %d", i, len(want))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(want) {
+			continue
+		}
+		packet := gopacket.NewPacket(packetData, layers.LayerTypeEthernet, gopacket.Default)
+		if !ci.Timestamp.Equal(testEpoch.Add(want[i].at)) || ci.CaptureLength != len(packetData) || ci.Length != len(packetData) {
+			t.Errorf("packet %d: %+v", i, ci)
+		}
+		if layer := packet.ApplicationLayer(); (layer == nil && want[i].payload != "") || (layer != nil && string(layer.Payload()) != want[i].payload) {
+			t.Errorf("packet %d: payload %v, want %q", i, layer, want[i].payload)
+		}
+	}
+
+	if comments := pcapngComments(t, data); !reflect.DeepEqual(comments, []string{"first\nsecond", "", "last"}) {
+		t.Errorf("comments %q", comments)
+	}
+}
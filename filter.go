@@ -0,0 +1,588 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// Filter expressions select decoded messages, e.g.
+//
+//	name == "ChatServerMessage" && channel in [5, 6] && content contains "vends"
+//
+// Identifiers are the message metadata (name, namespace, id, direction,
+// session, server, character) or else gjson paths in the message body
+// (content, infos.name, objects.#.objectGID); body.<path> reaches a body
+// field shadowed by the metadata. Missing fields are null.
+//
+// Operators, by increasing precedence:
+//
+//	||  &&  !
+//	== != < <= > >=   compare numbers, strings, booleans or null
+//	contains          substring, or element of an array
+//	~                 case insensitive substring
+//	matches "regexp"
+//	in [v1, v2]       or in an array field
+//
+// A value alone is true unless it is false or null, so `kamasTotal` keeps
+// the messages having that field.
+
+// filterSubject is what filter expressions are evaluated on
+type filterSubject interface {
+	// Returns a metadata field, see filterMetadata
+	filterField(name string) interface{}
+	// Returns the decoded body as JSON, nil if it could not be decoded
+	filterBody() []byte
+}
+
+// Identifiers resolved as message metadata instead of body fields
+var filterMetadata = map[string]bool{
+	"name": true, "namespace": true, "id": true, "direction": true,
+	"session": true, "server": true, "character": true,
+}
+
+func (dM *dofusMsg) filterField(name string) interface{} {
+	switch name {
+	case "name":
+		return dM.Name()
+	case "namespace":
+		return dM.Namespace()
+	case "id":
+		return float64(dM.ProtocolId)
+	case "direction":
+		return dM.Direction.String()
+	case "session":
+		return dM.Session()
+	case "server":
+		return dM.Server
+	}
+	// The character is only known to the modules tracking it
+	return nil
+}
+
+func (dM *dofusMsg) filterBody() []byte {
+	body, err := dM.JSON()
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+func (mR *messageRecord) filterField(name string) interface{} {
+	switch name {
+	case "name":
+		return mR.Name
+	case "namespace":
+		return mR.Namespace
+	case "id":
+		return float64(mR.ProtocolId)
+	case "direction":
+		return mR.Direction
+	case "session":
+		return mR.Session
+	case "server":
+		return mR.Server
+	case "character":
+		return mR.Character
+	}
+	return nil
+}
+
+func (mR *messageRecord) filterBody() []byte {
+	return mR.Body
+}
+
+// filterExpr is a parsed filter expression
+type filterExpr struct {
+	source string
+	root   filterNode
+}
+
+// Match tells whether the expression holds for subject
+func (fe *filterExpr) Match(subject filterSubject) bool {
+	return truthy(fe.root.eval(&filterInput{subject: subject}))
+}
+
+func (fe *filterExpr) String() string {
+	return fe.source
+}
+
+// filterInput is a subject being evaluated, its body is decoded once
+type filterInput struct {
+	subject    filterSubject
+	body       []byte
+	bodyLoaded bool
+}
+
+func (fi *filterInput) getBody() []byte {
+	if !fi.bodyLoaded {
+		fi.body = fi.subject.filterBody()
+		fi.bodyLoaded = true
+	}
+	return fi.body
+}
+
+// Values are float64, string, bool, nil or []interface{} (and
+// map[string]interface{} for body objects)
+type filterNode interface {
+	eval(input *filterInput) interface{}
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (ln *literalNode) eval(input *filterInput) interface{} {
+	return ln.value
+}
+
+type listNode struct {
+	items []filterNode
+}
+
+func (ln *listNode) eval(input *filterInput) interface{} {
+	values := make([]interface{}, len(ln.items))
+	for i, item := range ln.items {
+		values[i] = item.eval(input)
+	}
+	return values
+}
+
+type metadataNode struct {
+	name string
+}
+
+func (mn *metadataNode) eval(input *filterInput) interface{} {
+	return input.subject.filterField(mn.name)
+}
+
+type bodyNode struct {
+	path string
+}
+
+func (bn *bodyNode) eval(input *filterInput) interface{} {
+	body := input.getBody()
+	if body == nil {
+		return nil
+	}
+	return gjson.GetBytes(body, bn.path).Value()
+}
+
+type notNode struct {
+	operand filterNode
+}
+
+func (nn *notNode) eval(input *filterInput) interface{} {
+	return !truthy(nn.operand.eval(input))
+}
+
+type logicalNode struct {
+	and         bool
+	left, right filterNode
+}
+
+func (ln *logicalNode) eval(input *filterInput) interface{} {
+	if truthy(ln.left.eval(input)) != ln.and {
+		return !ln.and
+	}
+	return truthy(ln.right.eval(input))
+}
+
+type compareNode struct {
+	op          string
+	left, right filterNode
+}
+
+func (cn *compareNode) eval(input *filterInput) interface{} {
+	left, right := cn.left.eval(input), cn.right.eval(input)
+	switch cn.op {
+	case "==":
+		return filterEqual(left, right)
+	case "!=":
+		return !filterEqual(left, right)
+	case "contains":
+		return filterContains(left, right, false)
+	case "~":
+		return filterContains(left, right, true)
+	case "in":
+		return filterContains(right, left, false)
+	}
+	order, ok := filterOrder(left, right)
+	if !ok {
+		return false
+	}
+	switch cn.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+type matchesNode struct {
+	operand filterNode
+	re      *regexp.Regexp
+}
+
+func (mn *matchesNode) eval(input *filterInput) interface{} {
+	s, ok := mn.operand.eval(input).(string)
+	return ok && mn.re.MatchString(s)
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+func filterEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		b, ok := b.(float64)
+		return ok && a == b
+	case string:
+		b, ok := b.(string)
+		return ok && a == b
+	case bool:
+		b, ok := b.(bool)
+		return ok && a == b
+	}
+	return false
+}
+
+// Compares numbers or strings, ok is false for other values
+func filterOrder(a, b interface{}) (order int, ok bool) {
+	switch a := a.(type) {
+	case float64:
+		if b, ok := b.(float64); ok {
+			switch {
+			case a < b:
+				return -1, true
+			case a > b:
+				return 1, true
+			}
+			return 0, true
+		}
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b), true
+		}
+	}
+	return 0, false
+}
+
+// Tells whether the string haystack contains the string needle, or the
+// array haystack an element equal to (or containing, if fold) needle
+func filterContains(haystack, needle interface{}, fold bool) bool {
+	switch haystack := haystack.(type) {
+	case string:
+		needle, ok := needle.(string)
+		if !ok {
+			return false
+		}
+		if fold {
+			return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
+		}
+		return strings.Contains(haystack, needle)
+	case []interface{}:
+		for _, item := range haystack {
+			if filterEqual(item, needle) || (fold && filterContains(item, needle, true)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filterSyntaxError points at the faulty part of an expression
+type filterSyntaxError struct {
+	source string
+	pos    int
+	msg    string
+}
+
+func (fse *filterSyntaxError) Error() string {
+	return fmt.Sprintf("invalid filter, %s at column %d:\n\t%s\n\t%s^", fse.msg, fse.pos+1, fse.source, strings.Repeat(" ", fse.pos))
+}
+
+type filterTokenKind int
+
+const (
+	tokenEnd filterTokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenOperator
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string // Unquoted for strings
+	pos  int
+}
+
+func (ft filterToken) String() string {
+	switch ft.kind {
+	case tokenEnd:
+		return "end of expression"
+	case tokenString:
+		return strconv.Quote(ft.text)
+	}
+	return fmt.Sprintf("%q", ft.text)
+}
+
+// Symbols, the longest first
+var filterOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "~", "(", ")", "[", "]", ","}
+
+func isIdentByte(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+		(!first && ((c >= '0' && c <= '9') || c == '.' || c == '#'))
+}
+
+func tokenizeFilter(source string) ([]filterToken, error) {
+	var tokens []filterToken
+	pos := 0
+	for pos < len(source) {
+		c := source[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			pos++
+		case c == '"':
+			end := pos + 1
+			for end < len(source) && source[end] != '"' {
+				if source[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(source) {
+				return nil, &filterSyntaxError{source, pos, "unterminated string"}
+			}
+			text, err := strconv.Unquote(source[pos : end+1])
+			if err != nil {
+				return nil, &filterSyntaxError{source, pos, "invalid string"}
+			}
+			tokens = append(tokens, filterToken{tokenString, text, pos})
+			pos = end + 1
+		case c == '-' || c == '.' || (c >= '0' && c <= '9'):
+			end := pos + 1
+			for end < len(source) && (source[end] == '.' || source[end] == 'e' || (source[end] >= '0' && source[end] <= '9')) {
+				end++
+			}
+			if _, err := strconv.ParseFloat(source[pos:end], 64); err != nil {
+				return nil, &filterSyntaxError{source, pos, fmt.Sprintf("invalid number %q", source[pos:end])}
+			}
+			tokens = append(tokens, filterToken{tokenNumber, source[pos:end], pos})
+			pos = end
+		case isIdentByte(c, true):
+			end := pos + 1
+			for end < len(source) && isIdentByte(source[end], false) {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokenIdent, source[pos:end], pos})
+			pos = end
+		default:
+			operator := ""
+			for _, op := range filterOperators {
+				if strings.HasPrefix(source[pos:], op) {
+					operator = op
+					break
+				}
+			}
+			if operator == "" {
+				return nil, &filterSyntaxError{source, pos, fmt.Sprintf("unexpected %q", source[pos:pos+1])}
+			}
+			tokens = append(tokens, filterToken{tokenOperator, operator, pos})
+			pos += len(operator)
+		}
+	}
+	return append(tokens, filterToken{tokenEnd, "", len(source)}), nil
+}
+
+// filterParser is a recursive descent parser of filter expressions
+type filterParser struct {
+	source string
+	tokens []filterToken
+	next   int
+}
+
+// parseFilterExpr parses a filter expression, whose syntax is described at
+// the top of this file
+func parseFilterExpr(source string) (*filterExpr, error) {
+	tokens, err := tokenizeFilter(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := &filterParser{source: source, tokens: tokens}
+	root, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if token := parser.peek(); token.kind != tokenEnd {
+		return nil, parser.errorf(token, "unexpected %s", token)
+	}
+	return &filterExpr{source: source, root: root}, nil
+}
+
+func (fp *filterParser) peek() filterToken {
+	return fp.tokens[fp.next]
+}
+
+func (fp *filterParser) take() filterToken {
+	token := fp.tokens[fp.next]
+	if token.kind != tokenEnd {
+		fp.next++
+	}
+	return token
+}
+
+// Takes the next token if it is the operator or keyword text
+func (fp *filterParser) accept(text string) bool {
+	token := fp.peek()
+	if (token.kind == tokenOperator || token.kind == tokenIdent) && token.text == text {
+		fp.next++
+		return true
+	}
+	return false
+}
+
+func (fp *filterParser) errorf(token filterToken, format string, args ...interface{}) error {
+	return &filterSyntaxError{fp.source, token.pos, fmt.Sprintf(format, args...)}
+}
+
+func (fp *filterParser) or() (filterNode, error) {
+	left, err := fp.and()
+	for err == nil && fp.accept("||") {
+		var right filterNode
+		if right, err = fp.and(); err == nil {
+			left = &logicalNode{and: false, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (fp *filterParser) and() (filterNode, error) {
+	left, err := fp.not()
+	for err == nil && fp.accept("&&") {
+		var right filterNode
+		if right, err = fp.not(); err == nil {
+			left = &logicalNode{and: true, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (fp *filterParser) not() (filterNode, error) {
+	if fp.accept("!") {
+		operand, err := fp.not()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+	}
+	return fp.comparison()
+}
+
+// Comparisons do not chain, a == b == c is an error
+func (fp *filterParser) comparison() (filterNode, error) {
+	left, err := fp.operand()
+	if err != nil {
+		return nil, err
+	}
+	token := fp.peek()
+	if token.kind != tokenOperator && token.kind != tokenIdent {
+		return left, nil
+	}
+	switch token.text {
+	case "==", "!=", "<", "<=", ">", ">=", "~", "contains", "in":
+		fp.take()
+		right, err := fp.operand()
+		if err != nil {
+			return nil, err
+		}
+		return &compareNode{op: token.text, left: left, right: right}, nil
+	case "matches":
+		fp.take()
+		pattern := fp.take()
+		if pattern.kind != tokenString {
+			return nil, fp.errorf(pattern, "matches needs a quoted regexp, found %s", pattern)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fp.errorf(pattern, "%s", err)
+		}
+		return &matchesNode{operand: left, re: re}, nil
+	}
+	return left, nil
+}
+
+func (fp *filterParser) operand() (filterNode, error) {
+	token := fp.take()
+	switch token.kind {
+	case tokenString:
+		return &literalNode{token.text}, nil
+	case tokenNumber:
+		value, _ := strconv.ParseFloat(token.text, 64)
+		return &literalNode{value}, nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return &literalNode{true}, nil
+		case "false":
+			return &literalNode{false}, nil
+		case "null":
+			return &literalNode{nil}, nil
+		case "contains", "in", "matches":
+			return nil, fp.errorf(token, "expected a value, found %s", token)
+		}
+		if filterMetadata[token.text] {
+			return &metadataNode{token.text}, nil
+		}
+		return &bodyNode{strings.TrimPrefix(token.text, "body.")}, nil
+	case tokenOperator:
+		switch token.text {
+		case "(":
+			node, err := fp.or()
+			if err != nil {
+				return nil, err
+			}
+			if closing := fp.take(); closing.text != ")" || closing.kind != tokenOperator {
+				return nil, fp.errorf(closing, "expected \")\", found %s", closing)
+			}
+			return node, nil
+		case "[":
+			list := &listNode{}
+			if fp.accept("]") {
+				return list, nil
+			}
+			for {
+				item, err := fp.operand()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if fp.accept("]") {
+					return list, nil
+				}
+				if !fp.accept(",") {
+					next := fp.peek()
+					return nil, fp.errorf(next, "expected \",\" or \"]\", found %s", next)
+				}
+			}
+		}
+	}
+	return nil, fp.errorf(token, "expected a value, found %s", token)
+}
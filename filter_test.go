@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	record := &messageRecord{
+		Session:   "192.168.1.142:57148",
+		Character: "Aled",
+		Server:    "172.65.0.1:5555",
+		Direction: "server->client",
+		Name:      "ChatServerMessage",
+		Namespace: "com.ankamagames.dofus.network.messages.game.chat",
+		Body: []byte(`{"channel": 5, "content": "Vends Dofus Turquoise", "senderName": "Aled",
+			"objects": [{"objectGID": 421}, {"objectGID": 8}], "name": "shadowed", "muted": false, "flags": null}`),
+	}
+	undecoded := &messageRecord{Name: "ChatServerMessage"}
+
+	tests := []struct {
+		expr    string
+		subject *messageRecord
+		want    bool
+	}{
+		{`name == "ChatServerMessage"`, record, true},
+		{`name != "ChatServerMessage"`, record, false},
+		{`direction == "server->client" && character == "Aled"`, record, true},
+		{`session == "192.168.1.142:57148"`, record, true},
+		{`channel == 5`, record, true},
+		{`channel in [5, 6]`, record, true},
+		{`channel in [6, 7]`, record, false},
+		{`421 in objects.#.objectGID`, record, true},
+		{`objects.#.objectGID contains 8`, record, true},
+		{`objects.#.objectGID contains 9`, record, false},
+		{`content contains "Dofus"`, record, true},
+		{`content contains "dofus"`, record, false},
+		{`content ~ "dofus"`, record, true},
+		{`content matches "^Vends .* Turquoise$"`, record, true},
+		{`channel > 4 && channel <= 5`, record, true},
+		{`channel < 5`, record, false},
+		{`senderName >= "A"`, record, true},
+		{`body.name == "shadowed"`, record, true},
+		{`name == "shadowed"`, record, false},
+		{`channel`, record, true},
+		{`muted`, record, false},
+		{`flags`, record, false},
+		{`flags == null`, record, true},
+		{`missing == null`, record, true},
+		{`missing`, record, false},
+		{`!missing`, record, true},
+		{`!(channel == 5 || channel == 6)`, record, false},
+		{`channel == 6 || content ~ "turquoise" && senderName == "Aled"`, record, true},
+		{`(channel == 6 || content ~ "turquoise") && senderName == "Nope"`, record, false},
+		{`channel == "5"`, record, false},
+		{`name == "ChatServerMessage"`, undecoded, true},
+		{`channel == 5`, undecoded, false},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := parseFilterExpr(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := expr.Match(test.subject); got != test.want {
+				t.Errorf("%s is %v, want %v", test.expr, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+	}{
+		{``, 0},
+		{`channel ==`, 10},
+		{`channel == 5 &&`, 15},
+		{`(channel == 5`, 13},
+		{`channel in [5,`, 14},
+		{`content matches "("`, 16},
+		{`content == "unterminated`, 11},
+		{`channel = 5`, 8},
+		{`channel == 5 5`, 13},
+	}
+	for _, test := range tests {
+		t.Run(test.expr, func(t *testing.T) {
+			_, err := parseFilterExpr(test.expr)
+			var syntaxErr *filterSyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("got %v, want a syntax error", err)
+			}
+			if syntaxErr.pos != test.pos {
+				t.Errorf("error at %d, want %d: %v", syntaxErr.pos, test.pos, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerModule("inventory", func() Module { return new(inventoryModule) })
+	registerCommand("inventory", runInventory)
+
+	// GET /inventory lists the containers, /inventory?gid=421,422 tells
+	// where the items are
+	apiMux.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
+		book := runningInventories.Load()
+		if book == nil {
+			writeError(w, http.StatusNotFound, errors.New("the inventory module is not running"))
+			return
+		}
+		server := r.URL.Query().Get("server")
+		if r.URL.Query().Has("gid") {
+			gids, err := parseGIDs(r.URL.Query()["gid"])
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			writeJSON(w, book.Find(server, gids))
+			return
+		}
+		writeJSON(w, book.Summaries(server))
+	})
+}
+
+// Default file of the inventories, saved by the module and read by rps
+// inventory, relative to the working directory
+const defaultInventoriesPath = "rps-inventories.json"
+
+// How often the inventories are saved while they change
+const inventoriesSaveInterval = time.Minute
+
+// Exchange type of the bank (ExchangeTypeEnum.STORAGE). The bank kamas are
+// told at login, storage messages outside of an exchange are for the bank.
+const exchangeTypeBank = 5
+
+type itemStack struct {
+	GID      uint64 `json:"gid"`
+	Quantity uint64 `json:"quantity"`
+}
+
+// container is the bag of a character, or a storage: the bank, shared by
+// the characters of an account, or a chest
+type container struct {
+	Server   string               `json:"server"`
+	Kind     string               `json:"kind"`               // bag, bank or storage followed by its exchange type
+	Owner    string               `json:"owner"`              // Character for a bag, account for a storage if known
+	Location string               `json:"location,omitempty"` // Map and interactive element of a chest, if known
+	SeenBy   string               `json:"seenBy"`             // Last character to open it
+	Kamas    int64                `json:"kamas"`
+	Items    map[uint64]itemStack `json:"items"` // By object UID
+	Updated  time.Time            `json:"updated"`
+	// Characters seen opening the storage of an account, to find their
+	// account in the sessions where it is not told
+	Characters []string `json:"characters,omitempty"`
+}
+
+// Adds character to those seen opening the container
+func (c *container) seenWith(character string) {
+	i := sort.SearchStrings(c.Characters, character)
+	if i < len(c.Characters) && c.Characters[i] == character {
+		return
+	}
+	c.Characters = slices.Insert(c.Characters, i, character)
+}
+
+func (c *container) key() string {
+	key := c.Server + "/" + c.Kind + "/" + c.Owner
+	if c.Location != "" {
+		key += "/" + c.Location
+	}
+	return key
+}
+
+// Sets the quantity of the object, removing it at 0. Objects not known yet
+// need their GID.
+func (c *container) setQuantity(uid uint64, gid uint64, quantity uint64) {
+	stack, ok := c.Items[uid]
+	switch {
+	case quantity == 0:
+		delete(c.Items, uid)
+	case ok || gid != 0:
+		if gid != 0 {
+			stack.GID = gid
+		}
+		stack.Quantity = quantity
+		c.Items[uid] = stack
+	}
+}
+
+// Replaces the content with the objects of an InventoryContentMessage
+func (c *container) setContent(objects []gjson.Result, kamas int64) {
+	c.Items = make(map[uint64]itemStack, len(objects))
+	for _, object := range objects {
+		c.setQuantity(object.Get("objectUID").Uint(), object.Get("objectGID").Uint(), object.Get("quantity").Uint())
+	}
+	c.Kamas = kamas
+}
+
+// containerSummary describes a container without its items
+type containerSummary struct {
+	Server   string    `json:"server"`
+	Kind     string    `json:"kind"`
+	Owner    string    `json:"owner"`
+	Location string    `json:"location,omitempty"`
+	SeenBy   string    `json:"seenBy"`
+	Kamas    int64     `json:"kamas"`
+	Stacks   int       `json:"stacks"`
+	Items    uint64    `json:"items"` // Sum of the quantities
+	Updated  time.Time `json:"updated"`
+}
+
+// itemLocation is the quantity of an item in a container
+type itemLocation struct {
+	Server   string    `json:"server"`
+	Kind     string    `json:"kind"`
+	Owner    string    `json:"owner"`
+	Location string    `json:"location,omitempty"`
+	SeenBy   string    `json:"seenBy"`
+	Quantity uint64    `json:"quantity"`
+	Updated  time.Time `json:"updated"`
+}
+
+// itemSearch is where an item is and how many there are, all accounts
+// included
+type itemSearch struct {
+	GID       uint64         `json:"gid"`
+	Total     uint64         `json:"total"`
+	Locations []itemLocation `json:"locations"`
+}
+
+// inventoryBook holds the containers seen, by server, kind and owner
+type inventoryBook struct {
+	mu         sync.Mutex
+	containers map[string]*container
+	accounts   map[string]string // Account of the characters, by server and character
+}
+
+func newInventoryBook() *inventoryBook {
+	return &inventoryBook{containers: make(map[string]*container), accounts: make(map[string]string)}
+}
+
+// The inventories of the running module, for the API
+var runningInventories atomic.Pointer[inventoryBook]
+
+// Loads the inventories saved at path, empty if there are none yet
+func loadInventoryBook(path string) (*inventoryBook, error) {
+	ib := newInventoryBook()
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ib, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var containers []*container
+	if err = json.Unmarshal(bytes, &containers); err != nil {
+		return nil, fmt.Errorf("could not read inventories from %s - %w", path, err)
+	}
+	for _, c := range containers {
+		if c.Items == nil {
+			c.Items = make(map[uint64]itemStack)
+		}
+		ib.containers[c.key()] = c
+		for _, character := range c.Characters {
+			ib.accounts[c.Server+"/"+character] = c.Owner
+		}
+	}
+	return ib, nil
+}
+
+// Save writes the inventories to path, through a temporary file
+func (ib *inventoryBook) Save(path string) error {
+	ib.mu.Lock()
+	bytes, err := json.MarshalIndent(ib.sorted(""), "", "  ")
+	ib.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path+".tmp", bytes, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Returns the containers of server, all if empty, in a stable order. The
+// lock must be held.
+func (ib *inventoryBook) sorted(server string) []*container {
+	containers := make([]*container, 0, len(ib.containers))
+	for _, c := range ib.containers {
+		if server == "" || c.Server == server {
+			containers = append(containers, c)
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].key() < containers[j].key()
+	})
+	return containers
+}
+
+// Updates the container, created if new, with update under the lock
+func (ib *inventoryBook) update(server string, kind string, owner string, location string, seenBy string, at time.Time, update func(c *container)) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	c := &container{Server: server, Kind: kind, Owner: owner, Location: location}
+	if existing, ok := ib.containers[c.key()]; ok {
+		c = existing
+	} else {
+		c.Items = make(map[uint64]itemStack)
+		ib.containers[c.key()] = c
+	}
+	c.SeenBy = seenBy
+	c.Updated = at
+	update(c)
+}
+
+// Account returns the account of character on server, if it was ever told
+func (ib *inventoryBook) Account(server string, character string) (string, bool) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	account, ok := ib.accounts[server+"/"+character]
+	return account, ok
+}
+
+// Adopt records the account of character. The storages stored under the
+// character name, while its account was not known, are moved to the account
+// so that they are not counted twice, the latest copy winning.
+func (ib *inventoryBook) Adopt(server string, character string, account string) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+	if ib.accounts[server+"/"+character] == account {
+		return
+	}
+	ib.accounts[server+"/"+character] = account
+
+	for key, c := range ib.containers {
+		if c.Server != server || c.Kind == "bag" || c.Owner != character {
+			continue
+		}
+		delete(ib.containers, key)
+		moved := *c
+		moved.Owner = account
+		if existing, ok := ib.containers[moved.key()]; ok && existing.Updated.After(c.Updated) {
+			existing.seenWith(character)
+			continue
+		}
+		moved.seenWith(character)
+		ib.containers[moved.key()] = &moved
+	}
+}
+
+// Summaries describes the containers of server, all if empty
+func (ib *inventoryBook) Summaries(server string) []containerSummary {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	summaries := []containerSummary{}
+	for _, c := range ib.sorted(server) {
+		summary := containerSummary{Server: c.Server, Kind: c.Kind, Owner: c.Owner, Location: c.Location,
+			SeenBy: c.SeenBy, Kamas: c.Kamas, Stacks: len(c.Items), Updated: c.Updated}
+		for _, stack := range c.Items {
+			summary.Items += stack.Quantity
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries
+}
+
+// Find tells where the items are on server, all if empty
+func (ib *inventoryBook) Find(server string, gids []uint64) []itemSearch {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	searches := make([]itemSearch, len(gids))
+	for i, gid := range gids {
+		search := itemSearch{GID: gid, Locations: []itemLocation{}}
+		for _, c := range ib.sorted(server) {
+			var quantity uint64
+			for _, stack := range c.Items {
+				if stack.GID == gid {
+					quantity += stack.Quantity
+				}
+			}
+			if quantity > 0 {
+				search.Locations = append(search.Locations, itemLocation{Server: c.Server, Kind: c.Kind, Owner: c.Owner,
+					Location: c.Location, SeenBy: c.SeenBy, Quantity: quantity, Updated: c.Updated})
+				search.Total += quantity
+			}
+		}
+		searches[i] = search
+	}
+	return searches
+}
+
+// Parses item GIDs, given as repeated or comma separated values
+func parseGIDs(values []string) ([]uint64, error) {
+	var gids []uint64
+	for _, value := range values {
+		for _, item := range splitList(value) {
+			gid, err := strconv.ParseUint(item, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid item GID %q", item)
+			}
+			gids = append(gids, gid)
+		}
+	}
+	if len(gids) == 0 {
+		return nil, errors.New("no item GID")
+	}
+	return gids, nil
+}
+
+type inventoryOptions struct {
+	Path string `json:"path"` // Where to save the inventories, they are only kept in memory if empty
+}
+
+// openStorage is the storage a session has open
+type openStorage struct {
+	kind     string
+	location string
+}
+
+// inventoryModule follows the bag of every character and the storages they
+// open (bank, haven bag chests...), across accounts, so that the API can
+// tell where an item is. They are saved for rps inventory.
+type inventoryModule struct {
+	baseModule
+	options    inventoryOptions
+	book       *inventoryBook
+	servers    *gameServerTracker
+	characters *characterTracker
+	accounts   map[string]string      // By session
+	maps       map[string]uint64      // Current map, by session
+	elements   map[string]uint64      // Last interactive element used, by session
+	storages   map[string]openStorage // By session
+	dirty      bool
+	saved      time.Time
+}
+
+func (im *inventoryModule) Name() string {
+	return "inventory"
+}
+
+func (im *inventoryModule) Subscriptions() []messageFilter {
+	return []messageFilter{byName(
+		"ServerSelectionMessage", "SelectedServerDataMessage", "CharacterSelectedSuccessMessage",
+		"AccountCapabilitiesMessage", "CurrentMapMessage", "InteractiveUseRequestMessage",
+		"ExchangeStartedWithStorageMessage", "ExchangeLeaveMessage",
+		"InventoryContentMessage", "KamasUpdateMessage",
+		"ObjectAddedMessage", "ObjectsAddedMessage", "ObjectQuantityMessage", "ObjectsQuantityMessage",
+		"ObjectDeletedMessage", "ObjectsDeletedMessage",
+		"StorageInventoryContentMessage", "StorageKamasUpdateMessage",
+		"StorageObjectUpdateMessage", "StorageObjectsUpdateMessage", "StorageObjectRemoveMessage", "StorageObjectsRemoveMessage",
+	)}
+}
+
+// What is known of a session is forgotten at its end
+func (im *inventoryModule) subscribeSessionEnds() {}
+
+func (im *inventoryModule) Start(ctx context.Context, env *moduleEnv) error {
+	im.options = inventoryOptions{Path: defaultInventoriesPath}
+	if err := env.decodeOptions(&im.options); err != nil {
+		return err
+	}
+	book := newInventoryBook()
+	if im.options.Path != "" {
+		var err error
+		if book, err = loadInventoryBook(im.options.Path); err != nil {
+			return err
+		}
+		env.Log.Printf("%d containers in %s", len(book.containers), im.options.Path)
+	}
+
+	im.book = book
+	im.servers = newGameServerTracker()
+	im.characters = newCharacterTracker()
+	im.accounts = make(map[string]string)
+	im.maps = make(map[string]uint64)
+	im.elements = make(map[string]uint64)
+	im.storages = make(map[string]openStorage)
+	im.saved = time.Now()
+	runningInventories.Store(book)
+	im.run(env, im.observe)
+	return nil
+}
+
+func (im *inventoryModule) Stop() error {
+	im.baseModule.Stop()
+	runningInventories.Store(nil)
+	if !im.dirty || im.options.Path == "" {
+		return nil
+	}
+	return im.book.Save(im.options.Path)
+}
+
+func (im *inventoryModule) observe(msg dofusMsg) {
+	if msg.Closed {
+		session := msg.Session()
+		delete(im.accounts, session)
+		delete(im.maps, session)
+		delete(im.elements, session)
+		delete(im.storages, session)
+		im.servers.Forget(session)
+		im.characters.Forget(session)
+		return
+	}
+	server := im.servers.Observe(&msg)
+	if server == "" {
+		server = "unknown"
+	}
+	character := im.characters.Observe(&msg)
+	session := msg.Session()
+	body, err := msg.JSON()
+	if err != nil {
+		return
+	}
+	fields := gjson.ParseBytes(body)
+
+	switch msg.Name() {
+	case "AccountCapabilitiesMessage":
+		im.accounts[session] = "account " + fields.Get("accountId").String()
+		return
+	case "CurrentMapMessage":
+		im.maps[session] = fields.Get("mapId").Uint()
+		return
+	case "InteractiveUseRequestMessage":
+		im.elements[session] = fields.Get("elemId").Uint()
+		return
+	case "ExchangeStartedWithStorageMessage":
+		// Chests are told apart by the element opening them, the bank is
+		// the same everywhere
+		exchangeType := fields.Get("exchangeType").Int()
+		storage := openStorage{kind: storageKind(exchangeType)}
+		if element, ok := im.elements[session]; ok && exchangeType != exchangeTypeBank {
+			storage.location = fmt.Sprintf("map %d element %d", im.maps[session], element)
+		}
+		im.storages[session] = storage
+		return
+	case "ExchangeLeaveMessage":
+		delete(im.storages, session)
+		delete(im.elements, session)
+		return
+	}
+	if character == "" {
+		return
+	}
+
+	// The bag of the character
+	bag := func(update func(c *container)) {
+		im.book.update(server, "bag", character, "", character, msg.Timestamp, update)
+		im.dirty = true
+	}
+	// The storage opened, the bank if none
+	storage := func(update func(c *container)) {
+		opened, ok := im.storages[session]
+		if !ok {
+			opened = openStorage{kind: storageKind(exchangeTypeBank)}
+		}
+		// Without AccountCapabilitiesMessage, the account is the one last
+		// told for the character, its name otherwise
+		owner, ok := im.accounts[session]
+		if ok {
+			im.book.Adopt(server, character, owner)
+		} else if owner, ok = im.book.Account(server, character); !ok {
+			owner = character
+		}
+		im.book.update(server, opened.kind, owner, opened.location, character, msg.Timestamp, func(c *container) {
+			if owner != character {
+				c.seenWith(character)
+			}
+			update(c)
+		})
+		im.dirty = true
+	}
+
+	switch msg.Name() {
+	case "InventoryContentMessage":
+		bag(func(c *container) {
+			c.setContent(fields.Get("objects").Array(), fields.Get("kamas").Int())
+		})
+	case "KamasUpdateMessage":
+		bag(func(c *container) { c.Kamas = fields.Get("kamasTotal").Int() })
+	case "ObjectAddedMessage", "ObjectsAddedMessage":
+		bag(func(c *container) {
+			for _, object := range fields.Get("object").Array() {
+				c.setQuantity(object.Get("objectUID").Uint(), object.Get("objectGID").Uint(), object.Get("quantity").Uint())
+			}
+		})
+	case "ObjectQuantityMessage":
+		bag(func(c *container) { c.setQuantity(fields.Get("objectUID").Uint(), 0, fields.Get("quantity").Uint()) })
+	case "ObjectsQuantityMessage":
+		bag(func(c *container) {
+			for _, object := range fields.Get("objectsUIDAndQty").Array() {
+				c.setQuantity(object.Get("objectUID").Uint(), 0, object.Get("quantity").Uint())
+			}
+		})
+	case "ObjectDeletedMessage", "ObjectsDeletedMessage":
+		bag(func(c *container) {
+			for _, uid := range fields.Get("objectUID").Array() {
+				c.setQuantity(uid.Uint(), 0, 0)
+			}
+		})
+	case "StorageInventoryContentMessage":
+		storage(func(c *container) {
+			c.setContent(fields.Get("objects").Array(), fields.Get("kamas").Int())
+			im.env.Log.Printf("%s of %s: %d stacks, %d kamas", c.Kind, c.Owner, len(c.Items), c.Kamas)
+		})
+	case "StorageKamasUpdateMessage":
+		storage(func(c *container) { c.Kamas = fields.Get("kamasTotal").Int() })
+	case "StorageObjectUpdateMessage", "StorageObjectsUpdateMessage":
+		objects := fields.Get("object").Array()
+		if msg.Name() == "StorageObjectsUpdateMessage" {
+			objects = fields.Get("objectList").Array()
+		}
+		storage(func(c *container) {
+			for _, object := range objects {
+				c.setQuantity(object.Get("objectUID").Uint(), object.Get("objectGID").Uint(), object.Get("quantity").Uint())
+			}
+		})
+	case "StorageObjectRemoveMessage":
+		storage(func(c *container) { c.setQuantity(fields.Get("objectUID").Uint(), 0, 0) })
+	case "StorageObjectsRemoveMessage":
+		storage(func(c *container) {
+			for _, uid := range fields.Get("objectUIDList").Array() {
+				c.setQuantity(uid.Uint(), 0, 0)
+			}
+		})
+	}
+
+	if im.dirty && im.options.Path != "" && time.Since(im.saved) > inventoriesSaveInterval {
+		if err := im.book.Save(im.options.Path); err != nil {
+			im.env.Log.Printf("could not save inventories - %s", err)
+		} else {
+			im.dirty = false
+		}
+		im.saved = time.Now()
+	}
+}
+
+// Names the storage of an exchange type
+func storageKind(exchangeType int64) string {
+	if exchangeType == exchangeTypeBank {
+		return "bank"
+	}
+	return fmt.Sprintf("storage %d", exchangeType)
+}
+
+// rps inventory: lists the containers saved by the inventory module (given
+// a path in its options), or tells where items are across all accounts, e.g.
+//
+//	rps inventory -server 291 421 422
+func runInventory(args []string) int {
+	flags := flag.NewFlagSet("inventory", flag.ExitOnError)
+	path := flags.String("path", defaultInventoriesPath, "Inventories saved by the inventory module")
+	server := flags.String("server", "", "Only look on this game server")
+	format := flags.String("format", "table", "Output format: table, json or csv")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s inventory [-path file] [-server id] [item GID...]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	book, err := loadInventoryBook(*path)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var report interface{}
+	var columns []string
+	var rows [][]string
+	if flags.NArg() == 0 {
+		summaries := book.Summaries(*server)
+		report = summaries
+		columns = []string{"server", "kind", "owner", "location", "seen by", "kamas", "stacks", "items", "updated"}
+		for _, s := range summaries {
+			rows = append(rows, []string{s.Server, s.Kind, s.Owner, s.Location, s.SeenBy, strconv.FormatInt(s.Kamas, 10),
+				strconv.Itoa(s.Stacks), strconv.FormatUint(s.Items, 10), s.Updated.Local().Format(time.DateTime)})
+		}
+	} else {
+		gids, err := parseGIDs(flags.Args())
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		searches := book.Find(*server, gids)
+		report = searches
+		columns = []string{"gid", "server", "kind", "owner", "location", "seen by", "quantity", "updated"}
+		for _, search := range searches {
+			gid := strconv.FormatUint(search.GID, 10)
+			for _, l := range search.Locations {
+				rows = append(rows, []string{gid, l.Server, l.Kind, l.Owner, l.Location, l.SeenBy,
+					strconv.FormatUint(l.Quantity, 10), l.Updated.Local().Format(time.DateTime)})
+			}
+			rows = append(rows, []string{gid, "", "", "", "", "total", strconv.FormatUint(search.Total, 10), ""})
+		}
+	}
+
+	switch *format {
+	case "table":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(writer, strings.ToUpper(strings.Join(columns, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		err = writer.Flush()
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write(columns)
+		writer.WriteAll(rows)
+		err = writer.Error()
+	default:
+		log.Printf("unknown format %q, expected table, json or csv", *format)
+		return 2
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Writes an ObjectItem
+func encodeObjectItem(e *bodyEncoder, gid uint64, uid uint64, quantity uint64) {
+	e.short(63).varint(gid).short(0).varint(uid).varint(quantity).boolean(false)
+}
+
+// Every chest opened is kept, told apart by the interactive element used to
+// open it
+func TestInventoryChests(t *testing.T) {
+	const client = "10.0.0.1:4001"
+	storageContent := func(gid uint64, uid uint64, quantity uint64) *bodyEncoder {
+		e := new(bodyEncoder).short(1)
+		encodeObjectItem(e, gid, uid, quantity)
+		return e.varint(0)
+	}
+	openChest := func(second int, element uint64) []dofusMsg {
+		return []dofusMsg{
+			testMessage(t, "InteractiveUseRequestMessage", dirClientToServer, client, second, new(bodyEncoder).varint(element).varint(1)),
+			testMessage(t, "ExchangeStartedWithStorageMessage", dirServerToClient, client, second, new(bodyEncoder).byte(8).varint(100)),
+		}
+	}
+	leave := testMessage(t, "ExchangeLeaveMessage", dirServerToClient, client, 0, new(bodyEncoder).byte(1).boolean(true))
+
+	var messages []dofusMsg
+	messages = append(messages,
+		testMessage(t, "AccountCapabilitiesMessage", dirServerToClient, client, 0, new(bodyEncoder).byte(0).int(4242).byte(0)),
+		testMessage(t, "CurrentMapMessage", dirServerToClient, client, 1, new(bodyEncoder).double(162791424)))
+	messages = append(messages, openChest(2, 501)...)
+	messages = append(messages, testMessage(t, "StorageInventoryContentMessage", dirServerToClient, client, 3, storageContent(421, 1, 10)), leave)
+	messages = append(messages, openChest(4, 502)...)
+	messages = append(messages, testMessage(t, "StorageInventoryContentMessage", dirServerToClient, client, 5, storageContent(422, 2, 20)), leave)
+	// The bank, whatever element opened it
+	messages = append(messages, testMessage(t, "InteractiveUseRequestMessage", dirClientToServer, client, 6, new(bodyEncoder).varint(503).varint(1)),
+		testMessage(t, "ExchangeStartedWithStorageMessage", dirServerToClient, client, 6, new(bodyEncoder).byte(exchangeTypeBank).varint(100)),
+		testMessage(t, "StorageInventoryContentMessage", dirServerToClient, client, 7, storageContent(423, 3, 30)), leave)
+	// Back to the first chest
+	messages = append(messages, openChest(8, 501)...)
+	messages = append(messages, testMessage(t, "StorageObjectRemoveMessage", dirServerToClient, client, 9, new(bodyEncoder).varint(1)), leave)
+
+	path := filepath.Join(t.TempDir(), "inventories.json")
+	messages = append([]dofusMsg{characterSelected(t, client, "Yokoo")}, messages...)
+	runModule(t, new(inventoryModule), `{"path": "`+path+`"}`, messages)
+
+	book, err := loadInventoryBook(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		gid      uint64
+		kind     string
+		location string
+		quantity uint64
+	}{
+		{gid: 421},
+		{gid: 422, kind: "storage 8", location: "map 162791424 element 502", quantity: 20},
+		{gid: 423, kind: "bank", quantity: 30},
+	}
+	for _, tt := range tests {
+		search := book.Find("", []uint64{tt.gid})[0]
+		if tt.quantity == 0 {
+			if len(search.Locations) != 0 {
+				t.Errorf("item %d found in %+v", tt.gid, search.Locations)
+			}
+			continue
+		}
+		if len(search.Locations) != 1 {
+			t.Fatalf("item %d found in %+v, want one container", tt.gid, search.Locations)
+		}
+		l := search.Locations[0]
+		if l.Kind != tt.kind || l.Location != tt.location || l.Owner != "account 4242" || l.Quantity != tt.quantity {
+			t.Errorf("item %d in %+v, want %d in %s %q", tt.gid, l, tt.quantity, tt.kind, tt.location)
+		}
+	}
+	if n := len(book.Summaries("")); n != 3 {
+		t.Errorf("%d containers, want both chests and the bank", n)
+	}
+}
+
+// An account's bank is stored once, whether the account was told in the
+// session or not
+func TestInventoryBankOnce(t *testing.T) {
+	const first, second = "10.0.0.1:4001", "10.0.0.1:4002"
+	account := func(client string) dofusMsg {
+		return testMessage(t, "AccountCapabilitiesMessage", dirServerToClient, client, 0, new(bodyEncoder).byte(0).int(4242).byte(0))
+	}
+	bank := func(client string, character string, second int, quantity uint64) []dofusMsg {
+		content := new(bodyEncoder).short(1)
+		encodeObjectItem(content, 423, 3, quantity)
+		return []dofusMsg{
+			characterSelected(t, client, character),
+			testMessage(t, "ExchangeStartedWithStorageMessage", dirServerToClient, client, second, new(bodyEncoder).byte(exchangeTypeBank).varint(100)),
+			testMessage(t, "StorageInventoryContentMessage", dirServerToClient, client, second, content.varint(0)),
+		}
+	}
+	tests := []struct {
+		name     string
+		messages [][]dofusMsg
+		want     uint64
+	}{
+		{"account told after", [][]dofusMsg{bank(first, "Yokoo", 1, 30), append([]dofusMsg{account(second)}, bank(second, "Yokoo", 2, 40)...)}, 40},
+		{"account told before", [][]dofusMsg{append([]dofusMsg{account(first)}, bank(first, "Yokoo", 1, 30)...), bank(second, "Yokoo", 2, 40)}, 40},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Each capture reads the inventories the previous one saved
+			path := filepath.Join(t.TempDir(), "inventories.json")
+			for _, messages := range test.messages {
+				runModule(t, new(inventoryModule), `{"path": "`+path+`"}`, messages)
+			}
+			book, err := loadInventoryBook(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			search := book.Find("", []uint64{423})[0]
+			if search.Total != test.want || len(search.Locations) != 1 {
+				t.Fatalf("%d items in %+v, want %d in the bank", search.Total, search.Locations, test.want)
+			}
+			if owner := search.Locations[0].Owner; owner != "account 4242" {
+				t.Errorf("bank of %q", owner)
+			}
+		})
+	}
+}
+
+func TestInventorySaved(t *testing.T) {
+	tests := []struct {
+		name    string
+		options string
+		want    []string
+	}{
+		{"default path", "", []string{defaultInventoriesPath}},
+		{"kept in memory", `{"path": ""}`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			wd, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(dir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(wd)
+			const client = "10.0.0.1:4001"
+			inventory := new(bodyEncoder).short(1)
+			encodeObjectItem(inventory, 421, 1, 10)
+			runModule(t, new(inventoryModule), test.options, []dofusMsg{
+				characterSelected(t, client, "Yokoo"),
+				testMessage(t, "InventoryContentMessage", dirServerToClient, client, 1, inventory.varint(1000)),
+			})
+			matches, _ := filepath.Glob("*")
+			if !reflect.DeepEqual(matches, test.want) {
+				t.Errorf("files written: %v, want %v", matches, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerModule("ledger", func() Module { return new(ledgerModule) })
+	registerCommand("ledger", runLedger)
+}
+
+// Default file of the ledger, relative to the working directory
+const defaultLedgerPath = "rps-ledger.ndjson"
+
+// ledgerEntry is an event of our bid-house activity
+type ledgerEntry struct {
+	Time      time.Time `json:"time"`
+	Server    string    `json:"server"`
+	Character string    `json:"character"`
+	Kind      string    `json:"kind"` // listed, withdrawn, sold or unsold
+	GID       uint64    `json:"gid"`
+	Quantity  uint64    `json:"quantity"`
+	Price     uint64    `json:"price,omitempty"` // Of the whole lot
+	Tax       uint64    `json:"tax,omitempty"`   // Paid when listing
+	// The bid house was opened before the capture started, its tax rate
+	// is not known
+	TaxUnknown bool   `json:"taxUnknown,omitempty"`
+	UID        uint64 `json:"uid,omitempty"` // Of the lot listed or withdrawn
+	// Capture time of the message telling the sale or unsold lot, Unix
+	// nanoseconds, and the position of the lot in it
+	Message int64 `json:"message,omitempty"`
+	Index   int   `json:"index,omitempty"`
+}
+
+// Identifies an entry, so that replaying a capture does not count it twice.
+// Lots are told apart by their UID, sales and unsold lots by the message
+// telling them, as identical lots can be listed or sold in the same second.
+func (le *ledgerEntry) key() string {
+	switch {
+	case le.UID != 0:
+		return fmt.Sprintf("%s/%s/%s/%d/%d", le.Kind, le.Server, le.Character, le.UID, le.Time.Unix())
+	case le.Message != 0:
+		return fmt.Sprintf("%s/%s/%s/%d/%d", le.Kind, le.Server, le.Character, le.Message, le.Index)
+	}
+	// Entries written before UIDs and messages were recorded
+	return fmt.Sprintf("%s/%s/%s/%d/%d/%d/%d", le.Kind, le.Server, le.Character, le.GID, le.Quantity, le.Price, le.Time.Unix())
+}
+
+type ledgerOptions struct {
+	Path string `json:"path"`
+}
+
+// sellerSession is the bid house opened in sell mode by a session
+type sellerSession struct {
+	tax      float64                // Percentage of the price paid when listing
+	listings map[uint64]ledgerEntry // By object UID
+}
+
+// ledgerModule appends our bid-house activity to the ledger: items listed
+// and the taxes paid, items withdrawn, and the sales and unsold items told
+// at login, per character. rps ledger reports on it.
+type ledgerModule struct {
+	baseModule
+	options    ledgerOptions
+	file       *os.File
+	writer     *bufio.Writer
+	seen       map[string]bool
+	servers    *gameServerTracker
+	characters *characterTracker
+	sellers    map[string]*sellerSession // By session
+	err        error
+}
+
+func (lm *ledgerModule) Name() string {
+	return "ledger"
+}
+
+func (lm *ledgerModule) Subscriptions() []messageFilter {
+	return []messageFilter{byName(
+		"ServerSelectionMessage", "SelectedServerDataMessage", "CharacterSelectedSuccessMessage",
+		"ExchangeStartedBidSellerMessage", "ExchangeBidHouseItemAddOkMessage", "ExchangeBidHouseItemRemoveOkMessage",
+		"ExchangeOfflineSoldItemsMessage", "ExchangeBidHouseUnsoldItemsMessage",
+	)}
+}
+
+// What is known of a session, its bid house included, is forgotten at its
+// end
+func (lm *ledgerModule) subscribeSessionEnds() {}
+
+func (lm *ledgerModule) Start(ctx context.Context, env *moduleEnv) error {
+	lm.options = ledgerOptions{Path: defaultLedgerPath}
+	if err := env.decodeOptions(&lm.options); err != nil {
+		return err
+	}
+	lm.seen = make(map[string]bool)
+	err := readLedger(lm.options.Path, func(entry *ledgerEntry) {
+		lm.seen[entry.key()] = true
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	file, err := os.OpenFile(lm.options.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	env.Log.Printf("%d entries in %s", len(lm.seen), lm.options.Path)
+
+	lm.file = file
+	lm.writer = bufio.NewWriter(file)
+	lm.servers = newGameServerTracker()
+	lm.characters = newCharacterTracker()
+	lm.sellers = make(map[string]*sellerSession)
+	lm.run(env, lm.observe)
+	return nil
+}
+
+func (lm *ledgerModule) Stop() error {
+	lm.baseModule.Stop()
+	err := lm.writer.Flush()
+	if closeErr := lm.file.Close(); err == nil {
+		err = closeErr
+	}
+	if lm.err != nil {
+		return lm.err
+	}
+	return err
+}
+
+func (lm *ledgerModule) observe(msg dofusMsg) {
+	if msg.Closed {
+		delete(lm.sellers, msg.Session())
+		lm.servers.Forget(msg.Session())
+		lm.characters.Forget(msg.Session())
+		return
+	}
+	server := lm.servers.Observe(&msg)
+	character := lm.characters.Observe(&msg)
+	body, err := msg.JSON()
+	if err != nil {
+		return
+	}
+	fields := gjson.ParseBytes(body)
+	session := msg.Session()
+	entry := func(kind string, item gjson.Result) ledgerEntry {
+		return ledgerEntry{
+			Time:      msg.Timestamp,
+			Server:    server,
+			Character: character,
+			Kind:      kind,
+			GID:       item.Get("objectGID").Uint(),
+			Quantity:  item.Get("quantity").Uint(),
+		}
+	}
+
+	switch msg.Name() {
+	case "ExchangeStartedBidSellerMessage":
+		seller := &sellerSession{
+			tax:      fields.Get("sellerDescriptor.taxPercentage").Float(),
+			listings: make(map[uint64]ledgerEntry),
+		}
+		for _, item := range fields.Get("objectsInfos").Array() {
+			listing := entry("listed", item)
+			listing.Price = item.Get("objectPrice").Uint()
+			listing.UID = item.Get("objectUID").Uint()
+			seller.listings[listing.UID] = listing
+		}
+		lm.sellers[session] = seller
+	case "ExchangeBidHouseItemAddOkMessage":
+		item := fields.Get("itemInfo")
+		listing := entry("listed", item)
+		listing.Price = item.Get("objectPrice").Uint()
+		listing.UID = item.Get("objectUID").Uint()
+		if seller, ok := lm.sellers[session]; ok {
+			// Rounded up, the game does not give the amount
+			listing.Tax = uint64(math.Ceil(float64(listing.Price) * seller.tax / 100))
+			seller.listings[listing.UID] = listing
+		} else {
+			listing.TaxUnknown = true
+		}
+		lm.write(listing)
+	case "ExchangeBidHouseItemRemoveOkMessage":
+		// sellerId is the UID of the item withdrawn
+		seller, ok := lm.sellers[session]
+		if !ok {
+			return
+		}
+		uid := fields.Get("sellerId").Uint()
+		if listing, ok := seller.listings[uid]; ok {
+			delete(seller.listings, uid)
+			listing.Time, listing.Kind, listing.Tax = msg.Timestamp, "withdrawn", 0
+			lm.write(listing)
+		}
+	case "ExchangeOfflineSoldItemsMessage":
+		for i, item := range fields.Get("bidHouseItems").Array() {
+			sale := entry("sold", item)
+			sale.Price = item.Get("price").Uint()
+			sale.Message, sale.Index = msg.Timestamp.UnixNano(), i
+			if date := item.Get("date").Int(); date > 0 {
+				sale.Time = time.Unix(date, 0)
+			}
+			lm.write(sale)
+		}
+	case "ExchangeBidHouseUnsoldItemsMessage":
+		for i, item := range fields.Get("items").Array() {
+			unsold := entry("unsold", item)
+			unsold.Message, unsold.Index = msg.Timestamp.UnixNano(), i
+			lm.write(unsold)
+		}
+	}
+}
+
+// Appends an entry to the ledger, unless it is already there
+func (lm *ledgerModule) write(entry ledgerEntry) {
+	key := entry.key()
+	if lm.seen[key] {
+		return
+	}
+	lm.seen[key] = true
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = lm.writer.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = lm.writer.Flush()
+	}
+	if err != nil {
+		lm.env.Log.Printf("could not write to %s - %s", lm.options.Path, err)
+		lm.err = err
+		return
+	}
+	lm.env.Log.Printf("%s %s x%d of item %d for %d kamas", entry.Character, entry.Kind, entry.Quantity, entry.GID, entry.Price)
+}
+
+// Feeds the entries of the ledger at path to handle
+func readLedger(path string, handle func(entry *ledgerEntry)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			var entry ledgerEntry
+			if decodeErr := json.Unmarshal(line, &entry); decodeErr != nil {
+				log.Printf("%s:%d: %s", path, lineNumber, decodeErr)
+			} else {
+				handle(&entry)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ledgerDay sums the activity of a character over a day
+type ledgerDay struct {
+	Day       string `json:"day"`
+	Server    string `json:"server"`
+	Character string `json:"character"`
+	Listed    uint64 `json:"listed"`      // Lots put on sale
+	ListedFor uint64 `json:"listedValue"` // Kamas asked for them
+	Taxes     uint64 `json:"taxes"`
+	Untaxed   uint64 `json:"untaxed"` // Lots listed whose tax is not known, not in Taxes
+	Withdrawn uint64 `json:"withdrawn"`
+	Sold      uint64 `json:"sold"`
+	Gross     uint64 `json:"gross"` // Kamas of the sales
+	Unsold    uint64 `json:"unsold"`
+	Net       int64  `json:"net"` // Gross minus taxes
+}
+
+var ledgerColumns = []string{"day", "server", "character", "listed", "listed value", "taxes", "untaxed", "withdrawn", "sold", "gross", "unsold", "net"}
+
+func (ld *ledgerDay) columns() []string {
+	return []string{ld.Day, ld.Server, ld.Character,
+		strconv.FormatUint(ld.Listed, 10), strconv.FormatUint(ld.ListedFor, 10), strconv.FormatUint(ld.Taxes, 10),
+		strconv.FormatUint(ld.Untaxed, 10), strconv.FormatUint(ld.Withdrawn, 10), strconv.FormatUint(ld.Sold, 10), strconv.FormatUint(ld.Gross, 10),
+		strconv.FormatUint(ld.Unsold, 10), strconv.FormatInt(ld.Net, 10)}
+}
+
+// rps ledger: reports the bid-house activity recorded by the ledger module
+// per character and per day
+func runLedger(args []string) int {
+	flags := flag.NewFlagSet("ledger", flag.ExitOnError)
+	path := flags.String("path", defaultLedgerPath, "Ledger written by the ledger module")
+	character := flags.String("character", "", "Only report on this character")
+	from := flags.String("from", "", "Report from this time, 2006-01-02[ 15:04:05], RFC 3339 or a duration before now (e.g. 168h)")
+	to := flags.String("to", "", "Report until this time, same format as -from")
+	format := flags.String("format", "table", "Output format: table, json or csv")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s ledger [-path file] [-character name] [-from time] [-to time]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var fromTime, toTime time.Time
+	var err error
+	now := time.Now()
+	if *from != "" {
+		if fromTime, err = parseQueryTime(*from, now); err != nil {
+			log.Printf("invalid -from: %s", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if toTime, err = parseQueryTime(*to, now); err != nil {
+			log.Printf("invalid -to: %s", err)
+			return 2
+		}
+	}
+
+	days := make(map[string]*ledgerDay)
+	err = readLedger(*path, func(entry *ledgerEntry) {
+		if (*character != "" && !strings.EqualFold(entry.Character, *character)) ||
+			(!fromTime.IsZero() && entry.Time.Before(fromTime)) || (!toTime.IsZero() && entry.Time.After(toTime)) {
+			return
+		}
+		day := entry.Time.Local().Format(time.DateOnly)
+		key := day + "/" + entry.Server + "/" + entry.Character
+		summary, ok := days[key]
+		if !ok {
+			summary = &ledgerDay{Day: day, Server: entry.Server, Character: entry.Character}
+			days[key] = summary
+		}
+		switch entry.Kind {
+		case "listed":
+			summary.Listed++
+			summary.ListedFor += entry.Price
+			summary.Taxes += entry.Tax
+			if entry.TaxUnknown {
+				summary.Untaxed++
+			}
+		case "withdrawn":
+			summary.Withdrawn++
+		case "sold":
+			summary.Sold++
+			summary.Gross += entry.Price
+		case "unsold":
+			summary.Unsold++
+		}
+		summary.Net = int64(summary.Gross) - int64(summary.Taxes)
+	})
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	report := make([]*ledgerDay, 0, len(days))
+	for _, summary := range days {
+		report = append(report, summary)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Day != report[j].Day {
+			return report[i].Day < report[j].Day
+		}
+		if report[i].Server != report[j].Server {
+			return report[i].Server < report[j].Server
+		}
+		return report[i].Character < report[j].Character
+	})
+
+	switch *format {
+	case "table":
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(writer, strings.ToUpper(strings.Join(ledgerColumns, "\t"))+"\t")
+		for _, summary := range report {
+			fmt.Fprintln(writer, strings.Join(summary.columns(), "\t")+"\t")
+		}
+		err = writer.Flush()
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	case "csv":
+		writer := csv.NewWriter(os.Stdout)
+		writer.Write(ledgerColumns)
+		for _, summary := range report {
+			writer.Write(summary.columns())
+		}
+		writer.Flush()
+		err = writer.Error()
+	default:
+		log.Printf("unknown format %q, expected table, json or csv", *format)
+		return 2
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLedgerListingTaxes(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	// Opens the bid house with a 2% tax and a lot already listed
+	sellerOpened := func(second int) dofusMsg {
+		body := new(bodyEncoder)
+		body.short(1).varint(1).short(1).varint(48).float(2).float(0).byte(200).varint(100).int(-1).varint(672)
+		body.short(1).varint(421).short(0).varint(9001).varint(100).varint(4500).int(100)
+		return testMessage(t, "ExchangeStartedBidSellerMessage", dirServerToClient, game, second, body)
+	}
+	listed := func(second int, uid uint64, price uint64) dofusMsg {
+		body := new(bodyEncoder).varint(422).short(0).varint(uid).varint(10).varint(price).int(100)
+		return testMessage(t, "ExchangeBidHouseItemAddOkMessage", dirServerToClient, game, second, body)
+	}
+	ended := dofusMsg{Timestamp: testEpoch.Add(3 * time.Second), Client: game, Server: "172.65.0.1:5555", Closed: true, Ending: endClosed}
+
+	tests := []struct {
+		name        string
+		messages    []dofusMsg
+		wantTax     uint64
+		wantUnknown bool
+	}{
+		{"bid house opened", []dofusMsg{sellerOpened(1), listed(2, 9002, 999)}, 20, false},
+		{"opened before the capture", []dofusMsg{listed(2, 9002, 999)}, 0, true},
+		{"opened in an ended session", []dofusMsg{sellerOpened(1), ended, listed(4, 9002, 999)}, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ledger.ndjson")
+			messages := append([]dofusMsg{
+				testMessage(t, "ServerSelectionMessage", dirClientToServer, game, 0, new(bodyEncoder).varint(291)),
+			}, test.messages...)
+			runModule(t, new(ledgerModule), `{"path": "`+path+`"}`, messages)
+
+			var listings []ledgerEntry
+			err := readLedger(path, func(entry *ledgerEntry) {
+				if entry.Kind == "listed" {
+					listings = append(listings, *entry)
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(listings) != 1 {
+				t.Fatalf("%d listings: %+v", len(listings), listings)
+			}
+			if listings[0].Tax != test.wantTax || listings[0].TaxUnknown != test.wantUnknown {
+				t.Errorf("tax %d, unknown %v, want %d, %v", listings[0].Tax, listings[0].TaxUnknown, test.wantTax, test.wantUnknown)
+			}
+		})
+	}
+}
+
+func TestLedgerDeduplication(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	listed := func(second int, uid uint64) dofusMsg {
+		body := new(bodyEncoder).varint(422).short(0).varint(uid).varint(10).varint(999).int(100)
+		return testMessage(t, "ExchangeBidHouseItemAddOkMessage", dirServerToClient, game, second, body)
+	}
+	// Two identical sales, told at the same date
+	sold := func(second int) dofusMsg {
+		body := new(bodyEncoder).short(2)
+		body.varint(421).varint(100).varint(4400).short(0).int(1712400000)
+		body.varint(421).varint(100).varint(4400).short(0).int(1712400000)
+		return testMessage(t, "ExchangeOfflineSoldItemsMessage", dirServerToClient, game, second, body)
+	}
+	unsold := func(second int) dofusMsg {
+		body := new(bodyEncoder).short(2).varint(424).varint(10).varint(424).varint(10)
+		return testMessage(t, "ExchangeBidHouseUnsoldItemsMessage", dirServerToClient, game, second, body)
+	}
+
+	tests := []struct {
+		name     string
+		messages []dofusMsg
+		runs     int
+		want     map[string]int
+	}{
+		{"lots listed in the same second", []dofusMsg{listed(1, 9002), listed(1, 9003)}, 1, map[string]int{"listed": 2}},
+		{"lot listed again later", []dofusMsg{listed(1, 9002), listed(5, 9002)}, 1, map[string]int{"listed": 2}},
+		{"identical sales", []dofusMsg{sold(1)}, 1, map[string]int{"sold": 2}},
+		{"sales told at two logins", []dofusMsg{sold(1), sold(60)}, 1, map[string]int{"sold": 4}},
+		{"identical unsold lots", []dofusMsg{unsold(1)}, 1, map[string]int{"unsold": 2}},
+		{"capture replayed", []dofusMsg{listed(1, 9002), listed(1, 9003), sold(2), unsold(3)}, 2, map[string]int{"listed": 2, "sold": 2, "unsold": 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ledger.ndjson")
+			for i := 0; i < test.runs; i++ {
+				runModule(t, new(ledgerModule), `{"path": "`+path+`"}`, test.messages)
+			}
+			got := make(map[string]int)
+			if err := readLedger(path, func(entry *ledgerEntry) { got[entry.Kind]++ }); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ledger has %v, want %v", got, test.want)
+			}
+		})
+	}
+}
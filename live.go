@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+)
+
+const defaultSnapLen = 262144
+
+var captureBackend = flag.String("backend", "pcap", "Live capture backend: pcap, or afpacket (Linux TPACKET_V3 ring buffer)")
+var snapLen = flag.Int("snaplen", defaultSnapLen, "Maximum bytes captured per packet, 0 for the default. The afpacket backend applies it with the -f filter, and captures whole packets without one")
+var afpacketRingSize = flag.Int("afpacket-ring", 64, "Size of the afpacket ring buffer, in MiB")
+var afpacketFanoutId = flag.Int("afpacket-fanout", 0, "Fanout group id shared by rps instances splitting the traffic, 0 to disable")
+var afpacketFanoutType = flag.String("afpacket-fanout-type", "hash", "How the fanout group splits packets: hash (by flow), lb, cpu, rollover or random")
+
+// liveCapture captures packets on an interface, it is a
+// gopacket.PacketDataSource
+type liveCapture interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	// Counters returns the statistics of the capture since it started
+	Counters() (captureCounters, error)
+	Close()
+}
+
+// Returns the -snaplen, the default if it is not positive like libpcap does
+func captureSnapLen() int {
+	if *snapLen <= 0 {
+		return defaultSnapLen
+	}
+	return *snapLen
+}
+
+// Opens a capture on iface with the -backend, applying the BPF filter
+func openLiveCapture(iface string, bpf string) (liveCapture, error) {
+	switch *captureBackend {
+	case "pcap":
+		return openPcapCapture(iface, bpf)
+	case "afpacket":
+		return openAfpacketCapture(iface, bpf)
+	}
+	return nil, fmt.Errorf("unknown capture backend %q", *captureBackend)
+}
+
+// pcapCapture is the libpcap backend
+type pcapCapture struct {
+	*pcap.Handle
+}
+
+func openPcapCapture(iface string, bpf string) (liveCapture, error) {
+	log.Printf("Starting capture on interface %q", iface)
+	// Not blocking forever, so that the capture can be closed on shutdown
+	handle, err := pcap.OpenLive(iface, int32(captureSnapLen()), true, liveReadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("could not open interface - %v - %s", iface, err)
+	}
+	if bpf != "" {
+		if err = handle.SetBPFFilter(bpf); err != nil {
+			handle.Close()
+			return nil, fmt.Errorf("could not apply filter %v to capture - %s", bpf, err)
+		}
+	}
+	return pcapCapture{handle}, nil
+}
+
+func (pc pcapCapture) Counters() (captureCounters, error) {
+	pcapStats, err := pc.Stats()
+	if err != nil {
+		return captureCounters{}, err
+	}
+	return captureCounters{
+		Received:  pcapStats.PacketsReceived,
+		Dropped:   pcapStats.PacketsDropped,
+		IfDropped: pcapStats.PacketsIfDropped,
+	}, nil
+}
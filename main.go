@@ -1,256 +1,454 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"reflect"
-	"strings"
-
-	"github.com/tidwall/gjson"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var iface = flag.String("i", "Ethernet", "Interface to get packets from")
-var pcapfile = flag.String("r", "", "Pcap file to read from")
+var pcapfiles captureFiles
 var filter = flag.String("f", "tcp port 5555", "BPF filter for pcap")
 var listInterfaces = flag.Bool("l", false, "List all interfaces on the system")
 var logAllPackets = flag.Bool("v", false, "Logs every packet in great detail")
-var defaultSnapLen int32 = 262144
+
+func init() {
+	flag.Var(&pcapfiles, "r", "Pcap file to read from, - for stdin. Can be repeated or a glob, the files are read as one capture in timestamp order")
+}
+
+var liveReadTimeout = 500 * time.Millisecond
 var messagesJson, typesJson []byte
 
-var chatPackets chan dofusMsg
-var havenBagInventoryPackets chan dofusMsg
+var bus *messageBus
 
-func readVector(binaryMsg []byte, instance reflect.Value, index int, offset *int) {
+// decodedBody caches the decoding of a message body, shared by all the
+// copies of the message handed to subscribers.
+type decodedBody struct {
+	once     sync.Once
+	instance reflect.Value
+	err      error
+}
 
-	field := instance.Field(index)
-	vectorSize, size := readUnsignedShort(binaryMsg)
+func readInteger(data []byte, readFunc string) (value int64, size int, err error) {
+	switch readFunc {
+	case "readByte":
+		var v byte
+		v, size, err = readByte(data)
+		value = int64(v)
+	case "readShort":
+		var v int16
+		v, size, err = readShort(data)
+		value = int64(v)
+	case "readInt":
+		var v int32
+		v, size, err = readInt(data)
+		value = int64(v)
+	case "readUnsignedInt":
+		var v uint32
+		v, size, err = readUnsignedInt(data)
+		value = int64(v)
+	case "readVarShort":
+		var v int16
+		v, size, err = readVarShort(data)
+		value = int64(v)
+	case "readVarInt":
+		var v int32
+		v, size, err = readVarInt(data)
+		value = int64(v)
+	case "readVarLong":
+		value, size, err = readVarLong(data)
+	default:
+		err = fmt.Errorf("unimplemented readFunc: %q", readFunc)
+	}
+	return
+}
+
+func readScalar(binaryMsg []byte, field reflect.Value, readFunc string, offset *int) error {
+	data := binaryMsg[*offset:]
+	var size int
+	var err error
+	switch readFunc {
+	case "readBoolean":
+		var value bool
+		value, size, err = readBoolean(data)
+		field.SetBool(value)
+	case "readUTF":
+		var value string
+		value, size, err = readString(data)
+		field.SetString(value)
+	case "readDouble":
+		var value float64
+		value, size, err = readDouble(data)
+		field.SetFloat(value)
+	case "readFloat":
+		var value float32
+		value, size, err = readFloat(data)
+		field.SetFloat(float64(value))
+	default:
+		var value int64
+		value, size, err = readInteger(data, readFunc)
+		switch field.Kind() {
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			field.SetInt(value)
+		default:
+			field.SetUint(uint64(value))
+		}
+	}
+	if err != nil {
+		return err
+	}
 	*offset += size
+	if *logAllPackets {
+		fmt.Printf("Added %v value: %v (size:%v)\n", field.Type(), field.Interface(), size)
+	}
+	return nil
+}
 
-	fmt.Printf("Vector (size:%v): %v\n", vectorSize, field.Type().String())
+// Reads a value of the type named typeName
+func readTyped(binaryMsg []byte, typeName string, offset *int) (reflect.Value, error) {
+	structType, err := typeStruct(typeName)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	instance := reflect.New(structType).Elem()
+	err = ReadFields(binaryMsg, instance, offset)
+	return instance, err
+}
 
-	// Ensure field is a slice
-	if field.Kind() != reflect.Slice {
-		log.Fatalf("ReadVector: Field is not a slice")
+// Reads a value prefixed by the protocol id of its actual type
+func readPolymorphic(binaryMsg []byte, offset *int) (reflect.Value, error) {
+	typeId, size, err := readUnsignedShort(binaryMsg[*offset:])
+	if err != nil {
+		return reflect.Value{}, err
 	}
+	*offset += size
+	name, err := typeName(typeId)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return readTyped(binaryMsg, name, offset)
+}
 
-	// Create a new slice to hold the values
-	sliceType := field.Type().Elem()
-	newSlice := reflect.MakeSlice(field.Type(), int(vectorSize), int(vectorSize))
+// Reads a single value (a field, or an element of a vector field)
+func readElement(binaryMsg []byte, value reflect.Value, tag reflect.StructTag, offset *int) error {
+	switch {
+	case tag.Get("prefixed") == "true":
+		typed, err := readPolymorphic(binaryMsg, offset)
+		if err != nil {
+			return err
+		}
+		value.Set(typed)
+	case value.Kind() == reflect.Interface:
+		// Recursive type, see createFieldType
+		typed, err := readTyped(binaryMsg, tag.Get("type"), offset)
+		if err != nil {
+			return err
+		}
+		value.Set(typed)
+	case value.Kind() == reflect.Struct:
+		return ReadFields(binaryMsg, value, offset)
+	default:
+		return readScalar(binaryMsg, value, tag.Get("readfunc"), offset)
+	}
+	return nil
+}
 
-	for i := 0; i < int(vectorSize); i++ {
-		if instance.Type().Field(index).Tag.Get("prefixed") == "true" {
-			*offset += 2
+func readVector(binaryMsg []byte, field reflect.Value, tag reflect.StructTag, offset *int) error {
+	var vectorSize int
+	if constantLength, _ := strconv.Atoi(tag.Get("constlen")); constantLength > 0 {
+		vectorSize = constantLength
+	} else if tag.Get("lengthfunc") == "readVarInt" {
+		value, size, err := readVarInt(binaryMsg[*offset:])
+		if err != nil {
+			return err
 		}
-		fmt.Printf("DEBUG: %v\n", instance.Type().Field(index).Tag.Get("prefixed"))
-		switch sliceType {
-		case reflect.TypeOf(uint8(0)):
-			value, size := readByte(binaryMsg[*offset:])
-			*offset += size
-			newSlice.Index(i).SetUint(uint64(value))
-			fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-		case reflect.TypeOf(uint16(0)):
-			value, size := readUnsignedShort(binaryMsg[*offset:])
-			*offset += size
-			newSlice.Index(i).SetUint(uint64(value))
-			fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-		case reflect.TypeOf(string("")):
-			value, size := readString(binaryMsg[*offset:])
-			*offset += size
-			newSlice.Index(i).SetString(value)
-			fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-		case reflect.TypeOf(uint32(0)):
-			value, size := readUnsignedInt(binaryMsg[*offset:])
-			*offset += size
-			newSlice.Index(i).SetUint(uint64(value))
-			fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-		case reflect.TypeOf(int32(0)):
-			value, size := readInt(binaryMsg[*offset:])
-			*offset += size
-			newSlice.Index(i).SetInt(int64(value))
-			fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-		case reflect.TypeOf(float64(0.0)):
-			value, size := readDouble(binaryMsg[*offset:])
-			*offset += size
-			newSlice.Index(i).SetFloat(value)
-			fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-		default:
-			typeInstance := reflect.New(fieldTypesMap[string(instance.Type().Field(index).Tag.Get("type"))]).Elem()
-			ReadFields(binaryMsg, typeInstance, offset)
-			//log.Fatalf("ReadVector: Unimplemented type: %s, at index %v\n", field.Type().String(), index)
+		vectorSize = int(value)
+		*offset += size
+	} else {
+		value, size, err := readUnsignedShort(binaryMsg[*offset:])
+		if err != nil {
+			return err
+		}
+		vectorSize = int(value)
+		*offset += size
+	}
+
+	if *logAllPackets {
+		fmt.Printf("Vector (size:%v): %v\n", vectorSize, field.Type().String())
+	}
+
+	// Every element takes at least a byte
+	if vectorSize < 0 || vectorSize > len(binaryMsg)-*offset {
+		return fmt.Errorf("vector of %v elements does not fit in %v bytes", vectorSize, len(binaryMsg)-*offset)
+	}
+
+	newSlice := reflect.MakeSlice(field.Type(), vectorSize, vectorSize)
+	for i := 0; i < vectorSize; i++ {
+		if err := readElement(binaryMsg, newSlice.Index(i), tag, offset); err != nil {
+			return err
 		}
 	}
 
 	// Set the new slice to the field
 	field.Set(newSlice)
+	return nil
 }
 
-func readField(binaryMsg []byte, instance reflect.Value, index int, offset *int) {
-	field := instance.Field(index)
-	if instance.Type().Field(index).Tag.Get("prefixed") == "true" {
-		*offset += 2
+// Reads the bytes holding the flags of the booleans starting at index
+func readBooleanBox(binaryMsg []byte, instance reflect.Value, index int, offset *int) ([]byte, error) {
+	count := 0
+	for i := index; i < instance.NumField() && instance.Type().Field(i).Tag.Get("wrapper") != "0"; i++ {
+		count++
 	}
-	switch field.Kind() {
-	case reflect.Bool:
-		value, size := readBoolean(binaryMsg)
-		*offset += size
-		field.SetBool(value)
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	case reflect.Uint8:
-		value, size := readByte(binaryMsg)
-		*offset += size
-		field.SetUint(uint64(value))
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	case reflect.Uint16:
-		value, size := readUnsignedShort(binaryMsg)
-		*offset += size
-		field.SetUint(uint64(value))
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	case reflect.String:
-		value, size := readString(binaryMsg)
-		*offset += size
-		field.SetString(value)
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	case reflect.Uint32:
-		value, size := readUnsignedInt(binaryMsg)
-		*offset += size
-		field.SetUint(uint64(value))
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	case reflect.Int32:
-		value, size := readInt(binaryMsg)
-		*offset += size
-		field.SetInt(int64(value))
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	case reflect.Float64:
-		value, size := readDouble(binaryMsg)
-		*offset += size
-		field.SetFloat(value)
-		fmt.Printf("Added %v value: %v (size:%v)\n", reflect.TypeOf(value), value, size)
-	default:
-		log.Fatalf("Unimplemented type: %s, at index %v\n", field.Kind(), index)
+	size := (count + 7) / 8
+	if len(binaryMsg)-*offset < size {
+		return nil, errShortBody
 	}
+	box := binaryMsg[*offset : *offset+size]
+	*offset += size
+	return box, nil
 }
 
-func ReadFields(binaryMsg []byte, instance reflect.Value, offset *int) {
+func ReadFields(binaryMsg []byte, instance reflect.Value, offset *int) error {
+	var box []byte
 	for i := 0; i < instance.NumField(); i++ {
 		field := instance.Field(i)
-		fmt.Printf("loop %v, offset: %v\n", i, *offset)
+		tag := instance.Type().Field(i).Tag
+		if *logAllPackets {
+			fmt.Printf("loop %v, offset: %v\n", i, *offset)
+		}
+
+		// Booleans wrapped together in bytes
+		if wrapper, _ := strconv.Atoi(tag.Get("wrapper")); wrapper > 0 {
+			if box == nil {
+				var err error
+				if box, err = readBooleanBox(binaryMsg, instance, i, offset); err != nil {
+					return fmt.Errorf("field %v: %w", instance.Type().Field(i).Name, err)
+				}
+			}
+			field.SetBool(box[(wrapper-1)/8]&(1<<((wrapper-1)%8)) != 0)
+			continue
+		}
+		box = nil
+
+		var err error
 		if field.Kind() == reflect.Slice {
-			readVector(binaryMsg[*offset:], instance, i, offset)
+			err = readVector(binaryMsg, field, tag, offset)
 		} else {
-			readField(binaryMsg[*offset:], instance, i, offset)
+			err = readElement(binaryMsg, field, tag, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("field %v: %w", instance.Type().Field(i).Name, err)
 		}
 	}
+	return nil
 }
 
-func createStruct(packet dofusMsg) {
-	schemaBytes := gjson.GetBytes(messagesJson, fmt.Sprintf("%v", packet.ProtocolId))
-
-	// Unmarshal the JSON schema into a Schema struct
-	var schema MessageSchema
-	if err := json.Unmarshal([]byte(schemaBytes.Raw), &schema); err != nil {
-		log.Fatal(err)
+// Decodes the body of a message according to its schema
+func decodeBody(packet *dofusMsg) (instance reflect.Value, err error) {
+	messageType, err := messageStruct(packet.ProtocolId)
+	if err != nil {
+		return
 	}
+	instance = reflect.New(messageType).Elem()
 
-	// Dynamically create Message struct using reflection
-	var fields []reflect.StructField
-	//var fieldIndexMethodMap map[int]string
-	for _, field := range schema.Fields {
-		fields = append(fields, reflect.StructField{
-			Name: strings.Title(field.Name),
-			Type: getFieldType(field),
-			Tag:  reflect.StructTag(fmt.Sprintf("type:\"%v\" prefixed:\"%v\"", field.Type, field.PrefixedByTypeID)),
-		})
+	offset := 0
+	if err = ReadFields(packet.body, instance, &offset); err != nil {
+		return instance, fmt.Errorf("decoding %v: %w", packet.Name(), err)
+	}
+	if *logAllPackets {
+		fmt.Printf("Decoded %v (packetsize:%d, read:%d)\n", packet.Name(), len(packet.body), offset)
 	}
+	return
+}
 
-	// Create an instance of ChatServerMessage
-	messageType := reflect.StructOf(fields)
-	instance := reflect.New(messageType).Elem()
+// Fields returns the decoded body of the message. Decoding happens once and
+// is shared by every subscriber receiving the message.
+func (dM *dofusMsg) Fields() (reflect.Value, error) {
+	if dM.decoded == nil {
+		return decodeBody(dM)
+	}
+	dM.decoded.once.Do(func() {
+		dM.decoded.instance, dM.decoded.err = decodeBody(dM)
+	})
+	return dM.decoded.instance, dM.decoded.err
+}
 
-	// Example binary packet
-	binaryPacket := packet.body // "Hello" (string) followed by 5 (int)
+// JSON returns the decoded body of the message, using the field names of
+// the protocol
+func (dM *dofusMsg) JSON() ([]byte, error) {
+	instance, err := dM.Fields()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(instance.Interface())
+}
 
-	fmt.Printf("Decoding %v (size:%v)\n", idNameMap[packet.ProtocolId], len(binaryPacket))
-	// Decode the binary packet according to the dynamic schema
-	offset := 0
-	ReadFields(binaryPacket, instance, &offset)
+func printMessage(packet dofusMsg) {
+	instance, err := packet.Fields()
+	if err != nil {
+		log.Println(err)
+		return
+	}
 
-	// Use the decoded data
-	fmt.Printf("Decoded %v (packetsize:%d, read:%d)\n", idNameMap[packet.ProtocolId], len(binaryPacket), offset)
+	fmt.Printf("Decoded %v (packetsize:%d)\n", packet.Name(), len(packet.body))
 	for i := 0; i < instance.NumField(); i++ {
 		field := instance.Type().Field(i)
 		value := instance.Field(i).Interface()
 		fmt.Printf("%s: %v\n", field.Name, value)
 	}
 	fmt.Println("===============================")
-	//fmt.Printf("Field : %v\n", instance.FieldByName("Content"))
-
 }
 
-func parseArchi() {
-	for packet := range havenBagInventoryPackets {
-		fmt.Printf("%v\n", packet.ProtocolId)
-		createStruct(packet)
-	}
-}
+// Subcommands, run as "rps <command> [flags]". Without one, rps captures.
+var commands = map[string]func(args []string) int{}
 
-func beatbox() {
-	for packet := range chatPackets {
-		fmt.Printf("%v\n", packet.ProtocolId)
-		createStruct(packet)
+// Commands register themselves from an init function
+func registerCommand(name string, command func(args []string) int) {
+	if _, ok := commands[name]; ok {
+		log.Fatalf("Command %q registered twice", name)
 	}
+	commands[name] = command
 }
 
-func redirectMessage(message dofusMsg) {
-	// fmt.Printf("%v\n", idNameMap[int(message.ProtocolId)])
-	switch messageName := idNameMap[message.ProtocolId]; messageName {
-	//case "ChatServerMessage":
-	//fallthrough
-	//case "KnownZaapListMessage":
-	//chatPackets <- message
-	case "StorageInventoryContentMessage":
-		havenBagInventoryPackets <- message
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
 	}
+	os.Exit(run(os.Args[1:]))
 }
 
-func main() {
-	var err error
-	log.Println("start")
-	defer log.Println("end")
-	flag.Parse()
-
+// Loads the protocol description and resets the type caches
+func loadProtocol() error {
 	bytesJSON, err := os.ReadFile("toto.json")
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	messagesJson, typesJson, err = json_epurate(bytesJSON)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	fieldTypesMap = make(map[string]reflect.Type)
+	messageTypesMap = make(map[uint16]reflect.Type)
+	pendingTypes = make(map[string]bool)
+	return nil
+}
+
+// Returns a context cancelled by SIGINT or SIGTERM. The first signal starts
+// a clean shutdown, a second one kills the process.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// Runs the capture pipeline with the command line arguments args and
+// returns the exit code
+func run(args []string) int {
+	var err error
+	log.Println("start")
+	defer log.Println("end")
+	flag.CommandLine.Parse(args)
+
+	if err = loadProtocol(); err != nil {
+		log.Println(err)
+		return 1
 	}
 
 	if *listInterfaces {
 		ListInterfaces()
-		return
+		return 0
 	}
 
-	fieldTypesMap = make(map[string]reflect.Type)
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		log.Printf("could not load configuration %v - %s", *configFile, err)
+		return 1
+	}
+	if *whereFilter != "" {
+		if err = config.setWhere(*whereFilter); err != nil {
+			log.Printf("-where: %s", err)
+			return 2
+		}
+	}
+	if *replayPaused && *apiAddr == "" {
+		// Nothing could ever resume the replay
+		log.Println("-replay-paused needs -api")
+		return 2
+	}
 
-	//chatPackets = make(chan dofusMsg)
-	//go beatbox()
-	havenBagInventoryPackets = make(chan dofusMsg)
-	go parseArchi()
+	ctx, stop := signalContext()
+	defer stop()
 
-	handlePackets()
+	if isOfflineCapture() {
+		speed, err := parseReplaySpeed(*replaySpeed)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		replay = newReplayClock(speed, *replayPaused)
+	}
+
+	apiCtx, stopAPI := context.WithCancel(ctx)
+	defer stopAPI()
+	waitAPI, err := startAPI(apiCtx)
+	if err != nil {
+		log.Printf("could not start the api - %s", err)
+		return 1
+	}
+	go reportStats(apiCtx)
 
-	for true {
+	bus = newMessageBus()
+	names := config.enabledModules()
+	if agentMode && !slices.Contains(names, "agent") {
+		names = append(names, "agent")
+	}
+	modules, err := startModules(ctx, bus, names, config)
+	if err != nil {
+		log.Println(err)
+		stopAPI()
+		waitAPI()
+		return 1
+	}
 
+	// Capture, reassembly and readers are done once handlePackets (or the
+	// proxy, or the collector) returns, the modules can then handle what is
+	// left in their inbox
+	switch {
+	case collectorMode:
+		err = runCollector(ctx)
+	case *proxyListen != "":
+		err = runProxy(ctx)
+	default:
+		err = handlePackets(ctx)
 	}
-	// fmpackets := make(chan int)
+	bus.Close()
+	modules.Stop()
 
-	// go combat(combatpackets)
-	// go fm(fmpackets)
+	stopAPI()
+	waitAPI()
+	logStats(stats.report())
 
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain loads the protocol from toto.json. json_epurate writes its
+// result files in the working directory, so it runs from a scratch one.
+func TestMain(m *testing.M) {
+	if err := loadTestProtocol(); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+func loadTestProtocol() error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "rps-test")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink(filepath.Join(wd, "toto.json"), filepath.Join(dir, "toto.json")); err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+	return loadProtocol()
+}
+
+// bodyEncoder writes message bodies the way the game does, for the tests
+// feeding modules
+type bodyEncoder struct {
+	bytes.Buffer
+}
+
+func (e *bodyEncoder) varint(v uint64) *bodyEncoder {
+	for v >= 0x80 {
+		e.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	e.WriteByte(byte(v))
+	return e
+}
+
+func (e *bodyEncoder) byte(v byte) *bodyEncoder {
+	e.WriteByte(v)
+	return e
+}
+
+func (e *bodyEncoder) boolean(v bool) *bodyEncoder {
+	if v {
+		return e.byte(1)
+	}
+	return e.byte(0)
+}
+
+func (e *bodyEncoder) short(v int16) *bodyEncoder {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+	return e
+}
+
+func (e *bodyEncoder) int(v int32) *bodyEncoder {
+	binary.Write(&e.Buffer, binary.BigEndian, v)
+	return e
+}
+
+func (e *bodyEncoder) float(v float32) *bodyEncoder {
+	binary.Write(&e.Buffer, binary.BigEndian, math.Float32bits(v))
+	return e
+}
+
+func (e *bodyEncoder) double(v float64) *bodyEncoder {
+	binary.Write(&e.Buffer, binary.BigEndian, math.Float64bits(v))
+	return e
+}
+
+func (e *bodyEncoder) utf(s string) *bodyEncoder {
+	e.short(int16(len(s)))
+	e.WriteString(s)
+	return e
+}
+
+// Time of the first message of the tests
+var testEpoch = time.Date(2024, 4, 7, 16, 0, 0, 0, time.UTC)
+
+// Returns the message name with the given body, sent at second of the
+// session of client. The body must decode.
+func testMessage(t *testing.T, name string, dir msgDirection, client string, second int, body *bodyEncoder) dofusMsg {
+	t.Helper()
+	id, ok := nameIdMap[name]
+	if !ok {
+		t.Fatalf("unknown message %s", name)
+	}
+	msg := dofusMsg{
+		ProtocolId: id,
+		body:       append([]byte(nil), body.Bytes()...),
+		Timestamp:  testEpoch.Add(time.Duration(second) * time.Second),
+		Direction:  dir,
+		Client:     client,
+		Server:     "172.65.0.1:5555",
+		decoded:    new(decodedBody),
+	}
+	if _, err := msg.JSON(); err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return msg
+}
+
+// Runs module over messages with the given options, and stops it
+func runModule(t *testing.T, module Module, options string, messages []dofusMsg) {
+	t.Helper()
+	inbox := make(chan dofusMsg)
+	env := &moduleEnv{Inbox: inbox, Log: log.New(io.Discard, "", 0), Options: json.RawMessage(options)}
+	if c, ok := module.(configurableModule); ok {
+		if err := c.Configure(env); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := module.Start(context.Background(), env); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range messages {
+		inbox <- msg
+	}
+	close(inbox)
+	if err := module.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns the CharacterSelectedSuccessMessage of name, logging in the
+// session of client
+func characterSelected(t *testing.T, client string, name string) dofusMsg {
+	t.Helper()
+	body := new(bodyEncoder).varint(1).utf(name).varint(200)
+	body.varint(1).short(0).short(0).short(0).short(0) // entityLook
+	body.byte(1).boolean(false).boolean(false)
+	return testMessage(t, "CharacterSelectedSuccessMessage", dirServerToClient, client, 0, body)
+}
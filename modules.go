@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Module is a self-contained feature (chat logging, inventory tracking...)
+// fed with the messages it subscribed to.
+type Module interface {
+	Name() string
+	// Messages the module wants in its inbox, everything if empty
+	Subscriptions() []messageFilter
+	// Start launches the module. It must not block.
+	Start(ctx context.Context, env *moduleEnv) error
+	// Stop is called once the inbox is closed, it waits for the module to
+	// handle the remaining messages and releases its resources.
+	Stop() error
+}
+
+// moduleEnv is what a module gets from the registry when started
+type moduleEnv struct {
+	Inbox   <-chan dofusMsg
+	Log     *log.Logger
+	Options json.RawMessage // Module section of the configuration, may be nil
+}
+
+// Decodes the module options into v, leaving v untouched if there are none
+func (env *moduleEnv) decodeOptions(v interface{}) error {
+	if len(env.Options) == 0 {
+		return nil
+	}
+	return json.Unmarshal(env.Options, v)
+}
+
+// configurableModule is implemented by the modules whose subscriptions
+// depend on their options. Configure is called before Subscriptions, the
+// inbox of env is not set yet.
+type configurableModule interface {
+	Configure(env *moduleEnv) error
+}
+
+// sessionEndSubscriber is implemented by the modules keeping state per
+// session. Once both directions of a session are closed, they get a message
+// with Closed set after the last message of the session, whatever their
+// subscriptions.
+type sessionEndSubscriber interface {
+	subscribeSessionEnds()
+}
+
+type moduleFactory func() Module
+
+var moduleFactories = map[string]moduleFactory{}
+
+// Modules register themselves from an init function
+func registerModule(name string, factory moduleFactory) {
+	if _, ok := moduleFactories[name]; ok {
+		log.Fatalf("Module %q registered twice", name)
+	}
+	moduleFactories[name] = factory
+}
+
+// Returns the names of all the registered modules
+func moduleNames() []string {
+	names := make([]string, 0, len(moduleFactories))
+	for name := range moduleFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type runningModule struct {
+	module Module
+	sub    *subscription
+	log    *log.Logger
+}
+
+// moduleManager owns the lifecycle of the enabled modules
+type moduleManager struct {
+	bus     *messageBus
+	running []*runningModule
+}
+
+// Instantiates and starts the given modules, in order. On error, the
+// modules already started are stopped.
+func startModules(ctx context.Context, bus *messageBus, names []string, config *rpsConfig) (*moduleManager, error) {
+	policy, err := parseQueuePolicy(*moduleQueuePolicy, policyBlock, policyDropOldest)
+	if err != nil {
+		return nil, err
+	}
+	inbox := queueOptions{size: *moduleQueueSize, policy: policy}
+
+	mm := &moduleManager{bus: bus}
+	for i, name := range names {
+		if slices.Contains(names[:i], name) {
+			mm.Stop()
+			return nil, fmt.Errorf("module %q enabled twice", name)
+		}
+		factory, ok := moduleFactories[name]
+		if !ok {
+			mm.Stop()
+			return nil, fmt.Errorf("unknown module %q (available: %s)", name, strings.Join(moduleNames(), ", "))
+		}
+
+		module := factory()
+		logger := log.New(os.Stderr, fmt.Sprintf("[%s] ", name), log.LstdFlags|log.Lmsgprefix)
+		env := &moduleEnv{
+			Log:     logger,
+			Options: config.Options[name],
+		}
+		if configurable, ok := module.(configurableModule); ok {
+			if err := configurable.Configure(env); err != nil {
+				mm.Stop()
+				return nil, fmt.Errorf("configuring module %q: %w", name, err)
+			}
+		}
+		sub := bus.Subscribe(name, inbox, config.moduleSubscriptions(name, module.Subscriptions())...)
+		if _, ok := module.(sessionEndSubscriber); ok {
+			bus.SubscribeSessionEnds(sub)
+		}
+		env.Inbox = sub.C
+		if err := module.Start(ctx, env); err != nil {
+			bus.Unsubscribe(sub)
+			mm.Stop()
+			return nil, fmt.Errorf("starting module %q: %w", name, err)
+		}
+		logger.Println("started")
+		mm.running = append(mm.running, &runningModule{module: module, sub: sub, log: logger})
+	}
+	return mm, nil
+}
+
+// Stop closes the inbox of every module and stops them, in the reverse
+// order they were started
+func (mm *moduleManager) Stop() {
+	for i := len(mm.running) - 1; i >= 0; i-- {
+		rm := mm.running[i]
+		mm.bus.Unsubscribe(rm.sub)
+		if err := rm.module.Stop(); err != nil {
+			rm.log.Printf("stop: %v", err)
+		}
+		if dropped := rm.sub.Dropped(); dropped > 0 {
+			rm.log.Printf("stopped, %d messages dropped", dropped)
+		} else {
+			rm.log.Println("stopped")
+		}
+	}
+	mm.running = nil
+}
+
+// baseModule implements the lifecycle of modules handling their messages
+// one at a time in a single goroutine
+type baseModule struct {
+	env  *moduleEnv
+	done chan struct{}
+}
+
+func (bm *baseModule) run(env *moduleEnv, handle func(msg dofusMsg)) {
+	bm.env = env
+	bm.done = make(chan struct{})
+	go func() {
+		defer close(bm.done)
+		for msg := range env.Inbox {
+			handle(msg)
+		}
+	}()
+}
+
+func (bm *baseModule) Stop() error {
+	if bm.done != nil {
+		<-bm.done
+	}
+	return nil
+}
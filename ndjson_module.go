@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerModule("ndjson", func() Module { return new(ndjsonModule) })
+}
+
+// messageRecord is a message as written by the ndjson module, one per line
+type messageRecord struct {
+	Time       time.Time       `json:"time"`
+	Session    string          `json:"session"`
+	Character  string          `json:"character,omitempty"`
+	Server     string          `json:"server"`
+	Seq        uint64          `json:"seq"`
+	Direction  string          `json:"direction"`
+	ProtocolId uint16          `json:"protocolId"`
+	Name       string          `json:"name"`
+	Namespace  string          `json:"namespace"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Raw        []byte          `json:"raw"`
+}
+
+func newMessageRecord(msg *dofusMsg, character string) messageRecord {
+	record := messageRecord{
+		Time:       msg.Timestamp,
+		Session:    msg.Session(),
+		Character:  character,
+		Server:     msg.Server,
+		Seq:        msg.Seq,
+		Direction:  msg.Direction.String(),
+		ProtocolId: msg.ProtocolId,
+		Name:       msg.Name(),
+		Namespace:  msg.Namespace(),
+		Raw:        msg.body,
+	}
+	if body, err := msg.JSON(); err != nil {
+		record.Error = err.Error()
+	} else {
+		record.Body = body
+	}
+	return record
+}
+
+type ndjsonOptions struct {
+	Dir        string   `json:"dir"`
+	Prefix     string   `json:"prefix"`
+	MaxSize    int64    `json:"maxSize"`    // Bytes, 0 for no limit
+	Daily      bool     `json:"daily"`      // Start a new file every day
+	Gzip       bool     `json:"gzip"`       // Compress closed files
+	Names      []string `json:"names"`      // Only keep these messages and
+	Namespaces []string `json:"namespaces"` // those of these namespaces
+}
+
+// ndjsonModule writes a JSON line per message to files rotated by size or
+// by day, e.g. with the options
+//
+//	{"dir": "logs", "maxSize": 104857600, "daily": true, "gzip": true,
+//	 "namespaces": ["game.chat", "game.inventory.exchanges"]}
+type ndjsonModule struct {
+	baseModule
+	options    ndjsonOptions
+	characters *characterTracker
+
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+	day     string
+	err     error
+	gzipped sync.WaitGroup
+}
+
+func (nm *ndjsonModule) Name() string {
+	return "ndjson"
+}
+
+func (nm *ndjsonModule) Subscriptions() []messageFilter {
+	var filters []messageFilter
+	if len(nm.options.Names) > 0 {
+		filters = append(filters, byName(nm.options.Names...))
+	}
+	for _, namespace := range nm.options.Namespaces {
+		filters = append(filters, byNamespace(namespace))
+	}
+	return filters
+}
+
+// The character of a session is forgotten at its end
+func (nm *ndjsonModule) subscribeSessionEnds() {}
+
+func (nm *ndjsonModule) Start(ctx context.Context, env *moduleEnv) error {
+	if err := os.MkdirAll(nm.options.Dir, 0o755); err != nil {
+		return err
+	}
+	env.Log.Printf("writing to %s", nm.options.Dir)
+	nm.characters = newCharacterTracker()
+	nm.run(env, nm.write)
+	return nil
+}
+
+func (nm *ndjsonModule) Configure(env *moduleEnv) error {
+	nm.options = ndjsonOptions{Dir: "logs", Prefix: "rps", MaxSize: 100 << 20, Daily: true, Gzip: true}
+	return env.decodeOptions(&nm.options)
+}
+
+func (nm *ndjsonModule) Stop() error {
+	nm.baseModule.Stop()
+	nm.close()
+	nm.gzipped.Wait()
+	return nm.err
+}
+
+func (nm *ndjsonModule) write(msg dofusMsg) {
+	if msg.Closed {
+		nm.characters.Forget(msg.Session())
+		return
+	}
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(newMessageRecord(&msg, nm.characters.Observe(&msg))); err != nil {
+		nm.env.Log.Printf("could not encode %s - %s", msg.Name(), err)
+		return
+	}
+	line := buffer.Bytes()
+
+	day := msg.Timestamp.Local().Format(time.DateOnly)
+	if nm.file != nil && ((nm.options.Daily && day != nm.day) ||
+		(nm.options.MaxSize > 0 && nm.size+int64(len(line)) > nm.options.MaxSize)) {
+		nm.close()
+	}
+	if nm.file == nil {
+		if err := nm.open(msg.Timestamp); err != nil {
+			nm.env.Log.Printf("could not open a new file - %s", err)
+			nm.err = err
+			return
+		}
+		nm.day = day
+	}
+
+	if _, err := nm.writer.Write(line); err != nil {
+		nm.env.Log.Printf("could not write to %s - %s", nm.file.Name(), err)
+		nm.err = err
+		return
+	}
+	nm.size += int64(len(line))
+}
+
+// Opens a new file, named after the capture time of its first message
+func (nm *ndjsonModule) open(timestamp time.Time) error {
+	base := filepath.Join(nm.options.Dir, fmt.Sprintf("%s-%s", nm.options.Prefix, timestamp.Local().Format("2006-01-02T15-04-05")))
+	path := base + ".ndjson"
+	for i := 1; fileExists(path) || fileExists(path+".gz"); i++ {
+		path = fmt.Sprintf("%s-%d.ndjson", base, i)
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	nm.file = file
+	nm.writer = bufio.NewWriter(file)
+	nm.size = 0
+	return nil
+}
+
+// Closes the current file and compresses it in the background
+func (nm *ndjsonModule) close() {
+	if nm.file == nil {
+		return
+	}
+	path := nm.file.Name()
+	err := nm.writer.Flush()
+	if closeErr := nm.file.Close(); err == nil {
+		err = closeErr
+	}
+	nm.file, nm.writer = nil, nil
+	if err != nil {
+		nm.env.Log.Printf("could not close %s - %s", path, err)
+		nm.err = err
+		return
+	}
+
+	if nm.options.Gzip {
+		nm.gzipped.Add(1)
+		go func() {
+			defer nm.gzipped.Done()
+			if err := gzipFile(path); err != nil {
+				nm.env.Log.Printf("could not compress %s - %s", path, err)
+			}
+		}()
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Compresses path to path.gz and removes it
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(out)
+	writer.Name = filepath.Base(path)
+	_, err = io.Copy(writer, in)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestNdjsonRotation(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	// A message every 10 minutes from 23:40, local time
+	start := time.Date(2024, 4, 7, 23, 40, 0, 0, time.Local)
+	messages := make([]dofusMsg, 6)
+	for i := range messages {
+		messages[i] = testMessage(t, "KamasUpdateMessage", dirServerToClient, game, 0, new(bodyEncoder).varint(uint64(1000+i)))
+		messages[i].Timestamp = start.Add(time.Duration(i) * 10 * time.Minute)
+	}
+	// As the module writes them, all of the same length
+	var line bytes.Buffer
+	encoder := json.NewEncoder(&line)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(newMessageRecord(&messages[0], "")); err != nil {
+		t.Fatal(err)
+	}
+	lineLen := line.Len()
+
+	tests := []struct {
+		name    string
+		options string
+		want    []int // Messages by file, in order
+	}{
+		{"daily", `"daily": true, "maxSize": 0`, []int{2, 4}},
+		{"by size", fmt.Sprintf(`"daily": false, "maxSize": %d`, 2*lineLen), []int{2, 2, 2}},
+		{"by size and daily", fmt.Sprintf(`"daily": true, "maxSize": %d`, 3*lineLen), []int{2, 3, 1}},
+		{"never", `"daily": false, "maxSize": 0`, []int{6}},
+	}
+	for _, test := range tests {
+		for _, gzip := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s, gzip %v", test.name, gzip), func(t *testing.T) {
+				dir := t.TempDir()
+				runModule(t, new(ndjsonModule), fmt.Sprintf(`{"dir": %q, "gzip": %v, %s}`, dir, gzip, test.options), messages)
+
+				entries, err := os.ReadDir(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, entry := range entries {
+					if strings.HasSuffix(entry.Name(), ".gz") != gzip {
+						t.Errorf("%s left, gzip %v", entry.Name(), gzip)
+					}
+				}
+				// Every file is complete, and rps query reads them in order
+				files, err := ndjsonFiles(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []int
+				var kamas []int64
+				for _, file := range files {
+					count := 0
+					_, err := readNdjsonFile(file, func(record *messageRecord) bool {
+						count++
+						return true
+					})
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, count)
+				}
+				err = ndjsonSource(dir)(&queryFilter{}, func(record *messageRecord) bool {
+					kamas = append(kamas, gjson.GetBytes(record.Body, "kamasTotal").Int())
+					return true
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, test.want) {
+					t.Errorf("messages by file %v, want %v", got, test.want)
+				}
+				if !reflect.DeepEqual(kamas, []int64{1000, 1001, 1002, 1003, 1004, 1005}) {
+					t.Errorf("read %v", kamas)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommand("webhook-standin", runWebhookStandin)
+}
+
+// notification is something a module wants the user to know about
+type notification struct {
+	Time    time.Time              `json:"time"`
+	Kind    string                 `json:"kind"` // e.g. "price", "undercut"
+	Title   string                 `json:"title"`
+	Message string                 `json:"message"`
+	Fields  map[string]interface{} `json:"fields,omitempty"`
+}
+
+// notifier delivers notifications somewhere
+type notifier interface {
+	Notify(ctx context.Context, n notification) error
+}
+
+// notifierConfig configures a notifier in the options of a module, e.g.
+//
+//	"notify": [{"type": "log"}, {"type": "webhook", "url": "http://127.0.0.1:8099/"}]
+type notifierConfig struct {
+	Type    string            `json:"type"` // log or webhook
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Notifiers used when a module configures none
+var defaultNotifiers = []notifierConfig{{Type: "log"}}
+
+// logNotifier writes notifications to the log of the module
+type logNotifier struct {
+	logger *log.Logger
+}
+
+func (ln *logNotifier) Notify(ctx context.Context, n notification) error {
+	ln.logger.Printf("%s: %s", n.Title, n.Message)
+	return nil
+}
+
+// How long a webhook may take to answer
+const webhookTimeout = 10 * time.Second
+
+// webhookNotifier posts notifications as JSON to a URL, for chat bots,
+// push services or desktop scripts to pick them up
+type webhookNotifier struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (wn *webhookNotifier) Notify(ctx context.Context, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range wn.headers {
+		request.Header.Set(name, value)
+	}
+	response, err := wn.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("%s answered %s", wn.url, response.Status)
+	}
+	return nil
+}
+
+func newNotifier(config notifierConfig, logger *log.Logger) (notifier, error) {
+	switch config.Type {
+	case "log":
+		return &logNotifier{logger: logger}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, errors.New("webhook notifier without url")
+		}
+		return &webhookNotifier{url: config.URL, headers: config.Headers, client: &http.Client{Timeout: webhookTimeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier type %q, expected log or webhook", config.Type)
+}
+
+// Notifications waiting to be delivered, more are dropped
+const notificationQueueSize = 100
+
+// notifierSet delivers notifications to several notifiers in the
+// background, so that a slow webhook does not hold the module back
+type notifierSet struct {
+	notifiers []notifier
+	logger    *log.Logger
+	queue     chan notification
+	done      chan struct{}
+}
+
+func newNotifierSet(configs []notifierConfig, logger *log.Logger) (*notifierSet, error) {
+	if len(configs) == 0 {
+		configs = defaultNotifiers
+	}
+	ns := &notifierSet{
+		logger: logger,
+		queue:  make(chan notification, notificationQueueSize),
+		done:   make(chan struct{}),
+	}
+	for _, config := range configs {
+		target, err := newNotifier(config, logger)
+		if err != nil {
+			return nil, err
+		}
+		ns.notifiers = append(ns.notifiers, target)
+	}
+	go ns.deliver()
+	return ns, nil
+}
+
+// Notify queues a notification for delivery
+func (ns *notifierSet) Notify(n notification) {
+	select {
+	case ns.queue <- n:
+	default:
+		ns.logger.Printf("too many notifications, dropped %q", n.Title)
+	}
+}
+
+// Close delivers the queued notifications and stops
+func (ns *notifierSet) Close() {
+	close(ns.queue)
+	<-ns.done
+}
+
+func (ns *notifierSet) deliver() {
+	defer close(ns.done)
+	for n := range ns.queue {
+		var wg sync.WaitGroup
+		for _, target := range ns.notifiers {
+			wg.Add(1)
+			go func(target notifier) {
+				defer wg.Done()
+				if err := target.Notify(context.Background(), n); err != nil {
+					ns.logger.Printf("could not notify %q - %s", n.Title, err)
+				}
+			}(target)
+		}
+		wg.Wait()
+	}
+}
+
+// rps webhook-standin: logs the notifications posted by webhook notifiers,
+// to try them without a real service
+//
+//	rps webhook-standin -listen 127.0.0.1:8099
+func runWebhookStandin(args []string) int {
+	flags := flag.NewFlagSet("webhook-standin", flag.ExitOnError)
+	listen := flags.String("listen", "127.0.0.1:8099", "Address to receive the notifications on")
+	status := flags.Int("status", http.StatusOK, "HTTP status to answer with, to try failures")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s webhook-standin [-listen addr]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("webhook-standin: listening on http://%s", listener.Addr())
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			log.Printf("webhook-standin: %s %s: invalid notification - %s", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("webhook-standin: [%s] %s: %s %v", n.Kind, n.Title, n.Message, n.Fields)
+		w.WriteHeader(*status)
+	})}
+
+	ctx, stop := signalContext()
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
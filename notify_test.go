@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookNotifier(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		headers map[string]string
+		wantErr bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "headers", status: http.StatusOK, headers: map[string]string{"Authorization": "Bearer token", "X-Source": "rps"}},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+		{name: "not found", status: http.StatusNotFound, wantErr: true},
+	}
+	sent := notification{
+		Time:    time.Date(2024, 4, 7, 16, 0, 0, 0, time.UTC),
+		Kind:    "price",
+		Title:   "Item 421 x1 below 40",
+		Message: "the cheapest x1 of item 421 on server 291 is 30 kamas",
+		Fields:  map[string]interface{}{"gid": float64(421), "price": float64(30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received notification
+			var request *http.Request
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				request = r
+				if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+					t.Errorf("invalid notification - %s", err)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			target, err := newNotifier(notifierConfig{Type: "webhook", URL: server.URL, Headers: tt.headers}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = target.Notify(context.Background(), sent)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify() error = %v, want error %v", err, tt.wantErr)
+			}
+			if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+				t.Errorf("got %s with content type %q", request.Method, request.Header.Get("Content-Type"))
+			}
+			for name, value := range tt.headers {
+				if got := request.Header.Get(name); got != value {
+					t.Errorf("header %s = %q, want %q", name, got, value)
+				}
+			}
+			if !received.Time.Equal(sent.Time) || received.Kind != sent.Kind || received.Title != sent.Title ||
+				received.Message != sent.Message || received.Fields["gid"] != sent.Fields["gid"] {
+				t.Errorf("received %+v, want %+v", received, sent)
+			}
+		})
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		config  notifierConfig
+		wantErr bool
+	}{
+		{config: notifierConfig{Type: "log"}},
+		{config: notifierConfig{Type: "webhook", URL: "http://127.0.0.1:8099/"}},
+		{config: notifierConfig{Type: "webhook"}, wantErr: true},
+		{config: notifierConfig{Type: "mail"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := newNotifier(tt.config, nil); (err != nil) != tt.wantErr {
+			t.Errorf("newNotifier(%+v) error = %v, want error %v", tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+// Queued notifications are all delivered to the webhook on Close
+func TestNotifierSetWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var titles []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var n notification
+		json.NewDecoder(r.Body).Decode(&n)
+		mu.Lock()
+		titles = append(titles, n.Title)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	ns, err := newNotifierSet([]notifierConfig{{Type: "webhook", URL: server.URL}}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"first", "second", "third"} {
+		ns.Notify(notification{Title: title})
+	}
+	ns.Close()
+
+	if len(titles) != 3 || titles[0] != "first" || titles[2] != "third" {
+		t.Errorf("webhook received %v", titles)
+	}
+}
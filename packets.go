@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/binary"
-	"flag"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -12,10 +15,12 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/reassembly"
 )
 
+// Port of the game servers
+const gamePort layers.TCPPort = 5555
+
 // Dofus Protocol
 //
 // Standard port is TCP/5555
@@ -42,49 +47,157 @@ import (
 //
 //	If LenSize is 3, the pseudocode to get the value is the following
 //	(uint)(((msgLen1 & 255) << 16) + ((msgLen2 & 255) << 8) + (msgLen3 & 255))
+//
+//	Messages sent by the client have a 4 bytes InstanceId, counting the
+//	messages of the connection, between ProtocolId and MsgLen.
 type dofusMsg struct {
 	// Header fields
 	ProtocolId uint16
 	LenSize    uint8
+	InstanceId uint32
 	MsgLen     uint32
 
 	body []byte
+
+	// Capture metadata
+	Timestamp time.Time // Capture time of the segment holding the last byte
+	Direction msgDirection
+	Client    string   // Client endpoint, ip:port
+	Server    string   // Server endpoint, ip:port
+	Stream    string   // Ident of the tcpStream the message belongs to
+	Seq       uint64   // Position in the session timeline, both directions included
+	TCPSeq    uint32   // Sequence number of the segment holding the last byte
+	TCPAck    uint32   // Acknowledgment number of that segment
+	Attached  bool     // The session was picked up after it was established
+	Packets   []uint64 // Capture indexes of the packets carrying the message
+	Source    string   // Agent the message was received from, empty if captured here
+	Closed    bool     // Marks the end of the session, there is no body
+	Ending    string   // Why the session ended, for Closed: closed, shutdown or idle
+
+	order   uint64 // Arrival order in the session merger
+	decoded *decodedBody
 }
 
-func (dM *dofusMsg) decode(b *bufio.Reader) error {
-	var err error
+// dofusMsgWire is the serialized form of a dofusMsg, used when spilling
+// messages to disk
+type dofusMsgWire struct {
+	ProtocolId uint16
+	LenSize    uint8
+	InstanceId uint32
+	MsgLen     uint32
+	Body       []byte
+	Timestamp  time.Time
+	Direction  msgDirection
+	Client     string
+	Server     string
+	Stream     string
+	Seq        uint64
+	TCPSeq     uint32
+	TCPAck     uint32
+	Attached   bool
+	Packets    []uint64
+	Source     string
+	Closed     bool
+	Ending     string
+}
 
-	// Transform stream to byte slice
-	data, err := b.Peek(2)
-	if err != nil {
+func (dM dofusMsg) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(dofusMsgWire{
+		ProtocolId: dM.ProtocolId,
+		LenSize:    dM.LenSize,
+		InstanceId: dM.InstanceId,
+		MsgLen:     dM.MsgLen,
+		Body:       dM.body,
+		Timestamp:  dM.Timestamp,
+		Direction:  dM.Direction,
+		Client:     dM.Client,
+		Server:     dM.Server,
+		Stream:     dM.Stream,
+		Seq:        dM.Seq,
+		TCPSeq:     dM.TCPSeq,
+		TCPAck:     dM.TCPAck,
+		Attached:   dM.Attached,
+		Packets:    dM.Packets,
+		Source:     dM.Source,
+		Closed:     dM.Closed,
+		Ending:     dM.Ending,
+	})
+	return buf.Bytes(), err
+}
+
+func (dM *dofusMsg) GobDecode(b []byte) error {
+	var wire dofusMsgWire
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&wire); err != nil {
 		return err
 	}
+	*dM = dofusMsg{
+		ProtocolId: wire.ProtocolId,
+		LenSize:    wire.LenSize,
+		InstanceId: wire.InstanceId,
+		MsgLen:     wire.MsgLen,
+		body:       wire.Body,
+		Timestamp:  wire.Timestamp,
+		Direction:  wire.Direction,
+		Client:     wire.Client,
+		Server:     wire.Server,
+		Stream:     wire.Stream,
+		Seq:        wire.Seq,
+		TCPSeq:     wire.TCPSeq,
+		TCPAck:     wire.TCPAck,
+		Attached:   wire.Attached,
+		Packets:    wire.Packets,
+		Source:     wire.Source,
+		Closed:     wire.Closed,
+		Ending:     wire.Ending,
+		decoded:    new(decodedBody),
+	}
+	return nil
+}
 
-	// since there are no further layers, the baselayer's content is
-	// pointing to this layer
-	dM.ProtocolId = binary.BigEndian.Uint16(data[:2]) >> 2
-	dM.LenSize = data[1] & 0x3
-	switch dM.LenSize {
-	case 0:
-		dM.MsgLen = 0
-	case 1:
-		data, err = b.Peek(3)
-		if err != nil {
-			return err
-		}
-		dM.MsgLen = uint32(data[2])
-	case 2:
-		data, err = b.Peek(4)
-		if err != nil {
-			return err
-		}
-		dM.MsgLen = uint32(binary.BigEndian.Uint16(data[2:4]))
-	case 3:
-		data, err = b.Peek(5)
-		if err != nil {
-			return err
-		}
-		dM.MsgLen = uint32((data[2] << 16) + (data[3] << 8) + (data[4]))
+// Name returns the protocol name of the message
+func (dM *dofusMsg) Name() string {
+	return idNameMap[dM.ProtocolId]
+}
+
+// Namespace returns the protocol namespace of the message, relative to
+// messagesNamespace (e.g. "game.context.fight")
+func (dM *dofusMsg) Namespace() string {
+	return idNamespaceMap[dM.ProtocolId]
+}
+
+type msgDirection uint8
+
+const (
+	dirClientToServer msgDirection = iota
+	dirServerToClient
+)
+
+func (d msgDirection) String() string {
+	if d == dirClientToServer {
+		return "client->server"
+	}
+	return "server->client"
+}
+
+// Biggest message we expect, larger lengths mean we are not reading a header
+const maxMsgLen = 4 << 20
+
+var errInvalidFrame = errors.New("invalid frame")
+var errStreamGap = errors.New("data missing from the stream")
+var errUnknownMessage = errors.New("message missing from the protocol")
+
+// decode reads the frame at the start of b, the stream being in sync: the
+// header is trusted, plausible only serves to find the frames again. The
+// body of a message missing from the protocol, as when the game is newer
+// than toto.json, is skipped with errUnknownMessage.
+func (dM *dofusMsg) decode(b *bufio.Reader, isClient bool) error {
+	var err error
+	dM.decoded = new(decodedBody)
+
+	size, err := dM.peekHeader(b, 0, isClient)
+	if err != nil {
+		return err
 	}
 
 	if *logAllPackets {
@@ -94,49 +207,314 @@ func (dM *dofusMsg) decode(b *bufio.Reader) error {
 		log.Printf("LenSize : %v\n", dM.LenSize)
 		log.Printf("MsgLen : %v\n", dM.MsgLen)
 	}
-	b.Discard(int(2 + dM.LenSize))
+	if dM.MsgLen > maxMsgLen {
+		return errInvalidFrame
+	}
+
+	b.Discard(size)
 	dM.body, err = io.ReadAll(io.LimitReader(b, int64(dM.MsgLen)))
 
 	if err != nil {
 		return err
 	}
+	if len(dM.body) < int(dM.MsgLen) {
+		return io.ErrUnexpectedEOF
+	}
+	if _, ok := idNamespaceMap[dM.ProtocolId]; !ok {
+		return errUnknownMessage
+	}
 	return err
 }
 
+// peekHeader parses the header of the frame starting offset bytes ahead in
+// b, without consuming anything, and returns the size of the header
+func (dM *dofusMsg) peekHeader(b *bufio.Reader, offset int, isClient bool) (int, error) {
+	data, err := b.Peek(offset + 2)
+	if err != nil {
+		return 0, err
+	}
+
+	// since there are no further layers, the baselayer's content is
+	// pointing to this layer
+	dM.ProtocolId = binary.BigEndian.Uint16(data[offset:offset+2]) >> 2
+	dM.LenSize = data[offset+1] & 0x3
+
+	size := 2
+	if isClient {
+		size += 4
+	}
+	size += int(dM.LenSize)
+	data, err = b.Peek(offset + size)
+	if err != nil {
+		return 0, err
+	}
+	data = data[offset:]
+
+	if isClient {
+		dM.InstanceId = binary.BigEndian.Uint32(data[2:6])
+	}
+	dM.MsgLen = 0
+	for _, lenByte := range data[size-int(dM.LenSize) : size] {
+		dM.MsgLen = dM.MsgLen<<8 + uint32(lenByte)
+	}
+	return size, nil
+}
+
+// plausible tells if the header looks like one written by the game: a known
+// message, with a length encoded on as few bytes as possible
+func (dM *dofusMsg) plausible() bool {
+	if _, ok := idNamespaceMap[dM.ProtocolId]; !ok || dM.MsgLen > maxMsgLen {
+		return false
+	}
+	switch {
+	case dM.MsgLen == 0:
+		return dM.LenSize == 0
+	case dM.MsgLen <= 0xff:
+		return dM.LenSize == 1
+	case dM.MsgLen <= 0xffff:
+		return dM.LenSize == 2
+	}
+	return dM.LenSize == 3
+}
+
+// frame encodes the message back as it was sent on the wire
+func (dM *dofusMsg) frame() []byte {
+	frame := make([]byte, 2, 9+len(dM.body))
+	binary.BigEndian.PutUint16(frame, dM.ProtocolId<<2|uint16(dM.LenSize))
+	if dM.Direction == dirClientToServer {
+		frame = binary.BigEndian.AppendUint32(frame, dM.InstanceId)
+	}
+	for i := int(dM.LenSize) - 1; i >= 0; i-- {
+		frame = append(frame, byte(dM.MsgLen>>(8*i)))
+	}
+	return append(frame, dM.body...)
+}
+
+// Returns the size of the plausible frame starting offset bytes ahead in b
+func peekFrame(b *bufio.Reader, offset int, isClient bool) (int, error) {
+	var msg dofusMsg
+	size, err := msg.peekHeader(b, offset, isClient)
+	if err != nil {
+		return 0, err
+	}
+	if !msg.plausible() {
+		return 0, errInvalidFrame
+	}
+	return size + int(msg.MsgLen), nil
+}
+
+// Number of consecutive plausible frames needed to trust a boundary found
+// by syncFrames
+const syncChainLength = 3
+
+// Checks that the frame at offset is followed by plausible frames, as long
+// as they fit in the buffer and the stream goes on
+func peekChain(b *bufio.Reader, offset int, isClient bool) error {
+	for i := 0; i < syncChainLength; i++ {
+		size, err := peekFrame(b, offset, isClient)
+		if err == errInvalidFrame || (err != nil && i == 0) {
+			return err
+		}
+		if err != nil {
+			// Buffer full, end of stream or hole: cannot check any further
+			return nil
+		}
+		offset += size
+	}
+	return nil
+}
+
+// syncFrames looks for the first frame boundary in b, when the stream was
+// picked up in the middle or lost data. A boundary is a plausible header
+// followed by a few others, as far as the buffer allows to check. The bytes
+// before the boundary are discarded and their number returned.
+func syncFrames(b *bufio.Reader, isClient bool) (int, error) {
+	skipped := 0
+	for offset := 0; ; offset++ {
+		err := peekChain(b, offset, isClient)
+		switch err {
+		case nil:
+			n, _ := b.Discard(offset)
+			return skipped + n, nil
+		case errInvalidFrame:
+			continue
+		case bufio.ErrBufferFull, errStreamGap:
+			// Nothing in the buffer, or it is followed by a hole
+			n, _ := b.Discard(offset)
+			if err == errStreamGap {
+				rest, _ := b.Discard(b.Buffered())
+				n += rest
+			}
+			skipped += n
+			offset = -1
+		default:
+			return skipped, err
+		}
+	}
+}
+
+// streamChunk is a piece of reassembled data coming from a single captured
+// segment, along with its capture information.
+type streamChunk struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	gap  bool // Some data is missing before this chunk
+}
+
+// streamChunkWire is the serialized form of a streamChunk, used when
+// spilling chunks to disk
+type streamChunkWire struct {
+	Data []byte
+	CI   gopacket.CaptureInfo
+	Gap  bool
+}
+
+func (sC streamChunk) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(streamChunkWire{Data: sC.data, CI: sC.ci, Gap: sC.gap})
+	return buf.Bytes(), err
+}
+
+func (sC *streamChunk) GobDecode(b []byte) error {
+	var wire streamChunkWire
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&wire); err != nil {
+		return err
+	}
+	sC.data, sC.ci, sC.gap = wire.Data, wire.CI, wire.Gap
+	return nil
+}
+
+// chunkSpan remembers where a chunk ends in the stream, so a decoded message
+// can be mapped back to the segment holding its last byte.
+type chunkSpan struct {
+	end int64
+	ci  gopacket.CaptureInfo
+}
+
 type dofusReader struct {
 	ident    string
 	isClient bool
-	bytes    chan []byte
+	bytes    *boundedQueue[streamChunk]
 	data     []byte
+	consumed int64
+	spans    []chunkSpan
+	dropped  uint64
 	parent   *tcpStream
 }
 
+// Size of the buffer of a reader, a frame bigger than that cannot be
+// checked by the one following it when resynchronizing
+const readerBufferSize = 1 << 16
+
 func (hR *dofusReader) Read(bytes []byte) (int, error) {
 	ok := true
 	for len(hR.data) == 0 && ok {
-		hR.data, ok = <-hR.bytes
+		var chunk streamChunk
+		chunk, ok = hR.bytes.Pop()
+		hR.data = chunk.data
+		if ok && len(chunk.data) > 0 {
+			end := hR.consumed + int64(len(chunk.data))
+			if n := len(hR.spans); n > 0 {
+				end = hR.spans[n-1].end + int64(len(chunk.data))
+			}
+			hR.spans = append(hR.spans, chunkSpan{end: end, ci: chunk.ci})
+		}
+
+		// Report the hole before handing out what follows it
+		dropped := hR.bytes.Dropped()
+		if ok && (chunk.gap || dropped != hR.dropped) {
+			hR.dropped = dropped
+			return 0, errStreamGap
+		}
 	}
 	if !ok || len(hR.data) == 0 {
 		return 0, io.EOF
 	}
 	l := copy(bytes, hR.data)
 	hR.data = hR.data[l:]
+	hR.consumed += int64(l)
 	return l, nil
 }
 
+// packetsBetween returns the capture indexes of the packets carrying the
+// stream bytes from start to end (excluded)
+func (hR *dofusReader) packetsBetween(start, end int64) []uint64 {
+	var packets []uint64
+	for i, span := range hR.spans {
+		// Span i holds the bytes from the end of span i-1 to its own end
+		if span.end <= start || (i > 0 && hR.spans[i-1].end >= end) {
+			continue
+		}
+		if segment, ok := segmentOf(span.ci); ok {
+			if n := len(packets); n == 0 || packets[n-1] != segment.Packet {
+				packets = append(packets, segment.Packet)
+			}
+		}
+	}
+	return packets
+}
+
+// captureInfoAt returns the capture information of the segment holding the
+// byte at the given stream offset, and forgets about older segments.
+func (hR *dofusReader) captureInfoAt(offset int64) gopacket.CaptureInfo {
+	for len(hR.spans) > 1 && hR.spans[0].end <= offset {
+		hR.spans = hR.spans[1:]
+	}
+	if len(hR.spans) == 0 {
+		return gopacket.CaptureInfo{}
+	}
+	return hR.spans[0].ci
+}
+
 func (hR *dofusReader) Run(wg *sync.WaitGroup) {
 	defer wg.Done()
-	b := bufio.NewReader(hR)
+	b := bufio.NewReaderSize(hR, readerBufferSize)
+	synced := true
 	for {
+		if !synced {
+			skipped, err := syncFrames(b, hR.isClient)
+			if err != nil {
+				break
+			}
+			stats.resyncs.Add(1)
+			stats.skippedBytes.Add(uint64(skipped))
+			if skipped > 0 {
+				log.Printf("%s: skipped %d bytes to find the next message", hR.ident, skipped)
+			}
+			synced = true
+		}
+
 		msg := new(dofusMsg)
-		err := msg.decode(b)
+		start := hR.consumed - int64(b.Buffered())
+		err := msg.decode(b, hR.isClient)
+		if err == errStreamGap || err == errInvalidFrame {
+			if err == errStreamGap {
+				b.Discard(b.Buffered())
+			}
+			synced = false
+			continue
+		}
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			break
 		}
-		redirectMessage(*msg)
+		if err == errUnknownMessage {
+			stats.unknown.Add(1)
+			continue
+		}
+		end := hR.consumed - int64(b.Buffered())
+		msg.Packets = hR.packetsBetween(start, end)
+		hR.parent.tagMessage(msg, hR.isClient, hR.captureInfoAt(end-1))
+		stats.frames[msg.Direction].Add(1)
 		if *logAllPackets {
 			dumpByteSlice(msg.body)
 		}
+		hR.parent.merger.Add(msg)
+	}
+	// The stream tells why it ended before closing the queues
+	if hR.isClient {
+		hR.parent.merger.Done(dirClientToServer, hR.parent.ending)
+	} else {
+		hR.parent.merger.Done(dirServerToClient, hR.parent.ending)
 	}
 }
 
@@ -153,10 +531,37 @@ type tcpStream struct {
 	net, transport gopacket.Flow
 	tcpstate       *reassembly.TCPSimpleFSM
 	optchecker     reassembly.TCPOptionCheck
-	reversed       bool
+	clientIsSrc    bool // The game client is the source of the stream's flows
 	client         dofusReader
 	server         dofusReader
 	ident          string
+	clientAddr     string
+	serverAddr     string
+	merger         *sessionMerger
+	attached       bool
+	started        [2]bool // Data was seen, by reassembly direction
+	factory        *tcpStreamFactory
+	ending         string // Why the stream ended, set before closing the readers
+}
+
+// reassembly's nextSeq for a half connection that has not started yet
+const invalidSequence reassembly.Sequence = -1
+
+// tagMessage fills the capture metadata of a message decoded by one of the
+// stream's readers.
+func (tS *tcpStream) tagMessage(msg *dofusMsg, fromClient bool, ci gopacket.CaptureInfo) {
+	msg.Timestamp = ci.Timestamp
+	msg.Direction = dirServerToClient
+	if fromClient {
+		msg.Direction = dirClientToServer
+	}
+	msg.Client = tS.clientAddr
+	msg.Server = tS.serverAddr
+	msg.Stream = tS.ident
+	msg.Attached = tS.attached
+	if segment, ok := segmentOf(ci); ok {
+		msg.TCPSeq, msg.TCPAck = segment.Seq, segment.Ack
+	}
 }
 
 func (tS *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
@@ -166,113 +571,245 @@ func (tS *tcpStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reasse
 	if err := tS.optchecker.Accept(tcp, ci, dir, nextSeq, start); err != nil {
 		return false
 	}
+	// No SYN for this direction, rps was started after the connection
+	if nextSeq == invalidSequence && !tcp.SYN {
+		if !tS.attached {
+			log.Printf("%s: attached mid-stream", tS.ident)
+		}
+		tS.attached = true
+		*start = true
+	}
 	return true
 }
 
 func (tS *tcpStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.AssemblerContext) {
-	dir, _, _, _ := sg.Info()
+	dir, _, _, skip := sg.Info()
 	length, _ := sg.Lengths()
 
+	sgStats := sg.Stats()
+	stats.outOfOrderPackets.Add(uint64(sgStats.QueuedPackets))
+	stats.outOfOrderBytes.Add(uint64(sgStats.QueuedBytes))
+	stats.overlapPackets.Add(uint64(sgStats.OverlapPackets))
+	stats.overlapBytes.Add(uint64(sgStats.OverlapBytes))
+	if skip != 0 {
+		stats.gaps.Add(1)
+		if skip > 0 {
+			stats.missingBytes.Add(uint64(skip))
+		}
+	}
+
 	data := sg.Fetch(length)
 
 	if length > 0 {
-		if dir == reassembly.TCPDirClientToServer && !tS.reversed {
-			tS.client.bytes <- data
-		} else {
-			tS.server.bytes <- data
+		// The reassembler reuses its pages once we return
+		data = append([]byte(nil), data...)
+		chunks := splitBySegment(sg, data)
+		// Bytes were lost, or we are starting in the middle of the stream
+		chunks[0].gap = skip != 0 || (tS.attached && !tS.started[dirIndex(dir)])
+		tS.started[dirIndex(dir)] = true
+		for _, chunk := range chunks {
+			if (dir == reassembly.TCPDirClientToServer) == tS.clientIsSrc {
+				stats.bytes[dirClientToServer].Add(uint64(len(chunk.data)))
+				tS.client.bytes.Push(chunk)
+			} else {
+				stats.bytes[dirServerToClient].Add(uint64(len(chunk.data)))
+				tS.server.bytes.Push(chunk)
+			}
 		}
 	}
 }
 
+func dirIndex(dir reassembly.TCPFlowDirection) int {
+	if dir == reassembly.TCPDirClientToServer {
+		return 0
+	}
+	return 1
+}
+
+func sameSegment(a, b gopacket.CaptureInfo) bool {
+	segmentA, _ := segmentOf(a)
+	segmentB, _ := segmentOf(b)
+	return a.Timestamp.Equal(b.Timestamp) && a.Length == b.Length && segmentA == segmentB
+}
+
+// splitBySegment cuts reassembled data into chunks that each come from a
+// single captured segment. Most of the time there is only one.
+func splitBySegment(sg reassembly.ScatterGather, data []byte) []streamChunk {
+	if sg.Stats().Chunks <= 1 {
+		return []streamChunk{{data: data, ci: sg.CaptureInfo(0)}}
+	}
+	var chunks []streamChunk
+	start := 0
+	ci := sg.CaptureInfo(0)
+	for i := 1; i < len(data); i++ {
+		next := sg.CaptureInfo(i)
+		if sameSegment(next, ci) {
+			continue
+		}
+		chunks = append(chunks, streamChunk{data: data[start:i], ci: ci})
+		start, ci = i, next
+	}
+	return append(chunks, streamChunk{data: data[start:], ci: ci})
+}
+
 func (tS *tcpStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
-	close(tS.client.bytes)
-	close(tS.server.bytes)
+	stats.streams.Add(-1)
+	tS.ending = tS.factory.ending
+	tS.client.bytes.Close()
+	tS.server.bytes.Close()
 	return false
 }
 
 // Implements Interface reassembly.StreamFactory
 type tcpStreamFactory struct {
-	wg sync.WaitGroup
+	wg          sync.WaitGroup
+	readerQueue queueOptions
+	// Why the streams completed now end: endClosed while assembling, as
+	// the reassembler completes streams on FIN or RST, or the reason of
+	// the flush in progress
+	ending string
 }
 
 func (tSF *tcpStreamFactory) New(netFlow gopacket.Flow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
 	fsmOptions := reassembly.TCPSimpleFSMOptions{
-		SupportMissingEstablishment: false,
+		SupportMissingEstablishment: true,
 	}
 
+	stats.streams.Add(1)
+	stats.streamsTotal.Add(1)
+
 	stream := &tcpStream{
 		net:        netFlow,
 		transport:  tcpFlow,
 		tcpstate:   reassembly.NewTCPSimpleFSM(fsmOptions),
 		optchecker: reassembly.NewTCPOptionCheck(),
-		reversed:   tcp.SrcPort == 5555,
 		ident:      fmt.Sprintf("%s - %s", netFlow, tcpFlow),
+		factory:    tSF,
+	}
+	stream.clientIsSrc = clientIsSource(tcp, stream.ident)
+	stream.clientAddr = fmt.Sprintf("%s:%s", netFlow.Src(), tcpFlow.Src())
+	stream.serverAddr = fmt.Sprintf("%s:%s", netFlow.Dst(), tcpFlow.Dst())
+	if !stream.clientIsSrc {
+		stream.clientAddr, stream.serverAddr = stream.serverAddr, stream.clientAddr
 	}
 
-	if tcp.SrcPort == 5555 || tcp.DstPort == 5555 {
-		stream.client = dofusReader{
-			ident:    fmt.Sprintf("%s - %s", netFlow, tcpFlow),
-			bytes:    make(chan []byte),
-			isClient: true,
-			parent:   stream,
-		}
-		stream.server = dofusReader{
-			ident:    fmt.Sprintf("%s - %s", netFlow, tcpFlow),
-			bytes:    make(chan []byte),
-			isClient: false,
-			parent:   stream,
-		}
-		tSF.wg.Add(2)
-		go stream.client.Run(&tSF.wg)
-		go stream.server.Run(&tSF.wg)
+	if isGamePacket(tcp) {
+		stream.startReaders(tSF.readerQueue, &tSF.wg)
 	}
 
 	return stream
 }
 
+// Tells if the packet belongs to a connection with a game server
+func isGamePacket(tcp *layers.TCP) bool {
+	return tcp.SrcPort == gamePort || tcp.DstPort == gamePort
+}
+
+// clientIsSource tells if the sender of tcp, the first packet of a stream,
+// is the game client. The reassembler calls this sender's direction
+// TCPDirClientToServer whoever it is.
+func clientIsSource(tcp *layers.TCP, ident string) bool {
+	switch {
+	case tcp.DstPort == gamePort && tcp.SrcPort != gamePort:
+		return true
+	case tcp.SrcPort == gamePort && tcp.DstPort != gamePort:
+		return false
+	case tcp.SYN:
+		// Both ends on the game port, the SYN tells who connects
+		return !tcp.ACK
+	}
+	log.Printf("%s: cannot tell the client from the server, assuming the client sent the first packet", ident)
+	return true
+}
+
+// startReaders starts the readers decoding both directions of the stream,
+// and the merger publishing their messages. Data is then pushed to
+// tS.client.bytes and tS.server.bytes.
+func (tS *tcpStream) startReaders(readerQueue queueOptions, wg *sync.WaitGroup) {
+	tS.client = dofusReader{
+		ident:    tS.ident,
+		bytes:    newBoundedQueue[streamChunk](pipelineStage("reader"), readerQueue),
+		isClient: true,
+		parent:   tS,
+	}
+	tS.server = dofusReader{
+		ident:    tS.ident,
+		bytes:    newBoundedQueue[streamChunk](pipelineStage("reader"), readerQueue),
+		isClient: false,
+		parent:   tS,
+	}
+	tS.merger = newSessionMerger(tS.client.bytes, tS.server.bytes, bus.Publish)
+	tS.client.bytes.onIdle = tS.merger.Idle
+	tS.server.bytes.onIdle = tS.merger.Idle
+	wg.Add(2)
+	go tS.client.Run(wg)
+	go tS.server.Run(wg)
+}
+
 func (tSF *tcpStreamFactory) WaitGoRoutines() {
 	tSF.wg.Wait()
 }
 
-func handlePackets() {
+// Tells if packets are read from a file rather than captured live
+func isOfflineCapture() bool {
+	return len(pcapfiles) > 0
+}
+
+// Capture, reassemble and decode packets until the capture ends or ctx is
+// cancelled. Streams still open are flushed and their readers drained
+// before returning.
+func handlePackets(ctx context.Context) error {
 	var err error
 	log.Println("start")
 	defer log.Println("end")
-	flag.Parse()
 
-	var handle *pcap.Handle
+	var source *gopacket.PacketSource
 
-	if *pcapfile != "" {
-		handle, err = pcap.OpenOffline(*pcapfile)
+	if isOfflineCapture() {
+		files, err := openCaptureFiles(pcapfiles, *filter)
 		if err != nil {
-			log.Fatalf("could not open filename - %v - %s", *pcapfile, err)
+			return err
+		}
+		defer files.Close()
+		if len(pcapfiles) > 1 {
+			log.Printf("Reading %d files as a single capture", len(pcapfiles))
 		}
+		source = gopacket.NewPacketSource(files, files.LinkType())
 	} else {
 		if *iface == "" {
-			log.Fatal("Missing interface name")
+			return errors.New("missing interface name")
 		}
-		log.Printf("Starting capture on interface %q", *iface)
-		handle, err = pcap.OpenLive(*iface, defaultSnapLen, true, pcap.BlockForever)
+		live, err := openLiveCapture(*iface, *filter)
 		if err != nil {
-			panic(err)
-		}
-	}
-
-	defer handle.Close()
-
-	if *filter != "" {
-		if err = handle.SetBPFFilter(*filter); err != nil {
-			log.Fatalf("could not apply filter %v to capture - %s", *filter, err)
+			return err
 		}
+		defer live.Close()
+
+		stats.setCaptureSource(live.Counters)
+		// Keep the last counters around once the capture is closed
+		defer func() {
+			counters, err := live.Counters()
+			stats.setCaptureSource(func() (captureCounters, error) {
+				return counters, err
+			})
+		}()
+		source = gopacket.NewPacketSource(live, live.LinkType())
 	}
 
-	source := gopacket.NewPacketSource(handle, handle.LinkType())
 	source.Lazy = false
 	source.NoCopy = true
 	source.DecodeStreamsAsDatagrams = false // Same as default, but i put it here for potential tests
 
+	readerPolicy, err := parseQueuePolicy(*readerQueuePolicy, policyBlock, policySpill)
+	if err != nil {
+		return err
+	}
+
 	// Create StreamFactory
-	streamFactory := &tcpStreamFactory{}
+	streamFactory := &tcpStreamFactory{
+		readerQueue: queueOptions{size: *readerQueueSize, policy: readerPolicy},
+		ending:      endClosed,
+	}
 	// Create StreamPool
 	streamPool := reassembly.NewStreamPool(streamFactory)
 	// Create Assembler
@@ -282,13 +819,29 @@ func handlePackets() {
 	const timeout time.Duration = time.Minute * 1
 
 	count := 0
+	packets := source.Packets()
 
-	for packet := range source.Packets() {
+capture:
+	for {
+		var packet gopacket.Packet
+		select {
+		case <-ctx.Done():
+			log.Println("capture interrupted")
+			break capture
+		case packet = <-packets:
+		}
 
 		count++
 		//Parse Packet
 		if packet == nil {
-			return
+			break
+		}
+		stats.packets.Add(1)
+		if replay != nil {
+			if err := replay.Wait(ctx, packet.Metadata().Timestamp); err != nil {
+				log.Println("capture interrupted")
+				break capture
+			}
 		}
 		if packet.NetworkLayer() == nil || packet.TransportLayer() == nil || packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
 			continue
@@ -301,22 +854,27 @@ func handlePackets() {
 			context := Context{
 				CaptureInfo: packet.Metadata().CaptureInfo,
 			}
-			if tcp.SrcPort == 5555 || tcp.DstPort == 5555 {
+			context.CaptureInfo.AncillaryData = append(context.CaptureInfo.AncillaryData, segmentInfo{Seq: tcp.Seq, Ack: tcp.Ack, Packet: uint64(count)})
+			if isGamePacket(tcp) {
+				stats.tcpPackets.Add(1)
 				reassembler.AssembleWithContext(packet.NetworkLayer().NetworkFlow(), tcp, &context)
 			}
 		}
 
 		if count%1000 == 0 {
 			timestamp := packet.Metadata().CaptureInfo.Timestamp
+			streamFactory.ending = endIdle
 			reassembler.FlushWithOptions(reassembly.FlushOptions{T: timestamp.Add(-timeout), TC: timestamp.Add(-closeTimeout)})
+			streamFactory.ending = endClosed
 		}
 	}
 
 	log.Println("iterated all packets")
 
+	streamFactory.ending = endShutdown
 	reassembler.FlushAll()
 	log.Println("flushed all connections")
 	streamFactory.WaitGoRoutines()
 	log.Println("all go routines finished")
-
+	return nil
 }
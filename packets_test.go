@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Returns the frame of a message as the game writes it, the body is not
+// checked
+func testFrame(t *testing.T, name string, dir msgDirection, bodyLen int) []byte {
+	t.Helper()
+	id, ok := nameIdMap[name]
+	if !ok {
+		t.Fatalf("unknown message %s", name)
+	}
+	msg := dofusMsg{ProtocolId: id, Direction: dir, InstanceId: 7, MsgLen: uint32(bodyLen), body: bytes.Repeat([]byte{0x2a}, bodyLen)}
+	for n := bodyLen; n > 0; n >>= 8 {
+		msg.LenSize++
+	}
+	return msg.frame()
+}
+
+func TestPeekHeader(t *testing.T) {
+	id := nameIdMap["ChatServerMessage"]
+	tests := []struct {
+		name     string
+		data     []byte
+		offset   int
+		isClient bool
+		wantSize int
+		wantLen  uint32
+		wantErr  error
+	}{
+		{"server, short body", testFrame(t, "ChatServerMessage", dirServerToClient, 12), 0, false, 3, 12, nil},
+		{"server, empty body", testFrame(t, "ChatServerMessage", dirServerToClient, 0), 0, false, 2, 0, nil},
+		{"server, long body", testFrame(t, "ChatServerMessage", dirServerToClient, 300), 0, false, 4, 300, nil},
+		{"client", testFrame(t, "ChatServerMessage", dirClientToServer, 12), 0, true, 7, 12, nil},
+		{"at an offset", append([]byte{1, 2, 3}, testFrame(t, "ChatServerMessage", dirServerToClient, 70000)...), 3, false, 5, 70000, nil},
+		{"truncated length", testFrame(t, "ChatServerMessage", dirServerToClient, 300)[:3], 0, false, 0, 0, io.EOF},
+		{"truncated instance", testFrame(t, "ChatServerMessage", dirClientToServer, 12)[:4], 0, true, 0, 0, io.EOF},
+		{"nothing", nil, 0, false, 0, 0, io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := bufio.NewReader(bytes.NewReader(test.data))
+			var msg dofusMsg
+			size, err := msg.peekHeader(b, test.offset, test.isClient)
+			if err != test.wantErr {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if size != test.wantSize || msg.MsgLen != test.wantLen || msg.ProtocolId != id {
+				t.Errorf("header of %d bytes, message %d of %d bytes, want %d bytes, message %d of %d bytes",
+					size, msg.ProtocolId, msg.MsgLen, test.wantSize, id, test.wantLen)
+			}
+			if !msg.plausible() {
+				t.Errorf("%+v is not plausible", msg)
+			}
+			if test.isClient && msg.InstanceId != 7 {
+				t.Errorf("instance %d", msg.InstanceId)
+			}
+			if head, _ := b.Peek(test.offset + 1); !bytes.Equal(head, test.data[:test.offset+1]) {
+				t.Errorf("consumed the header")
+			}
+		})
+	}
+}
+
+func TestSyncFrames(t *testing.T) {
+	frames := func(dir msgDirection) []byte {
+		var stream []byte
+		stream = append(stream, testFrame(t, "ChatServerMessage", dir, 40)...)
+		stream = append(stream, testFrame(t, "BasicAckMessage", dir, 0)...)
+		stream = append(stream, testFrame(t, "GameContextRefreshEntityLookMessage", dir, 300)...)
+		return stream
+	}
+	// Implausible as a header wherever it is cut
+	garbage := bytes.Repeat([]byte{0xff}, 40)
+	tests := []struct {
+		name     string
+		data     []byte
+		isClient bool
+		bufSize  int
+		want     int
+		wantErr  error
+	}{
+		{"aligned", frames(dirServerToClient), false, 4096, 0, nil},
+		{"aligned client", frames(dirClientToServer), true, 4096, 0, nil},
+		{"middle of a frame", append(garbage[:5:5], frames(dirServerToClient)...), false, 4096, 5, nil},
+		{"middle of a client frame", append(garbage[:9:9], frames(dirClientToServer)...), true, 4096, 9, nil},
+		{"garbage over the buffer", append(garbage[:40:40], frames(dirServerToClient)...), false, 16, 40, nil},
+		{"garbage only", garbage, false, 4096, 0, io.EOF},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := bufio.NewReaderSize(bytes.NewReader(test.data), test.bufSize)
+			skipped, err := syncFrames(b, test.isClient)
+			if err != test.wantErr {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if skipped != test.want {
+				t.Errorf("skipped %d bytes, want %d", skipped, test.want)
+			}
+			if err != nil {
+				return
+			}
+			var msg dofusMsg
+			if _, err := msg.peekHeader(b, 0, test.isClient); err != nil || msg.ProtocolId != nameIdMap["ChatServerMessage"] {
+				t.Errorf("synchronized on message %d (%v)", msg.ProtocolId, err)
+			}
+		})
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	unknown := uint16(1)
+	for ; unknown < 1<<14; unknown++ {
+		if _, ok := idNamespaceMap[unknown]; !ok {
+			break
+		}
+	}
+	chat := nameIdMap["ChatServerMessage"]
+	// Frames with any id and length encoding, followed by a known one
+	frame := func(id uint16, lenSize uint8, bodyLen int) []byte {
+		msg := dofusMsg{ProtocolId: id, LenSize: lenSize, MsgLen: uint32(bodyLen), Direction: dirServerToClient, body: make([]byte, bodyLen)}
+		return append(msg.frame(), testFrame(t, "BasicAckMessage", dirServerToClient, 0)...)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+		wantLen int
+	}{
+		{"known", frame(chat, 1, 12), nil, 12},
+		{"unknown message", frame(unknown, 1, 12), errUnknownMessage, 12},
+		{"length on more bytes than needed", frame(chat, 3, 12), nil, 12},
+		{"empty body with a length", frame(chat, 1, 0), nil, 0},
+		{"too long", frame(chat, 3, maxMsgLen+1)[:5], errInvalidFrame, 0},
+		{"truncated body", frame(chat, 1, 12)[:10], io.ErrUnexpectedEOF, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := bufio.NewReader(bytes.NewReader(test.data))
+			msg := new(dofusMsg)
+			err := msg.decode(b, false)
+			if err != test.wantErr {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if err != nil && err != errUnknownMessage {
+				return
+			}
+			if len(msg.body) != test.wantLen {
+				t.Errorf("body of %d bytes, want %d", len(msg.body), test.wantLen)
+			}
+			// The frame is consumed whole, in sync with the next one
+			next := new(dofusMsg)
+			if err := next.decode(b, false); err != nil || next.ProtocolId != nameIdMap["BasicAckMessage"] {
+				t.Errorf("next frame is message %d (%v)", next.ProtocolId, err)
+			}
+		})
+	}
+}
+
+// testSegment is a TCP segment of a test capture
+type testSegment struct {
+	at       time.Duration // Since testEpoch
+	src, dst string        // ip:port
+	seq      uint32
+	syn, ack bool
+	payload  []byte
+}
+
+// Writes segments to a pcap file at path, over Ethernet
+func writeTestCapture(t *testing.T, path string, segments []testSegment) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	writer := pcapgo.NewWriter(file)
+	if err := writer.WriteFileHeader(65536, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	endpoint := func(address string) (net.IP, uint16) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return net.ParseIP(host).To4(), uint16(number)
+	}
+	for _, segment := range segments {
+		srcIP, srcPort := endpoint(segment.src)
+		dstIP, dstPort := endpoint(segment.dst)
+		eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: srcIP, DstIP: dstIP}
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(srcPort), DstPort: layers.TCPPort(dstPort), Seq: segment.seq, Ack: 1,
+			SYN: segment.syn, ACK: segment.ack, PSH: len(segment.payload) > 0, Window: 65535}
+		tcp.SetNetworkLayerForChecksum(ip)
+		buffer := gopacket.NewSerializeBuffer()
+		options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		if err := gopacket.SerializeLayers(buffer, options, eth, ip, tcp, gopacket.Payload(segment.payload)); err != nil {
+			t.Fatal(err)
+		}
+		data := buffer.Bytes()
+		ci := gopacket.CaptureInfo{Timestamp: testEpoch.Add(segment.at), CaptureLength: len(data), Length: len(data)}
+		if err := writer.WritePacket(ci, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A connection picked up without its SYN is told apart by the game port,
+// whichever side speaks first
+func TestMidConnection(t *testing.T) {
+	const client, server = "192.168.1.5:50000", "172.65.0.1:5555"
+	frames := func(dir msgDirection, name string) []byte {
+		return append(testFrame(t, name, dir, 12), testFrame(t, name, dir, 30)...)
+	}
+	fromServer := func(at time.Duration, seq uint32) testSegment {
+		return testSegment{at: at, src: server, dst: client, seq: seq, ack: true, payload: frames(dirServerToClient, "ChatServerMessage")}
+	}
+	fromClient := func(at time.Duration, seq uint32) testSegment {
+		return testSegment{at: at, src: client, dst: server, seq: seq, ack: true, payload: frames(dirClientToServer, "ChatClientMultiMessage")}
+	}
+	serverLen, clientLen := uint32(len(fromServer(0, 0).payload)), uint32(len(fromClient(0, 0).payload))
+	tests := []struct {
+		name     string
+		segments []testSegment
+	}{
+		{"server first", []testSegment{fromServer(0, 1000), fromClient(time.Second, 5000), fromServer(2*time.Second, 1000+serverLen)}},
+		{"client first", []testSegment{fromClient(0, 5000), fromServer(time.Second, 1000), fromClient(2*time.Second, 5000+clientLen)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "capture.pcap")
+			writeTestCapture(t, path, test.segments)
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			messages, err := decodeCapture(ctx, []string{path}, "tcp port 5555")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[msgDirection]string{dirClientToServer: "ChatClientMultiMessage", dirServerToClient: "ChatServerMessage"}
+			count := make(map[msgDirection]int)
+			for _, msg := range messages {
+				if msg.Closed {
+					continue
+				}
+				count[msg.Direction]++
+				if msg.Name() != want[msg.Direction] || msg.Client != client || msg.Server != server || !msg.Attached {
+					t.Errorf("%s message %s from %s to %s, attached %v", msg.Direction, msg.Name(), msg.Client, msg.Server, msg.Attached)
+				}
+			}
+			wantCount := make(map[msgDirection]int)
+			for _, segment := range test.segments {
+				if segment.src == client {
+					wantCount[dirClientToServer] += 2
+				} else {
+					wantCount[dirServerToClient] += 2
+				}
+			}
+			if !reflect.DeepEqual(count, wantCount) {
+				t.Errorf("messages by direction %v, want %v", count, wantCount)
+			}
+		})
+	}
+}
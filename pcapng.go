@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// pcapng block types and options used by pcapngWriter
+const (
+	pcapngSectionHeader    = 0x0A0D0D0A
+	pcapngInterface        = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1A2B3C4D
+	pcapngOptEnd           = 0
+	pcapngOptComment       = 1
+	pcapngOptUserAppl      = 4
+	pcapngOptTimestampUnit = 9
+)
+
+// pcapngWriter writes a single interface pcapng file whose packets can be
+// annotated with comments, which pcapgo's NgWriter does not support.
+// Timestamps are written in nanoseconds.
+type pcapngWriter struct {
+	w *bufio.Writer
+}
+
+func newPcapngWriter(w io.Writer, linkType layers.LinkType, snapLen int) (*pcapngWriter, error) {
+	pW := &pcapngWriter{w: bufio.NewWriter(w)}
+
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)                  // Major version
+	shb = binary.LittleEndian.AppendUint16(shb, 0)                  // Minor version
+	shb = binary.LittleEndian.AppendUint64(shb, 0xFFFFFFFFFFFFFFFF) // Unknown section length
+	shb = appendPcapngOption(shb, pcapngOptUserAppl, []byte("rps"))
+	shb = appendPcapngOption(shb, pcapngOptEnd, nil)
+	if err := pW.writeBlock(pcapngSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, uint16(linkType))
+	idb = binary.LittleEndian.AppendUint16(idb, 0) // Reserved
+	idb = binary.LittleEndian.AppendUint32(idb, uint32(snapLen))
+	idb = appendPcapngOption(idb, pcapngOptTimestampUnit, []byte{9})
+	idb = appendPcapngOption(idb, pcapngOptEnd, nil)
+	if err := pW.writeBlock(pcapngInterface, idb); err != nil {
+		return nil, err
+	}
+	return pW, nil
+}
+
+// WritePacket writes a packet, with a comment if not empty
+func (pW *pcapngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, comment string) error {
+	timestamp := uint64(ci.Timestamp.UnixNano())
+	length := ci.Length
+	if length < len(data) {
+		length = len(data)
+	}
+
+	var epb []byte
+	epb = binary.LittleEndian.AppendUint32(epb, 0) // Interface id
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(timestamp))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(length))
+	epb = append(epb, data...)
+	epb = append(epb, make([]byte, pcapngPadding(len(data)))...)
+	if comment != "" {
+		epb = appendPcapngOption(epb, pcapngOptComment, []byte(comment))
+		epb = appendPcapngOption(epb, pcapngOptEnd, nil)
+	}
+	return pW.writeBlock(pcapngEnhancedPacket, epb)
+}
+
+func (pW *pcapngWriter) Flush() error {
+	return pW.w.Flush()
+}
+
+// Writes a block: type, total length, body and total length again
+func (pW *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	var header [8]byte
+	length := uint32(12 + len(body))
+	binary.LittleEndian.PutUint32(header[0:4], blockType)
+	binary.LittleEndian.PutUint32(header[4:8], length)
+	if _, err := pW.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := pW.w.Write(body); err != nil {
+		return err
+	}
+	_, err := pW.w.Write(header[4:8])
+	return err
+}
+
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pcapngPadding(len(value)))...)
+}
+
+// Bytes needed to align a field of the given length on 32 bits
+func pcapngPadding(length int) int {
+	return (4 - length%4) % 4
+}
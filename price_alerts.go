@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+)
+
+// priceAlertRule notifies when the cheapest offer of an item crosses a
+// price, e.g. {"gid": 421, "lot": 100, "below": 5000}
+type priceAlertRule struct {
+	Name   string `json:"name"`   // Title of the notifications, generated if empty
+	Server string `json:"server"` // Game server id, any if empty
+	GID    uint64 `json:"gid"`
+	Lot    uint64 `json:"lot"`   // Lot size, 1 if not set
+	Below  uint64 `json:"below"` // Notify when the cheapest offer drops below
+	Above  uint64 `json:"above"` // or rises above this price
+}
+
+func (par *priceAlertRule) title() string {
+	if par.Name != "" {
+		return par.Name
+	}
+	if par.Below > 0 {
+		return fmt.Sprintf("Item %d x%d below %d", par.GID, par.Lot, par.Below)
+	}
+	return fmt.Sprintf("Item %d x%d above %d", par.GID, par.Lot, par.Above)
+}
+
+// ownListing is an item we put on sale in a bid house
+type ownListing struct {
+	character string
+	gid       uint64
+	quantity  uint64
+	price     uint64
+}
+
+// priceAlerts evaluates the alert rules and looks for undercuts of our own
+// listings as prices are observed. Notifications are sent when a condition
+// starts to hold, not again until it stops holding.
+type priceAlerts struct {
+	rules     []priceAlertRule
+	undercut  bool
+	notifiers *notifierSet
+	triggered map[string]bool
+	listings  map[string]map[uint64]ownListing // By server, then object UID
+}
+
+func newPriceAlerts(rules []priceAlertRule, undercut bool, notifiers *notifierSet) (*priceAlerts, error) {
+	for i := range rules {
+		rule := &rules[i]
+		if rule.GID == 0 || (rule.Below == 0) == (rule.Above == 0) {
+			return nil, fmt.Errorf("alert %d: needs a gid and one of below or above", i+1)
+		}
+		if rule.Lot == 0 {
+			rule.Lot = 1
+		}
+	}
+	return &priceAlerts{
+		rules:     rules,
+		undercut:  undercut,
+		notifiers: notifiers,
+		triggered: make(map[string]bool),
+		listings:  make(map[string]map[uint64]ownListing),
+	}, nil
+}
+
+// Sends n when the condition named key starts to hold
+func (pa *priceAlerts) trigger(key string, holds bool, n func() notification) {
+	if holds && !pa.triggered[key] {
+		pa.notifiers.Notify(n())
+	}
+	pa.triggered[key] = holds
+}
+
+// check evaluates the rules and our listings against the cheapest offer of
+// a lot
+func (pa *priceAlerts) check(server string, gid uint64, lot uint64, point pricePoint) {
+	for i := range pa.rules {
+		rule := &pa.rules[i]
+		if rule.GID != gid || rule.Lot != lot || (rule.Server != "" && rule.Server != server) {
+			continue
+		}
+		holds := (rule.Below > 0 && point.Price < rule.Below) || (rule.Above > 0 && point.Price > rule.Above)
+		pa.trigger(fmt.Sprintf("rule/%d/%s", i, server), holds, func() notification {
+			return notification{
+				Time:    point.Time,
+				Kind:    "price",
+				Title:   rule.title(),
+				Message: fmt.Sprintf("the cheapest x%d of item %d on server %s is %d kamas", lot, gid, server, point.Price),
+				Fields:  map[string]interface{}{"server": server, "gid": gid, "lot": lot, "price": point.Price},
+			}
+		})
+	}
+
+	if !pa.undercut {
+		return
+	}
+	for uid, listing := range pa.listings[server] {
+		if listing.gid != gid || listing.quantity != lot {
+			continue
+		}
+		pa.trigger(fmt.Sprintf("undercut/%s/%d", server, uid), point.Price < listing.price, func() notification {
+			return notification{
+				Time:  point.Time,
+				Kind:  "undercut",
+				Title: fmt.Sprintf("Item %d x%d undercut", gid, lot),
+				Message: fmt.Sprintf("our listing at %d kamas on server %s is no longer the cheapest, %d now",
+					listing.price, server, point.Price),
+				Fields: map[string]interface{}{
+					"server": server, "gid": gid, "lot": lot, "price": point.Price,
+					"character": listing.character, "ourPrice": listing.price,
+				},
+			}
+		})
+	}
+}
+
+// Follows our listings from the messages of the bid houses in sell mode
+func (pa *priceAlerts) observeSeller(name string, fields gjson.Result, server string, character string) {
+	listings, ok := pa.listings[server]
+	if !ok {
+		listings = make(map[uint64]ownListing)
+		pa.listings[server] = listings
+	}
+	add := func(item gjson.Result) {
+		listings[item.Get("objectUID").Uint()] = ownListing{
+			character: character,
+			gid:       item.Get("objectGID").Uint(),
+			quantity:  item.Get("quantity").Uint(),
+			price:     item.Get("objectPrice").Uint(),
+		}
+	}
+
+	switch name {
+	case "ExchangeStartedBidSellerMessage":
+		// Everything the character has on sale in this bid house. Items
+		// sold are not told, so the listings of the other bid houses are
+		// forgotten until they are opened again.
+		for uid, listing := range listings {
+			if listing.character == character {
+				delete(listings, uid)
+			}
+		}
+		for _, item := range fields.Get("objectsInfos").Array() {
+			add(item)
+		}
+	case "ExchangeBidHouseItemAddOkMessage":
+		add(fields.Get("itemInfo"))
+	case "ExchangeBidHouseItemRemoveOkMessage":
+		// sellerId is the UID of the item withdrawn
+		uid := fields.Get("sellerId").Uint()
+		delete(listings, uid)
+		delete(pa.triggered, fmt.Sprintf("undercut/%s/%d", server, uid))
+	}
+}
+
+func (pa *priceAlerts) Close() {
+	pa.notifiers.Close()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// recordingNotifier keeps the notifications it is given
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []notification
+}
+
+func (rn *recordingNotifier) Notify(ctx context.Context, n notification) error {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.sent = append(rn.sent, n)
+	return nil
+}
+
+func newRecordingSet(recorder *recordingNotifier) *notifierSet {
+	ns := &notifierSet{
+		notifiers: []notifier{recorder},
+		logger:    log.New(io.Discard, "", 0),
+		queue:     make(chan notification, notificationQueueSize),
+		done:      make(chan struct{}),
+	}
+	go ns.deliver()
+	return ns
+}
+
+// observedPrice is the cheapest offer of a lot seen at some point
+type observedPrice struct {
+	server string
+	gid    uint64
+	lot    uint64
+	price  uint64
+}
+
+func TestPriceAlertRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []priceAlertRule
+		history []observedPrice
+		want    []uint64 // Prices notified
+	}{
+		{
+			name:  "below, once per crossing",
+			rules: []priceAlertRule{{GID: 421, Below: 100}},
+			history: []observedPrice{
+				{"291", 421, 1, 150}, {"291", 421, 1, 90}, {"291", 421, 1, 80},
+				{"291", 421, 1, 120}, {"291", 421, 1, 95},
+			},
+			want: []uint64{90, 95},
+		},
+		{
+			name:  "above, other lots and items ignored",
+			rules: []priceAlertRule{{GID: 421, Lot: 10, Above: 2000}},
+			history: []observedPrice{
+				{"291", 421, 1, 2500}, {"291", 422, 10, 2500}, {"291", 421, 10, 1500},
+				{"291", 421, 10, 2100}, {"291", 421, 10, 2200},
+			},
+			want: []uint64{2100},
+		},
+		{
+			name:  "server restricted",
+			rules: []priceAlertRule{{Server: "291", GID: 421, Below: 100}},
+			history: []observedPrice{
+				{"292", 421, 1, 50}, {"291", 421, 1, 60},
+			},
+			want: []uint64{60},
+		},
+		{
+			name:  "servers tracked apart",
+			rules: []priceAlertRule{{GID: 421, Below: 100}},
+			history: []observedPrice{
+				{"291", 421, 1, 50}, {"292", 421, 1, 60}, {"291", 421, 1, 40},
+			},
+			want: []uint64{50, 60},
+		},
+		{
+			name:    "price on the threshold",
+			rules:   []priceAlertRule{{GID: 421, Below: 100}},
+			history: []observedPrice{{"291", 421, 1, 100}},
+		},
+	}
+
+	base := time.Date(2024, 4, 7, 16, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := new(recordingNotifier)
+			alerts, err := newPriceAlerts(tt.rules, false, newRecordingSet(recorder))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, p := range tt.history {
+				alerts.check(p.server, p.gid, p.lot, pricePoint{base.Add(time.Duration(i) * time.Minute), p.price})
+			}
+			alerts.Close()
+
+			checkNotified(t, recorder.sent, "price", tt.want)
+		})
+	}
+}
+
+func TestPriceAlertUndercut(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []string // Seller messages observed before the history
+		history  []observedPrice
+		want     []uint64
+	}{
+		{
+			name:     "listing added",
+			messages: []string{`ExchangeBidHouseItemAddOkMessage {"itemInfo": {"objectUID": 7, "objectGID": 421, "quantity": 10, "objectPrice": 500}}`},
+			history: []observedPrice{
+				{"291", 421, 10, 600}, {"291", 421, 10, 450}, {"291", 421, 10, 400},
+				{"291", 421, 10, 550}, {"291", 421, 10, 480}, {"291", 421, 1, 10},
+			},
+			want: []uint64{450, 480},
+		},
+		{
+			name: "listings of the bid house",
+			messages: []string{`ExchangeStartedBidSellerMessage {"objectsInfos": [
+				{"objectUID": 7, "objectGID": 421, "quantity": 10, "objectPrice": 500},
+				{"objectUID": 8, "objectGID": 422, "quantity": 1, "objectPrice": 90}]}`},
+			history: []observedPrice{{"291", 421, 10, 499}, {"291", 422, 1, 80}, {"292", 422, 1, 10}},
+			want:    []uint64{499, 80},
+		},
+		{
+			name: "listing withdrawn",
+			messages: []string{
+				`ExchangeBidHouseItemAddOkMessage {"itemInfo": {"objectUID": 7, "objectGID": 421, "quantity": 10, "objectPrice": 500}}`,
+				`ExchangeBidHouseItemRemoveOkMessage {"sellerId": 7}`,
+			},
+			history: []observedPrice{{"291", 421, 10, 450}},
+		},
+	}
+
+	base := time.Date(2024, 4, 7, 16, 0, 0, 0, time.UTC)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := new(recordingNotifier)
+			alerts, err := newPriceAlerts(nil, true, newRecordingSet(recorder))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, message := range tt.messages {
+				name, fields, _ := strings.Cut(message, " ")
+				alerts.observeSeller(name, gjson.Parse(fields), "291", "Yokoo")
+			}
+			for i, p := range tt.history {
+				alerts.check(p.server, p.gid, p.lot, pricePoint{base.Add(time.Duration(i) * time.Minute), p.price})
+			}
+			alerts.Close()
+
+			checkNotified(t, recorder.sent, "undercut", tt.want)
+		})
+	}
+}
+
+func TestPriceAlertRuleValidation(t *testing.T) {
+	tests := []struct {
+		rule    priceAlertRule
+		wantErr bool
+	}{
+		{rule: priceAlertRule{GID: 421, Below: 100}},
+		{rule: priceAlertRule{GID: 421, Above: 100}},
+		{rule: priceAlertRule{GID: 421}, wantErr: true},
+		{rule: priceAlertRule{GID: 421, Below: 100, Above: 200}, wantErr: true},
+		{rule: priceAlertRule{Below: 100}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if _, err := newPriceAlerts([]priceAlertRule{tt.rule}, false, nil); (err != nil) != tt.wantErr {
+			t.Errorf("newPriceAlerts(%+v) error = %v, want error %v", tt.rule, err, tt.wantErr)
+		}
+	}
+}
+
+func checkNotified(t *testing.T, sent []notification, kind string, want []uint64) {
+	t.Helper()
+	if len(sent) != len(want) {
+		t.Fatalf("got %d notifications %v, want prices %v", len(sent), sent, want)
+	}
+	for i, n := range sent {
+		if n.Kind != kind || n.Fields["price"] != want[i] {
+			t.Errorf("notification %d: %s at %v, want %s at %d", i, n.Kind, n.Fields["price"], kind, want[i])
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerModule("prices", func() Module { return new(pricesModule) })
+}
+
+// Default file of the price history, relative to the working directory
+const defaultPricesPath = "rps-prices.json"
+
+// How often the price history is saved while prices are observed
+const pricesSaveInterval = time.Minute
+
+// Lot sizes of the bid houses, until one tells otherwise
+var defaultLotSizes = []uint64{1, 10, 100, 1000}
+
+type pricePoint struct {
+	Time  time.Time `json:"time"`
+	Price uint64    `json:"price"`
+}
+
+// priceSeries is the last price observed and the history of its changes
+type priceSeries struct {
+	Last    pricePoint   `json:"last"`
+	History []pricePoint `json:"history"`
+}
+
+func (ps *priceSeries) add(point pricePoint, maxHistory int) {
+	ps.Last = point
+	if n := len(ps.History); n > 0 && ps.History[n-1].Price == point.Price {
+		return
+	}
+	ps.History = append(ps.History, point)
+	if maxHistory > 0 && len(ps.History) > maxHistory {
+		ps.History = ps.History[len(ps.History)-maxHistory:]
+	}
+}
+
+// itemPrices are the prices of an item on a game server
+type itemPrices struct {
+	Server  string                  `json:"server"`
+	GID     uint64                  `json:"gid"`
+	Lowest  map[uint64]*priceSeries `json:"lowest"`            // Cheapest offer, by lot size, 0 once none is left
+	Average *priceSeries            `json:"average,omitempty"` // Average unit price given by the bid house
+}
+
+type priceKey struct {
+	server string
+	gid    uint64
+}
+
+// priceBook holds the prices observed, by server and item
+type priceBook struct {
+	mu         sync.Mutex
+	items      map[priceKey]*itemPrices
+	maxHistory int // Points kept per series, 0 for all
+}
+
+// Loads the price book saved at path, empty if there is none yet
+func loadPriceBook(path string, maxHistory int) (*priceBook, error) {
+	pb := &priceBook{items: make(map[priceKey]*itemPrices), maxHistory: maxHistory}
+	bytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pb, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []*itemPrices
+	if err = json.Unmarshal(bytes, &items); err != nil {
+		return nil, fmt.Errorf("could not read prices from %s - %w", path, err)
+	}
+	for _, item := range items {
+		if item.Lowest == nil {
+			item.Lowest = make(map[uint64]*priceSeries)
+		}
+		pb.items[priceKey{item.Server, item.GID}] = item
+	}
+	return pb, nil
+}
+
+// Save writes the price book to path, through a temporary file so that a
+// crash does not lose the history
+func (pb *priceBook) Save(path string) error {
+	pb.mu.Lock()
+	bytes, err := json.MarshalIndent(pb.sorted(), "", "  ")
+	pb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path+".tmp", bytes, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Returns the items by server and GID, the lock must be held
+func (pb *priceBook) sorted() []*itemPrices {
+	items := make([]*itemPrices, 0, len(pb.items))
+	for _, item := range pb.items {
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Server != items[j].Server {
+			return items[i].Server < items[j].Server
+		}
+		return items[i].GID < items[j].GID
+	})
+	return items
+}
+
+// Returns the prices of an item, created if needed. The lock must be held.
+func (pb *priceBook) item(server string, gid uint64) *itemPrices {
+	key := priceKey{server, gid}
+	item, ok := pb.items[key]
+	if !ok {
+		item = &itemPrices{Server: server, GID: gid, Lowest: make(map[uint64]*priceSeries)}
+		pb.items[key] = item
+	}
+	return item
+}
+
+func (pb *priceBook) observeLowest(server string, gid uint64, lot uint64, point pricePoint) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	item := pb.item(server, gid)
+	series, ok := item.Lowest[lot]
+	if !ok {
+		series = new(priceSeries)
+		item.Lowest[lot] = series
+	}
+	series.add(point, pb.maxHistory)
+}
+
+// Records that there is no offer left for the lot, when one was seen.
+// Returns whether the series changed.
+func (pb *priceBook) clearLowest(server string, gid uint64, lot uint64, at time.Time) bool {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	item, ok := pb.items[priceKey{server, gid}]
+	if !ok {
+		return false
+	}
+	series, ok := item.Lowest[lot]
+	if !ok || series.Last.Price == 0 {
+		return false
+	}
+	series.add(pricePoint{at, 0}, pb.maxHistory)
+	return true
+}
+
+func (pb *priceBook) observeAverage(server string, gid uint64, point pricePoint) {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	item := pb.item(server, gid)
+	if item.Average == nil {
+		item.Average = new(priceSeries)
+	}
+	item.Average.add(point, pb.maxHistory)
+}
+
+// bidHouseListing is the item browsed in a bid house by a session: its
+// offers by UID, each with a price per lot size, 0 when there is no lot
+type bidHouseListing struct {
+	gid    uint64
+	offers map[int64][]uint64
+}
+
+// Returns the cheapest offer of each lot, 0 when there is none
+func (bl *bidHouseListing) lowest(lots int) []uint64 {
+	lowest := make([]uint64, lots)
+	for _, prices := range bl.offers {
+		for i, price := range prices {
+			if i < lots && price > 0 && (lowest[i] == 0 || price < lowest[i]) {
+				lowest[i] = price
+			}
+		}
+	}
+	return lowest
+}
+
+func jsonUints(result gjson.Result) []uint64 {
+	var values []uint64
+	for _, value := range result.Array() {
+		values = append(values, value.Uint())
+	}
+	return values
+}
+
+type pricesOptions struct {
+	Path       string           `json:"path"`
+	MaxHistory int              `json:"maxHistory"` // Price changes kept per item and lot, 0 for all
+	Alerts     []priceAlertRule `json:"alerts"`
+	Undercut   bool             `json:"undercut"` // Notify when one of our listings is no longer the cheapest
+	Notify     []notifierConfig `json:"notify"`
+}
+
+// pricesModule builds a price history of the bid houses from what is
+// browsed in game: the cheapest offer of each item by lot size, and the
+// average price the game gives when selling, by game server. It notifies
+// price alerts and undercuts, e.g. with the options
+//
+//	{"alerts": [{"gid": 421, "lot": 100, "below": 5000}], "undercut": true,
+//	 "notify": [{"type": "log"}, {"type": "webhook", "url": "http://127.0.0.1:8099/"}]}
+type pricesModule struct {
+	baseModule
+	options    pricesOptions
+	book       *priceBook
+	alerts     *priceAlerts
+	servers    *gameServerTracker
+	characters *characterTracker
+
+	lots     map[string][]uint64 // Lot sizes of the bid house opened, by session
+	listings map[string]*bidHouseListing
+	dirty    bool
+	saved    time.Time
+}
+
+func (pm *pricesModule) Name() string {
+	return "prices"
+}
+
+func (pm *pricesModule) Subscriptions() []messageFilter {
+	return []messageFilter{byName(
+		"ServerSelectionMessage", "SelectedServerDataMessage", "CharacterSelectedSuccessMessage",
+		"ExchangeStartedBidBuyerMessage", "ExchangeLeaveMessage",
+		"ExchangeStartedBidSellerMessage", "ExchangeBidHouseItemAddOkMessage", "ExchangeBidHouseItemRemoveOkMessage",
+		"ExchangeTypesItemsExchangerDescriptionForUserMessage",
+		"ExchangeBidHouseInListAddedMessage", "ExchangeBidHouseInListUpdatedMessage", "ExchangeBidHouseInListRemovedMessage",
+		"ExchangeBidPriceMessage", "ExchangeBidPriceForSellerMessage",
+	)}
+}
+
+// What is known of a session, its bid house included, is forgotten at its
+// end
+func (pm *pricesModule) subscribeSessionEnds() {}
+
+func (pm *pricesModule) Start(ctx context.Context, env *moduleEnv) error {
+	pm.options = pricesOptions{Path: defaultPricesPath, MaxHistory: 1000}
+	if err := env.decodeOptions(&pm.options); err != nil {
+		return err
+	}
+	book, err := loadPriceBook(pm.options.Path, pm.options.MaxHistory)
+	if err != nil {
+		return err
+	}
+	env.Log.Printf("%d items in %s", len(book.items), pm.options.Path)
+	notifiers, err := newNotifierSet(pm.options.Notify, env.Log)
+	if err != nil {
+		return err
+	}
+	alerts, err := newPriceAlerts(pm.options.Alerts, pm.options.Undercut, notifiers)
+	if err != nil {
+		notifiers.Close()
+		return err
+	}
+
+	pm.book = book
+	pm.alerts = alerts
+	pm.servers = newGameServerTracker()
+	pm.characters = newCharacterTracker()
+	pm.lots = make(map[string][]uint64)
+	pm.listings = make(map[string]*bidHouseListing)
+	pm.saved = time.Now()
+	pm.run(env, pm.observe)
+	return nil
+}
+
+func (pm *pricesModule) Stop() error {
+	pm.baseModule.Stop()
+	pm.alerts.Close()
+	if !pm.dirty {
+		return nil
+	}
+	return pm.book.Save(pm.options.Path)
+}
+
+func (pm *pricesModule) observe(msg dofusMsg) {
+	if msg.Closed {
+		delete(pm.lots, msg.Session())
+		delete(pm.listings, msg.Session())
+		pm.servers.Forget(msg.Session())
+		pm.characters.Forget(msg.Session())
+		return
+	}
+	server := pm.servers.Observe(&msg)
+	if server == "" {
+		server = "unknown"
+	}
+	character := pm.characters.Observe(&msg)
+	session := msg.Session()
+	body, err := msg.JSON()
+	if err != nil {
+		return
+	}
+	fields := gjson.ParseBytes(body)
+
+	switch msg.Name() {
+	case "ExchangeStartedBidBuyerMessage":
+		pm.lots[session] = jsonUints(fields.Get("buyerDescriptor.quantities"))
+		return
+	case "ExchangeLeaveMessage":
+		delete(pm.lots, session)
+		delete(pm.listings, session)
+		return
+	case "ExchangeStartedBidSellerMessage", "ExchangeBidHouseItemAddOkMessage", "ExchangeBidHouseItemRemoveOkMessage":
+		pm.alerts.observeSeller(msg.Name(), fields, server, character)
+		return
+	case "ExchangeTypesItemsExchangerDescriptionForUserMessage":
+		listing := &bidHouseListing{gid: fields.Get("objectGID").Uint(), offers: make(map[int64][]uint64)}
+		for _, offer := range fields.Get("itemTypeDescriptions").Array() {
+			listing.offers[offer.Get("objectUID").Int()] = jsonUints(offer.Get("prices"))
+		}
+		pm.listings[session] = listing
+		pm.recordListing(server, session, msg.Timestamp)
+	case "ExchangeBidHouseInListAddedMessage", "ExchangeBidHouseInListUpdatedMessage", "ExchangeBidHouseInListRemovedMessage":
+		listing, ok := pm.listings[session]
+		if !ok || listing.gid != fields.Get("objectGID").Uint() {
+			return
+		}
+		if msg.Name() == "ExchangeBidHouseInListRemovedMessage" {
+			delete(listing.offers, fields.Get("itemUID").Int())
+		} else {
+			listing.offers[fields.Get("itemUID").Int()] = jsonUints(fields.Get("prices"))
+		}
+		pm.recordListing(server, session, msg.Timestamp)
+	case "ExchangeBidPriceMessage", "ExchangeBidPriceForSellerMessage":
+		gid := fields.Get("genericId").Uint()
+		if average := fields.Get("averagePrice").Uint(); average > 0 {
+			pm.book.observeAverage(server, gid, pricePoint{msg.Timestamp, average})
+			pm.dirty = true
+		}
+		lots := pm.lotSizes(session)
+		for i, price := range jsonUints(fields.Get("minimalPrices")) {
+			if i >= len(lots) {
+				break
+			}
+			if price > 0 {
+				pm.observeLowest(server, gid, lots[i], pricePoint{msg.Timestamp, price})
+			} else {
+				pm.clearLowest(server, gid, lots[i], msg.Timestamp)
+			}
+		}
+	default:
+		return
+	}
+
+	if pm.dirty && time.Since(pm.saved) > pricesSaveInterval {
+		if err := pm.book.Save(pm.options.Path); err != nil {
+			pm.env.Log.Printf("could not save prices - %s", err)
+		} else {
+			pm.dirty = false
+		}
+		pm.saved = time.Now()
+	}
+}
+
+func (pm *pricesModule) lotSizes(session string) []uint64 {
+	if lots, ok := pm.lots[session]; ok && len(lots) > 0 {
+		return lots
+	}
+	return defaultLotSizes
+}
+
+func (pm *pricesModule) observeLowest(server string, gid uint64, lot uint64, point pricePoint) {
+	pm.book.observeLowest(server, gid, lot, point)
+	pm.alerts.check(server, gid, lot, point)
+	pm.dirty = true
+}
+
+// Records that the lot is no longer on sale, alerts are not told
+func (pm *pricesModule) clearLowest(server string, gid uint64, lot uint64, at time.Time) {
+	if pm.book.clearLowest(server, gid, lot, at) {
+		pm.dirty = true
+	}
+}
+
+// Records the cheapest offers of the listing browsed by session
+func (pm *pricesModule) recordListing(server string, session string, timestamp time.Time) {
+	listing := pm.listings[session]
+	lots := pm.lotSizes(session)
+	var summary []string
+	for i, price := range listing.lowest(len(lots)) {
+		if price == 0 {
+			pm.clearLowest(server, listing.gid, lots[i], timestamp)
+			continue
+		}
+		pm.observeLowest(server, listing.gid, lots[i], pricePoint{timestamp, price})
+		summary = append(summary, fmt.Sprintf("x%d %d", lots[i], price))
+	}
+	if len(summary) > 0 {
+		pm.env.Log.Printf("server %s item %d: %s", server, listing.gid, strings.Join(summary, ", "))
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPricesLowest(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	// Opens a bid house selling lots of 1, 10 and 100
+	buyerOpened := testMessage(t, "ExchangeStartedBidBuyerMessage", dirServerToClient, game, 1,
+		new(bodyEncoder).short(3).varint(1).varint(10).varint(100).short(1).varint(48).float(2).float(0).
+			byte(200).varint(100).int(-1).varint(672))
+	offer := func(e *bodyEncoder, prices ...uint64) *bodyEncoder {
+		e.short(0).short(int16(len(prices)))
+		for _, price := range prices {
+			e.varint(price)
+		}
+		return e
+	}
+	listing := new(bodyEncoder).varint(421).int(48).short(2)
+	offer(listing.varint(1).varint(421).int(48), 100, 900, 0)
+	offer(listing.varint(2).varint(421).int(48), 120, 0, 8000)
+	inList := func(name string, second int, uid int32, prices ...uint64) dofusMsg {
+		return testMessage(t, name, dirServerToClient, game, second, offer(new(bodyEncoder).int(uid).varint(421).int(48), prices...))
+	}
+	leave := testMessage(t, "ExchangeLeaveMessage", dirServerToClient, game, 7, new(bodyEncoder).byte(11).boolean(true))
+	// Told when selling, by the lot sizes of the last bid house opened
+	sellerPrices := func(second int, gid uint64, prices ...uint64) dofusMsg {
+		e := new(bodyEncoder).varint(gid).varint(500).boolean(false).short(int16(len(prices)))
+		for _, price := range prices {
+			e.varint(price)
+		}
+		return testMessage(t, "ExchangeBidPriceForSellerMessage", dirServerToClient, game, second, e)
+	}
+
+	path := filepath.Join(t.TempDir(), "prices.json")
+	runModule(t, new(pricesModule), `{"path": "`+path+`"}`, []dofusMsg{
+		testMessage(t, "ServerSelectionMessage", dirClientToServer, game, 0, new(bodyEncoder).varint(291)),
+		buyerOpened,
+		testMessage(t, "ExchangeTypesItemsExchangerDescriptionForUserMessage", dirServerToClient, game, 2, listing),
+		inList("ExchangeBidHouseInListUpdatedMessage", 3, 2, 90, 0, 8000),
+		inList("ExchangeBidHouseInListAddedMessage", 4, 3, 0, 850, 0),
+		// The last lot of 100 is sold
+		testMessage(t, "ExchangeBidHouseInListRemovedMessage", dirServerToClient, game, 5, new(bodyEncoder).int(2).varint(421).int(48)),
+		leave,
+		// The lot sizes are forgotten with the bid house
+		sellerPrices(8, 422, 50, 450, 0, 30000),
+		buyerOpened,
+		sellerPrices(9, 421, 110, 0),
+	})
+
+	book, err := loadPriceBook(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		gid  uint64
+		lot  uint64
+		want []uint64 // History of the lowest price
+	}{
+		{421, 1, []uint64{100, 90, 100, 110}},
+		{421, 10, []uint64{900, 850, 0}},
+		{421, 100, []uint64{8000, 0}},
+		{422, 1, []uint64{50}},
+		{422, 10, []uint64{450}},
+		{422, 100, nil},
+		{422, 1000, []uint64{30000}},
+	}
+	for _, test := range tests {
+		item, ok := book.items[priceKey{"291", test.gid}]
+		if !ok {
+			t.Fatalf("no prices of item %d", test.gid)
+		}
+		var got []uint64
+		if series, ok := item.Lowest[test.lot]; ok {
+			for _, point := range series.History {
+				got = append(got, point.Price)
+			}
+			if series.Last.Price != got[len(got)-1] {
+				t.Errorf("item %d x%d: last price %d", test.gid, test.lot, series.Last.Price)
+			}
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("item %d x%d: lowest prices %v, want %v", test.gid, test.lot, got, test.want)
+		}
+	}
+	if average := book.items[priceKey{"291", 422}].Average; average == nil || average.Last.Price != 500 {
+		t.Errorf("average %+v", average)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+var proxyListen = flag.String("proxy-listen", "", "Run as a TCP proxy listening on this address instead of capturing packets, e.g. 127.0.0.1:5555")
+var proxyTarget = flag.String("proxy-target", "", "Address of the game server the proxy forwards connections to")
+
+// Size of the reads of the proxy, each one becomes a stream chunk
+const proxyBufferSize = 32 << 10
+
+// runProxy forwards the connections accepted on -proxy-listen to
+// -proxy-target, decoding both directions like captured streams, until ctx
+// is cancelled. The readers are drained before returning.
+func runProxy(ctx context.Context) error {
+	if *proxyTarget == "" {
+		return errors.New("-proxy-listen needs a -proxy-target")
+	}
+	listener, err := net.Listen("tcp", *proxyListen)
+	if err != nil {
+		return fmt.Errorf("could not listen on %v - %s", *proxyListen, err)
+	}
+	return serveProxy(ctx, listener)
+}
+
+// serveProxy forwards the connections accepted on listener to -proxy-target
+// until ctx is cancelled, see runProxy
+func serveProxy(ctx context.Context, listener net.Listener) error {
+	readerPolicy, err := parseQueuePolicy(*readerQueuePolicy, policyBlock, policySpill)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	readerQueue := queueOptions{size: *readerQueueSize, policy: readerPolicy}
+
+	log.Printf("Proxying %s to %s", listener.Addr(), *proxyTarget)
+	stopListening := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stopListening()
+
+	var readers, sessions sync.WaitGroup
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				break
+			}
+			log.Printf("proxy: %s", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			proxySession(ctx, conn, readerQueue, &readers)
+		}()
+	}
+
+	log.Println("proxy closed")
+	sessions.Wait()
+	readers.Wait()
+	log.Println("all go routines finished")
+	return nil
+}
+
+// Forwards a client connection to the game server until one of them closes
+// both directions, or ctx is cancelled
+func proxySession(ctx context.Context, client net.Conn, readerQueue queueOptions, readers *sync.WaitGroup) {
+	var dialer net.Dialer
+	server, err := dialer.DialContext(ctx, "tcp", *proxyTarget)
+	if err != nil {
+		log.Printf("proxy: could not connect %s to %s - %s", client.RemoteAddr(), *proxyTarget, err)
+		client.Close()
+		return
+	}
+
+	stream := &tcpStream{
+		ident:      fmt.Sprintf("%s -> %s", client.RemoteAddr(), server.RemoteAddr()),
+		clientAddr: client.RemoteAddr().String(),
+		serverAddr: server.RemoteAddr().String(),
+	}
+	stats.streams.Add(1)
+	stats.streamsTotal.Add(1)
+	defer stats.streams.Add(-1)
+	stream.startReaders(readerQueue, readers)
+	log.Printf("%s: proxying", stream.ident)
+
+	// Closing the connections on shutdown unblocks the copies
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+		server.Close()
+	})
+	defer stop()
+
+	var copies sync.WaitGroup
+	var segments proxySegments
+	copies.Add(2)
+	go func() {
+		defer copies.Done()
+		proxyCopy(server, client, stream.client.bytes, dirClientToServer, &segments)
+	}()
+	go func() {
+		defer copies.Done()
+		proxyCopy(client, server, stream.server.bytes, dirServerToClient, &segments)
+	}()
+	copies.Wait()
+
+	stream.ending = endClosed
+	if ctx.Err() != nil {
+		stream.ending = endShutdown
+	}
+	client.Close()
+	server.Close()
+	stream.client.bytes.Close()
+	stream.server.bytes.Close()
+	log.Printf("%s: closed", stream.ident)
+}
+
+// proxySegments numbers the reads of a proxied session like captured
+// segments, so messages get TCPSeq, TCPAck and Packets as in a capture.
+// Sequence numbers are relative, as if both sides started at 0, and every
+// read counts as one packet.
+type proxySegments struct {
+	forwarded [2]atomic.Uint32 // Bytes forwarded, by direction
+	packets   atomic.Uint64
+}
+
+// Returns the segment information of a read of n bytes in direction dir
+func (pS *proxySegments) next(dir msgDirection, n int) segmentInfo {
+	seq := pS.forwarded[dir].Add(uint32(n)) - uint32(n)
+	return segmentInfo{
+		Seq:    seq + 1,
+		Ack:    pS.forwarded[1-dir].Load() + 1,
+		Packet: pS.packets.Add(1),
+	}
+}
+
+// Forwards src to dst, handing a copy of every read to the reader queue.
+// dst is half closed once src is done, so the peer sees the end of stream.
+func proxyCopy(dst net.Conn, src net.Conn, queue *boundedQueue[streamChunk], dir msgDirection, segments *proxySegments) {
+	buffer := make([]byte, proxyBufferSize)
+	for {
+		n, err := src.Read(buffer)
+		if n > 0 {
+			data := append([]byte(nil), buffer[:n]...)
+			if _, err := dst.Write(data); err != nil {
+				break
+			}
+			ci := gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: n, Length: n}
+			ci.AncillaryData = []interface{}{segments.next(dir, n)}
+			stats.bytes[dir].Add(uint64(n))
+			queue.Push(streamChunk{data: data, ci: ci})
+		}
+		if err != nil {
+			break
+		}
+	}
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// Plays a recorded session through the proxy, between the two sides of the
+// stand-in, and checks the proxy decodes the same messages as the capture.
+func TestProxyStandin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	captured, err := decodeCapture(ctx, []string{"chat_messages.pcap"}, "tcp port 5555")
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured = sessionMessages(captured, "")
+	if len(captured) == 0 {
+		t.Fatal("no session in chat_messages.pcap")
+	}
+
+	serverListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := *proxyTarget
+	*proxyTarget = serverListener.Addr().String()
+	defer func() { *proxyTarget = target }()
+
+	bus = newMessageBus()
+	sub := bus.Subscribe("test", queueOptions{size: 64, policy: policyBlock})
+	bus.SubscribeSessionEnds(sub)
+	done := make(chan []dofusMsg)
+	go func() {
+		var messages []dofusMsg
+		for msg := range sub.C {
+			messages = append(messages, msg)
+		}
+		done <- messages
+	}()
+
+	proxyCtx, stopProxy := context.WithCancel(ctx)
+	serverCtx, stopServer := context.WithCancel(ctx)
+	proxyDone := make(chan error)
+	go func() { proxyDone <- serveProxy(proxyCtx, proxyListener) }()
+	serverDone := make(chan error)
+	go func() { serverDone <- standinServe(serverCtx, serverListener, captured, time.Second) }()
+
+	if err := standinConnect(ctx, proxyListener.Addr().String(), captured, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stopServer()
+	if err := <-serverDone; err != nil {
+		t.Fatal(err)
+	}
+	stopProxy()
+	if err := <-proxyDone; err != nil {
+		t.Fatal(err)
+	}
+	bus.Close()
+	proxied := <-done
+
+	var messages []dofusMsg
+	var ends []string
+	for _, msg := range proxied {
+		if msg.Closed {
+			ends = append(ends, msg.Ending)
+		} else {
+			messages = append(messages, msg)
+		}
+	}
+	if len(ends) != 1 || ends[0] != endClosed {
+		t.Errorf("session ends %q, want one %q", ends, endClosed)
+	}
+	if len(messages) != len(captured) {
+		t.Fatalf("proxy decoded %d messages, the capture %d", len(messages), len(captured))
+	}
+	var seqs [2]uint32
+	for i, msg := range messages {
+		want := captured[i]
+		if msg.ProtocolId != want.ProtocolId || msg.Direction != want.Direction || !bytes.Equal(msg.body, want.body) {
+			t.Fatalf("message %d: got %s %s, want %s %s", i, msg.Direction, msg.Name(), want.Direction, want.Name())
+		}
+		if len(msg.Packets) == 0 || msg.TCPSeq == 0 || msg.TCPSeq < seqs[msg.Direction] {
+			t.Errorf("message %d: bad segment information, seq %d packets %v", i, msg.TCPSeq, msg.Packets)
+		}
+		seqs[msg.Direction] = msg.TCPSeq
+	}
+}
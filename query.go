@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerCommand("query", runQuery)
+}
+
+// queryFilter selects the records of a query. Empty criteria match
+// everything.
+type queryFilter struct {
+	names      map[string]bool
+	from       time.Time
+	to         time.Time
+	session    string // Client endpoint (ip:port) or client port
+	character  string
+	predicates []*filterExpr
+}
+
+func (qf *queryFilter) match(record *messageRecord) bool {
+	if len(qf.names) > 0 && !qf.names[record.Name] {
+		return false
+	}
+	if !qf.from.IsZero() && record.Time.Before(qf.from) {
+		return false
+	}
+	if !qf.to.IsZero() && record.Time.After(qf.to) {
+		return false
+	}
+	if qf.session != "" && record.Session != qf.session && !strings.HasSuffix(record.Session, ":"+qf.session) {
+		return false
+	}
+	if qf.character != "" && !strings.EqualFold(record.Character, qf.character) {
+		return false
+	}
+	for _, predicate := range qf.predicates {
+		if !predicate.Match(record) {
+			return false
+		}
+	}
+	return true
+}
+
+// Parses a -from/-to bound: an RFC 3339 time, a local date or date and
+// time, or a duration before now (e.g. 24h)
+func parseQueryTime(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02 15:04", time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a time (2006-01-02 15:04:05, RFC 3339) nor a duration", s)
+}
+
+// A recordSource feeds its records matching filter to yield, in time order,
+// until yield returns false
+type recordSource func(filter *queryFilter, yield func(record *messageRecord) bool) error
+
+// Reads the records of the SQLite archive at path. The filter is
+// partly applied by the database.
+func archiveSource(path string) recordSource {
+	return func(filter *queryFilter, yield func(record *messageRecord) bool) error {
+		if _, err := os.Stat(path); err != nil {
+			return err
+		}
+		db, err := openArchiveReadOnly(path)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		query := "SELECT time, session, character, server, seq, direction, protocol_id, name, namespace, body, error, raw FROM messages"
+		var conditions []string
+		var args []interface{}
+		if len(filter.names) > 0 {
+			placeholders := make([]string, 0, len(filter.names))
+			for name := range filter.names {
+				placeholders = append(placeholders, "?")
+				args = append(args, name)
+			}
+			conditions = append(conditions, "name IN ("+strings.Join(placeholders, ", ")+")")
+		}
+		if !filter.from.IsZero() {
+			conditions = append(conditions, "time >= ?")
+			args = append(args, filter.from.UnixNano())
+		}
+		if !filter.to.IsZero() {
+			conditions = append(conditions, "time <= ?")
+			args = append(args, filter.to.UnixNano())
+		}
+		if filter.character != "" {
+			conditions = append(conditions, "character = ? COLLATE NOCASE")
+			args = append(args, filter.character)
+		}
+		if len(conditions) > 0 {
+			query += " WHERE " + strings.Join(conditions, " AND ")
+		}
+		query += " ORDER BY time, id"
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var record messageRecord
+			var nanos int64
+			var body, decodeErr sql.NullString
+			err = rows.Scan(&nanos, &record.Session, &record.Character, &record.Server, &record.Seq, &record.Direction,
+				&record.ProtocolId, &record.Name, &record.Namespace, &body, &decodeErr, &record.Raw)
+			if err != nil {
+				return err
+			}
+			record.Time = time.Unix(0, nanos)
+			if body.Valid {
+				record.Body = json.RawMessage(body.String)
+			}
+			record.Error = decodeErr.String
+			if filter.match(&record) && !yield(&record) {
+				return nil
+			}
+		}
+		return rows.Err()
+	}
+}
+
+// Reads the records of the files written by the ndjson module, compressed
+// or not. pattern is a directory or a glob.
+func ndjsonSource(pattern string) recordSource {
+	return func(filter *queryFilter, yield func(record *messageRecord) bool) error {
+		files, err := ndjsonFiles(pattern)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("no ndjson file in %s", pattern)
+		}
+		for _, file := range files {
+			more, err := readNdjsonFile(file, func(record *messageRecord) bool {
+				return !filter.match(record) || yield(record)
+			})
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// Returns the ndjson files of pattern ordered by the time of their first
+// record, file names do not sort well once rotated twice in a second
+func ndjsonFiles(pattern string) ([]string, error) {
+	var files []string
+	if info, err := os.Stat(pattern); err == nil && info.IsDir() {
+		for _, glob := range []string{"*.ndjson", "*.ndjson.gz"} {
+			matches, _ := filepath.Glob(filepath.Join(pattern, glob))
+			files = append(files, matches...)
+		}
+	} else {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = matches
+	}
+
+	starts := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		_, err := readNdjsonFile(file, func(record *messageRecord) bool {
+			starts[file] = record.Time
+			return false
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return starts[files[i]].Before(starts[files[j]])
+	})
+	return files, nil
+}
+
+// Feeds the records of an ndjson file to yield, returns false if yield
+// asked to stop. Malformed lines, like the last one of a file being
+// written, are logged and skipped.
+func readNdjsonFile(path string, yield func(record *messageRecord) bool) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	var input io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+		defer gz.Close()
+		input = gz
+	}
+
+	reader := bufio.NewReader(input)
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var record messageRecord
+			if decodeErr := json.Unmarshal(line, &record); decodeErr != nil {
+				log.Printf("%s:%d: %s", path, lineNumber, decodeErr)
+			} else if !yield(&record) {
+				return false, nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+}
+
+// recordWriter prints the records found by a query
+type recordWriter interface {
+	Write(record *messageRecord) error
+	Flush() error
+}
+
+// Columns printed before the body, or the -fields, of the records
+var queryColumns = []string{"time", "character", "session", "direction", "name"}
+
+// Returns the body columns of record: the requested fields, or the whole
+// body, or the decoding error
+func bodyColumns(record *messageRecord, fields []string) []string {
+	if len(fields) == 0 {
+		if record.Body == nil {
+			return []string{"error: " + record.Error}
+		}
+		return []string{string(record.Body)}
+	}
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		values[i] = gjson.GetBytes(record.Body, field).String()
+	}
+	return values
+}
+
+func headerColumns(fields []string) []string {
+	if len(fields) == 0 {
+		return append(queryColumns, "body")
+	}
+	return append(queryColumns, fields...)
+}
+
+// Longest body printed in a table cell
+const tableBodyWidth = 120
+
+type tableRecordWriter struct {
+	writer *tabwriter.Writer
+	fields []string
+	header bool
+}
+
+func (tw *tableRecordWriter) Write(record *messageRecord) error {
+	if !tw.header {
+		tw.header = true
+		if _, err := fmt.Fprintln(tw.writer, strings.ToUpper(strings.Join(headerColumns(tw.fields), "\t"))); err != nil {
+			return err
+		}
+	}
+	character := record.Character
+	if character == "" {
+		character = "-"
+	}
+	columns := []string{record.Time.Local().Format("2006-01-02 15:04:05.000"), character, record.Session, record.Direction, record.Name}
+	for _, value := range bodyColumns(record, tw.fields) {
+		if len(value) > tableBodyWidth {
+			value = value[:tableBodyWidth-3] + "..."
+		}
+		columns = append(columns, value)
+	}
+	_, err := fmt.Fprintln(tw.writer, strings.Join(columns, "\t"))
+	return err
+}
+
+func (tw *tableRecordWriter) Flush() error {
+	return tw.writer.Flush()
+}
+
+// Writes the records as the ndjson module does, so that the output of a
+// query can be queried again
+type jsonRecordWriter struct {
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func (jw *jsonRecordWriter) Write(record *messageRecord) error {
+	return jw.encoder.Encode(record)
+}
+
+func (jw *jsonRecordWriter) Flush() error {
+	return jw.writer.Flush()
+}
+
+type csvRecordWriter struct {
+	writer *csv.Writer
+	fields []string
+	header bool
+}
+
+func (cw *csvRecordWriter) Write(record *messageRecord) error {
+	if !cw.header {
+		cw.header = true
+		if err := cw.writer.Write(headerColumns(cw.fields)); err != nil {
+			return err
+		}
+	}
+	columns := []string{record.Time.Format(time.RFC3339Nano), record.Character, record.Session, record.Direction, record.Name}
+	return cw.writer.Write(append(columns, bodyColumns(record, cw.fields)...))
+}
+
+func (cw *csvRecordWriter) Flush() error {
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+func newRecordWriter(format string, output io.Writer, fields []string) (recordWriter, error) {
+	switch format {
+	case "table":
+		return &tableRecordWriter{writer: tabwriter.NewWriter(output, 0, 0, 2, ' ', 0), fields: fields}, nil
+	case "json":
+		writer := bufio.NewWriter(output)
+		encoder := json.NewEncoder(writer)
+		encoder.SetEscapeHTML(false)
+		return &jsonRecordWriter{writer: writer, encoder: encoder}, nil
+	case "csv":
+		return &csvRecordWriter{writer: csv.NewWriter(output), fields: fields}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected table, json or csv", format)
+}
+
+// Splits a comma separated flag value, dropping empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// rps query: searches the messages stored by the archive or ndjson
+// modules, e.g.
+//
+//	rps query -name ChatServerMessage 'content~"ALED"'
+//	rps query -ndjson logs -character Yokoo -fields kamasTotal -format csv 'kamasTotal>1000000'
+func runQuery(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	archive := flags.String("archive", "", "SQLite archive to search, "+defaultArchivePath+" if no -ndjson is given")
+	ndjson := flags.String("ndjson", "", "Directory or glob of the ndjson files to search")
+	names := flags.String("name", "", "Comma separated message names to keep")
+	from := flags.String("from", "", "Keep messages captured from this time, 2006-01-02[ 15:04:05], RFC 3339 or a duration before now (e.g. 24h)")
+	to := flags.String("to", "", "Keep messages captured until this time, same format as -from")
+	session := flags.String("session", "", "Keep the messages of this session, by client endpoint (ip:port) or client port")
+	character := flags.String("character", "", "Keep the messages of this character")
+	fields := flags.String("fields", "", "Comma separated body fields to print instead of the whole body (gjson paths)")
+	format := flags.String("format", "table", "Output format: table, json or csv")
+	limit := flags.Int("limit", 0, "Print at most this many messages, 0 for all")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s query [-archive file | -ndjson dir] [filters] [filter expressions]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Filter expressions are evaluated on the messages, e.g. 'content~\"ALED\"' 'kamasTotal>1000000' 'channel in [5,6] || name == \"KamasUpdateMessage\"'\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *archive != "" && *ndjson != "" {
+		log.Println("-archive and -ndjson are exclusive")
+		return 2
+	}
+
+	filter := &queryFilter{
+		names:     make(map[string]bool),
+		session:   *session,
+		character: *character,
+	}
+	for _, name := range splitList(*names) {
+		filter.names[name] = true
+	}
+	var err error
+	now := time.Now()
+	if *from != "" {
+		if filter.from, err = parseQueryTime(*from, now); err != nil {
+			log.Printf("invalid -from: %s", err)
+			return 2
+		}
+	}
+	if *to != "" {
+		if filter.to, err = parseQueryTime(*to, now); err != nil {
+			log.Printf("invalid -to: %s", err)
+			return 2
+		}
+	}
+	for _, arg := range flags.Args() {
+		predicate, err := parseFilterExpr(arg)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		filter.predicates = append(filter.predicates, predicate)
+	}
+
+	writer, err := newRecordWriter(*format, os.Stdout, splitList(*fields))
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	source := archiveSource(defaultArchivePath)
+	if *archive != "" {
+		source = archiveSource(*archive)
+	} else if *ndjson != "" {
+		source = ndjsonSource(*ndjson)
+	}
+
+	found := 0
+	err = source(filter, func(record *messageRecord) bool {
+		if err := writer.Write(record); err != nil {
+			log.Println(err)
+			return false
+		}
+		found++
+		return *limit <= 0 || found < *limit
+	})
+	if flushErr := writer.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
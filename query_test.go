@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// Messages written by the archive and ndjson modules are found again by
+// rps query, in every format
+func TestQueryRoundTrip(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	sent := testEpoch.Add(-time.Minute)
+	messages := []dofusMsg{
+		characterSelected(t, game, "Aled"),
+		chatReceived(t, game, 1, 0, "Bob", "aled?", sent, "f1"),
+		chatReceived(t, game, 2, 5, "Bob", "ALED!", sent, "f2"),
+		chatReceived(t, game, 3, 0, "Carl", "hello", sent, "f3"),
+		testMessage(t, "KamasUpdateMessage", dirServerToClient, game, 3, new(bodyEncoder).varint(1000)),
+		chatReceived(t, game, 4, 0, "Carl", "aled again", sent, "f4"),
+		chatReceived(t, game, 5, 0, "Carl", "aled, last", sent, "f5"),
+	}
+	dir := t.TempDir()
+	archivePath, ndjsonDir := filepath.Join(dir, "archive.sqlite"), filepath.Join(dir, "logs")
+	runModule(t, new(archiveModule), `{"path": "`+archivePath+`"}`, messages)
+	runModule(t, new(ndjsonModule), `{"dir": "`+ndjsonDir+`", "gzip": false}`, messages)
+
+	predicate, err := parseFilterExpr(`content~"aled"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := &queryFilter{from: testEpoch.Add(2 * time.Second), to: testEpoch.Add(4 * time.Second), predicates: []*filterExpr{predicate}}
+	// The messages at 2 and 4 seconds
+	want := []int{2, 5}
+	fields := []string{"channel", "content"}
+
+	sources := []struct {
+		name   string
+		source recordSource
+	}{
+		{"archive", archiveSource(archivePath)},
+		{"ndjson", ndjsonSource(ndjsonDir)},
+	}
+	for _, source := range sources {
+		for _, format := range []string{"table", "json", "csv"} {
+			t.Run(source.name+" "+format, func(t *testing.T) {
+				var output bytes.Buffer
+				writer, err := newRecordWriter(format, &output, fields)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = source.source(filter, func(record *messageRecord) bool {
+					if err := writer.Write(record); err != nil {
+						t.Fatal(err)
+					}
+					return true
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.Flush(); err != nil {
+					t.Fatal(err)
+				}
+
+				switch format {
+				case "table":
+					lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+					if len(lines) != len(want)+1 || !strings.HasPrefix(lines[0], "TIME") || !strings.HasSuffix(lines[0], "CONTENT") {
+						t.Fatalf("table\n%s", output.String())
+					}
+					for i, index := range want {
+						text := bodyField(t, &messages[index], "content")
+						if !strings.Contains(lines[i+1], " Aled ") || !strings.HasSuffix(lines[i+1], text) {
+							t.Errorf("row %q, want %q of Aled", lines[i+1], text)
+						}
+					}
+				case "json":
+					decoder := json.NewDecoder(&output)
+					for _, index := range want {
+						var record messageRecord
+						if err := decoder.Decode(&record); err != nil {
+							t.Fatal(err)
+						}
+						msg := &messages[index]
+						if !record.Time.Equal(msg.Timestamp) || record.Character != "Aled" || record.Name != msg.Name() ||
+							record.Session != msg.Session() || !bytes.Equal(record.Raw, msg.body) {
+							t.Errorf("record %+v, want %s of Aled at %v", record, msg.Name(), msg.Timestamp)
+						}
+						if text := bodyField(t, msg, "content"); !strings.Contains(string(record.Body), `"content":"`+text+`"`) {
+							t.Errorf("body %s, want %q", record.Body, text)
+						}
+					}
+					if decoder.More() {
+						t.Error("more records")
+					}
+				case "csv":
+					rows, err := csv.NewReader(&output).ReadAll()
+					if err != nil {
+						t.Fatal(err)
+					}
+					wantRows := [][]string{headerColumns(fields)}
+					for i, index := range want {
+						msg := &messages[index]
+						// In the time zone of the source
+						if i+1 < len(rows) {
+							if at, err := time.Parse(time.RFC3339Nano, rows[i+1][0]); err != nil || !at.Equal(msg.Timestamp) {
+								t.Errorf("row at %s, want %v", rows[i+1][0], msg.Timestamp)
+							}
+							rows[i+1][0] = ""
+						}
+						wantRows = append(wantRows, []string{"", "Aled", msg.Session(),
+							msg.Direction.String(), msg.Name(), bodyField(t, msg, "channel"), bodyField(t, msg, "content")})
+					}
+					if !reflect.DeepEqual(rows, wantRows) {
+						t.Errorf("csv %v, want %v", rows, wantRows)
+					}
+				}
+			})
+		}
+	}
+}
+
+// Returns a field of the body of msg, as printed by the queries
+func bodyField(t *testing.T, msg *dofusMsg, path string) string {
+	t.Helper()
+	body, err := msg.JSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gjson.GetBytes(body, path).String()
+}
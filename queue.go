@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var readerQueueSize = flag.Int("reader-queue", 1024, "Chunks buffered between the reassembler and each stream reader")
+var readerQueuePolicy = flag.String("reader-policy", "auto", "What to do when a reader queue is full: block, drop-oldest, spill or auto (block on files, spill live). Dropping data desynchronizes the stream")
+var moduleQueueSize = flag.Int("module-queue", 256, "Messages buffered between the readers and each module")
+var moduleQueuePolicy = flag.String("module-policy", "auto", "What to do when a module queue is full: block, drop-oldest, spill or auto (block on files, drop-oldest live)")
+var spillDir = flag.String("spill-dir", os.TempDir(), "Directory of the files used by the spill policy")
+
+// queuePolicy tells what a full queue does with new items
+type queuePolicy int
+
+const (
+	// Wait for room, slowing down the previous stage
+	policyBlock queuePolicy = iota
+	// Drop the oldest queued item
+	policyDropOldest
+	// Write new items to disk until there is room again
+	policySpill
+)
+
+func (p queuePolicy) String() string {
+	switch p {
+	case policyDropOldest:
+		return "drop-oldest"
+	case policySpill:
+		return "spill"
+	default:
+		return "block"
+	}
+}
+
+// Parses a -*-policy flag. auto resolves to offline when reading a file and
+// to live when capturing.
+func parseQueuePolicy(s string, offline queuePolicy, live queuePolicy) (queuePolicy, error) {
+	switch s {
+	case "block":
+		return policyBlock, nil
+	case "drop-oldest":
+		return policyDropOldest, nil
+	case "spill":
+		return policySpill, nil
+	case "auto":
+		if isOfflineCapture() {
+			return offline, nil
+		}
+		return live, nil
+	}
+	return policyBlock, fmt.Errorf("unknown queue policy %q", s)
+}
+
+type queueOptions struct {
+	size   int
+	policy queuePolicy
+}
+
+// stageStats aggregates the queues of a pipeline stage
+type stageStats struct {
+	name    string
+	queues  atomic.Int64
+	depth   atomic.Int64
+	pushed  atomic.Uint64
+	dropped atomic.Uint64
+	spilled atomic.Uint64
+	// Failures to write or read a spill file, the items are dropped
+	spillErrors atomic.Uint64
+}
+
+var stagesMutex sync.Mutex
+var stages = map[string]*stageStats{}
+
+// Returns the stats of the named stage, creating them if needed
+func pipelineStage(name string) *stageStats {
+	stagesMutex.Lock()
+	defer stagesMutex.Unlock()
+
+	if stages[name] == nil {
+		stages[name] = &stageStats{name: name}
+	}
+	return stages[name]
+}
+
+// Returns the stats of every stage, sorted by name
+func pipelineStages() []*stageStats {
+	stagesMutex.Lock()
+	defer stagesMutex.Unlock()
+
+	list := make([]*stageStats, 0, len(stages))
+	for _, stage := range stages {
+		list = append(list, stage)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+func (s *stageStats) String() string {
+	return fmt.Sprintf("%s: %d queues, depth %d, pushed %d, dropped %d, spilled %d, spill errors %d",
+		s.name, s.queues.Load(), s.depth.Load(), s.pushed.Load(), s.dropped.Load(), s.spilled.Load(), s.spillErrors.Load())
+}
+
+// boundedQueue is a FIFO holding at most size items in memory, behaving
+// according to its policy when full. Items must be gob encodable to be
+// spilled.
+type boundedQueue[T any] struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   []T
+	options queueOptions
+	stage   *stageStats
+	closed  bool
+
+	spill   *spillFile[T]
+	spilled int
+	dropped uint64
+
+	// Number of Pop calls waiting for an item, and the hook called when
+	// one starts waiting
+	waiters int
+	onIdle  func()
+}
+
+func newBoundedQueue[T any](stage *stageStats, options queueOptions) *boundedQueue[T] {
+	if options.size < 1 {
+		options.size = 1
+	}
+	q := &boundedQueue[T]{
+		options: options,
+		stage:   stage,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	stage.queues.Add(1)
+	return q
+}
+
+// Push queues an item. It returns false if the item was dropped, or if the
+// queue is closed.
+func (q *boundedQueue[T]) Push(item T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+	q.stage.pushed.Add(1)
+
+	full := len(q.items) >= q.options.size
+	switch {
+	case q.options.policy == policySpill && (full || q.spilled > 0):
+		if err := q.spillItem(item); err != nil {
+			log.Printf("%s queue: could not spill, dropping - %s", q.stage.name, err)
+			q.stage.spillErrors.Add(1)
+			q.dropped++
+			q.stage.dropped.Add(1)
+			return false
+		}
+		q.spilled++
+		q.stage.spilled.Add(1)
+	case full && q.options.policy == policyDropOldest:
+		var zero T
+		q.items[0] = zero
+		q.items = q.items[1:]
+		q.dropped++
+		q.stage.dropped.Add(1)
+		q.stage.depth.Add(-1)
+		q.items = append(q.items, item)
+	default:
+		for len(q.items) >= q.options.size && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return false
+		}
+		q.items = append(q.items, item)
+	}
+	q.stage.depth.Add(1)
+	q.cond.Broadcast()
+	return true
+}
+
+// Pop waits for an item. It returns false once the queue is closed and
+// empty. Spilled items that cannot be read back are dropped.
+func (q *boundedQueue[T]) Pop() (item T, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		for len(q.items) == 0 && q.spilled == 0 && !q.closed {
+			q.waiters++
+			if q.onIdle != nil {
+				q.mu.Unlock()
+				q.onIdle()
+				q.mu.Lock()
+			}
+			if len(q.items) == 0 && q.spilled == 0 && !q.closed {
+				q.cond.Wait()
+			}
+			q.waiters--
+		}
+
+		// Items in memory are always older than the spilled ones
+		switch {
+		case len(q.items) > 0:
+			item = q.items[0]
+			var zero T
+			q.items[0] = zero
+			q.items = q.items[1:]
+		case q.spilled > 0:
+			var err error
+			if item, err = q.spill.read(); err != nil {
+				q.dropSpilled(err)
+				var zero T
+				item = zero
+				continue
+			}
+			q.spilled--
+			if q.spilled == 0 {
+				q.spill.reset()
+			}
+		default:
+			return item, false
+		}
+		q.stage.depth.Add(-1)
+		q.cond.Broadcast()
+		return item, true
+	}
+}
+
+// Drops the spilled items after a read error
+func (q *boundedQueue[T]) dropSpilled(err error) {
+	log.Printf("%s queue: could not read spilled items, dropping %d - %s", q.stage.name, q.spilled, err)
+	q.stage.spillErrors.Add(1)
+	q.stage.dropped.Add(uint64(q.spilled))
+	q.stage.depth.Add(-int64(q.spilled))
+	q.dropped += uint64(q.spilled)
+	q.spilled = 0
+	q.spill.reset()
+}
+
+// Close stops accepting items, Pop still returns the queued ones
+func (q *boundedQueue[T]) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.stage.queues.Add(-1)
+	q.cond.Broadcast()
+}
+
+// Len returns the number of queued items, spilled ones included
+func (q *boundedQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) + q.spilled
+}
+
+// Idle tells if the consumer is waiting on an empty queue
+func (q *boundedQueue[T]) Idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) == 0 && q.spilled == 0 && q.waiters > 0
+}
+
+// Dropped returns the number of items dropped by this queue
+func (q *boundedQueue[T]) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
+
+func (q *boundedQueue[T]) spillItem(item T) error {
+	if q.spill == nil {
+		q.spill = &spillFile[T]{prefix: q.stage.name}
+	}
+	return q.spill.write(item)
+}
+
+// spillFile stores the overflow of a queue, it is removed once drained
+type spillFile[T any] struct {
+	prefix  string
+	path    string
+	writer  *os.File
+	reader  *os.File
+	encoder *gob.Encoder
+	decoder *gob.Decoder
+}
+
+func (sf *spillFile[T]) write(item T) error {
+	if sf.writer == nil {
+		file, err := os.CreateTemp(*spillDir, fmt.Sprintf("rps-%s-*.spill", sf.prefix))
+		if err != nil {
+			return err
+		}
+		reader, err := os.Open(file.Name())
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return err
+		}
+		sf.path = file.Name()
+		sf.writer, sf.reader = file, reader
+		sf.encoder = gob.NewEncoder(file)
+		sf.decoder = gob.NewDecoder(reader)
+	}
+	return sf.encoder.Encode(item)
+}
+
+func (sf *spillFile[T]) read() (item T, err error) {
+	if sf.decoder == nil {
+		return item, io.ErrUnexpectedEOF
+	}
+	err = sf.decoder.Decode(&item)
+	return
+}
+
+// Removes the file, the next write starts a new one
+func (sf *spillFile[T]) reset() {
+	if sf.writer == nil {
+		return
+	}
+	sf.writer.Close()
+	sf.reader.Close()
+	os.Remove(sf.path)
+	sf.writer, sf.reader = nil, nil
+	sf.encoder, sf.decoder = nil, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBoundedQueuePolicies(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      queuePolicy
+		size        int
+		push        []int
+		wantPushed  []bool
+		wantPopped  []int
+		wantDropped uint64
+	}{
+		{
+			name:       "block within size",
+			policy:     policyBlock,
+			size:       4,
+			push:       []int{1, 2, 3},
+			wantPushed: []bool{true, true, true},
+			wantPopped: []int{1, 2, 3},
+		},
+		{
+			name:        "drop oldest",
+			policy:      policyDropOldest,
+			size:        2,
+			push:        []int{1, 2, 3, 4},
+			wantPushed:  []bool{true, true, true, true},
+			wantPopped:  []int{3, 4},
+			wantDropped: 2,
+		},
+		{
+			name:       "spill keeps the order",
+			policy:     policySpill,
+			size:       2,
+			push:       []int{1, 2, 3, 4, 5},
+			wantPushed: []bool{true, true, true, true, true},
+			wantPopped: []int{1, 2, 3, 4, 5},
+		},
+		{
+			name:       "size below one",
+			policy:     policyDropOldest,
+			size:       0,
+			push:       []int{1, 2},
+			wantPushed: []bool{true, true},
+			wantPopped: []int{2},
+
+			wantDropped: 1,
+		},
+	}
+
+	*spillDir = t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newBoundedQueue[int](pipelineStage("test"), queueOptions{size: tt.size, policy: tt.policy})
+			var pushed []bool
+			for _, item := range tt.push {
+				pushed = append(pushed, q.Push(item))
+			}
+			q.Close()
+			if q.Push(0) {
+				t.Error("Push succeeded on a closed queue")
+			}
+			if q.Len() != len(tt.wantPopped) {
+				t.Errorf("Len() = %d, want %d", q.Len(), len(tt.wantPopped))
+			}
+
+			var popped []int
+			for {
+				item, ok := q.Pop()
+				if !ok {
+					break
+				}
+				popped = append(popped, item)
+			}
+			if !reflect.DeepEqual(pushed, tt.wantPushed) {
+				t.Errorf("Push() = %v, want %v", pushed, tt.wantPushed)
+			}
+			if !reflect.DeepEqual(popped, tt.wantPopped) {
+				t.Errorf("Pop() = %v, want %v", popped, tt.wantPopped)
+			}
+			if q.Dropped() != tt.wantDropped {
+				t.Errorf("Dropped() = %d, want %d", q.Dropped(), tt.wantDropped)
+			}
+		})
+	}
+}
+
+// Spilled items that cannot be read back are dropped and counted, Pop goes
+// on with the next items
+func TestBoundedQueueSpillReadError(t *testing.T) {
+	*spillDir = t.TempDir()
+	stage := pipelineStage("test-spill-error")
+	spillErrors := stage.spillErrors.Load()
+	q := newBoundedQueue[int](stage, queueOptions{size: 1, policy: policySpill})
+	for item := 1; item <= 3; item++ {
+		q.Push(item)
+	}
+	if err := q.spill.writer.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+
+	if item, ok := q.Pop(); item != 1 || !ok {
+		t.Fatalf("Pop() = %d, %v, want 1, true", item, ok)
+	}
+	popped := make(chan int)
+	go func() {
+		item, _ := q.Pop()
+		popped <- item
+	}()
+	// Once the spilled items are dropped, Pop waits for the next one
+	for !q.Idle() {
+		time.Sleep(time.Millisecond)
+	}
+	q.Push(4)
+	if item := <-popped; item != 4 {
+		t.Errorf("Pop() after the error = %d, want 4", item)
+	}
+	q.Close()
+	if item, ok := q.Pop(); item != 0 || ok {
+		t.Errorf("Pop() on a closed queue = %d, %v, want 0, false", item, ok)
+	}
+	if errors := stage.spillErrors.Load() - spillErrors; errors != 1 || q.Dropped() != 2 {
+		t.Errorf("%d spill errors and %d dropped, want 1 and 2", errors, q.Dropped())
+	}
+}
@@ -2,99 +2,148 @@ package main
 
 import (
 	"encoding/binary"
+	"errors"
 	"math"
 	"reflect"
 )
 
+// The readers fail with errShortBody rather than reading past the data,
+// misframed or truncated bodies are common on resynchronized streams
+var errShortBody = errors.New("body too short")
+var errLongVarint = errors.New("variable length integer too long")
+
 type dofusField struct {
 	fieldType reflect.Type
 	reader    func(data []byte) (value bool, size int)
 }
 
-func readBoolean(data []byte) (value bool, size int) {
+func readBoolean(data []byte) (value bool, size int, err error) {
+	if len(data) < 1 {
+		return value, 0, errShortBody
+	}
 	value = data[0] != 0
 	size = 1
 	return
 }
 
-func readByte(data []byte) (value byte, size int) {
+func readByte(data []byte) (value byte, size int, err error) {
+	if len(data) < 1 {
+		return value, 0, errShortBody
+	}
 	value = data[0]
 	size = 1
 	return
 }
 
-func readShort(data []byte) (value int16, size int) {
+func readShort(data []byte) (value int16, size int, err error) {
+	if len(data) < 2 {
+		return value, 0, errShortBody
+	}
 	value = int16(binary.BigEndian.Uint16(data[0:2]))
 	size = 2
 	return
 }
 
-func readUnsignedShort(data []byte) (value uint16, size int) {
+func readUnsignedShort(data []byte) (value uint16, size int, err error) {
+	if len(data) < 2 {
+		return value, 0, errShortBody
+	}
 	value = binary.BigEndian.Uint16(data[0:2])
 	size = 2
 	return
 }
 
-func readInt(data []byte) (value int32, size int) {
+func readInt(data []byte) (value int32, size int, err error) {
+	if len(data) < 4 {
+		return value, 0, errShortBody
+	}
 	value = int32(binary.BigEndian.Uint32(data[0:4]))
 	size = 4
 	return
 }
 
-func readUnsignedInt(data []byte) (value uint32, size int) {
+func readUnsignedInt(data []byte) (value uint32, size int, err error) {
+	if len(data) < 4 {
+		return value, 0, errShortBody
+	}
 	value = binary.BigEndian.Uint32(data[0:4])
 	size = 4
 	return
 }
 
-func readDouble(data []byte) (value float64, size int) {
+func readDouble(data []byte) (value float64, size int, err error) {
+	if len(data) < 8 {
+		return value, 0, errShortBody
+	}
 	value = math.Float64frombits(binary.BigEndian.Uint64(data[0:8]))
 	size = 8
 	return
 }
 
-func readString(data []byte) (value string, size int) {
-	stringLen, _ := readUnsignedShort(data)
+func readFloat(data []byte) (value float32, size int, err error) {
+	if len(data) < 4 {
+		return value, 0, errShortBody
+	}
+	value = math.Float32frombits(binary.BigEndian.Uint32(data[0:4]))
+	size = 4
+	return
+}
+
+func readString(data []byte) (value string, size int, err error) {
+	stringLen, _, err := readUnsignedShort(data)
+	if err != nil {
+		return
+	}
+	if len(data) < 2+int(stringLen) {
+		return value, 0, errShortBody
+	}
 	value = string(data[2 : 2+stringLen])
 	size = 2 + int(stringLen)
 	return
 }
 
-func readVarShort(data []byte) (value int16, size int) {
+func readVarShort(data []byte) (value int16, size int, err error) {
 	for i := 0; i < 16; i += 7 {
-		b, byteSize := readByte(data[size:])
+		b, byteSize, readErr := readByte(data[size:])
+		if readErr != nil {
+			return 0, 0, readErr
+		}
 		value += int16(b&0b01111111) << i
 		size += byteSize
 		if b&0b10000000 == 0 {
 			return
 		}
 	}
-	return 0, 0 // Error handling for too much data
+	return 0, 0, errLongVarint
 }
 
-func readVarInt(data []byte) (value int32, size int) {
+func readVarInt(data []byte) (value int32, size int, err error) {
 	var tmpValue int64
 	for offset := 0; offset < 32; {
-		current, byteSize := readByte(data[size:])
+		current, byteSize, readErr := readByte(data[size:])
+		if readErr != nil {
+			return 0, 0, readErr
+		}
 
 		hasNext := int(current&0b10000000) >> 7
 		tmpValue += int64(current&0b01111111) << offset
 		offset += 7
 		size += byteSize
 		if hasNext == 0 {
-			if tmpValue > 0 && tmpValue > math.MaxInt32 {
-				tmpValue -= int64(math.MaxUint32)
-			}
+			// Negative values are sent as their 32 bits two's complement
 			value = int32(tmpValue)
 			return
 		}
 	}
-	return 0, 0 // Error handling for too much data
+	return 0, 0, errLongVarint
 }
 
-func readVarLong(data []byte) (value int64, size int) {
+func readVarLong(data []byte) (value int64, size int, err error) {
 	for offset := 0; offset < 64; {
-		current, byteSize := readByte(data[size:])
+		current, byteSize, readErr := readByte(data[size:])
+		if readErr != nil {
+			return 0, 0, readErr
+		}
 		hasNext := int(current&0b10000000) >> 7
 		value += int64(current&0b01111111) << offset
 		offset += 7
@@ -103,5 +152,5 @@ func readVarLong(data []byte) (value int64, size int) {
 			return
 		}
 	}
-	return 0, 0 // Error handling for too much data
+	return 0, 0, errLongVarint
 }
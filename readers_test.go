@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestReaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		read     func(data []byte) (interface{}, int, error)
+		data     []byte
+		want     interface{}
+		wantSize int
+		wantErr  error
+	}{
+		{"boolean", wrapReader(readBoolean), []byte{1}, true, 1, nil},
+		{"byte", wrapReader(readByte), []byte{200, 1}, byte(200), 1, nil},
+		{"short", wrapReader(readShort), []byte{0xff, 0xfe}, int16(-2), 2, nil},
+		{"short truncated", wrapReader(readShort), []byte{0xff}, int16(0), 0, errShortBody},
+		{"int", wrapReader(readInt), []byte{0, 1, 0, 0}, int32(65536), 4, nil},
+		{"unsigned int truncated", wrapReader(readUnsignedInt), []byte{0, 1, 0}, uint32(0), 0, errShortBody},
+		{"double truncated", wrapReader(readDouble), make([]byte, 7), float64(0), 0, errShortBody},
+		{"float", wrapReader(readFloat), []byte{0x40, 0, 0, 0}, float32(2), 4, nil},
+		{"string", wrapReader(readString), []byte{0, 4, 'A', 'l', 'e', 'd', 0}, "Aled", 6, nil},
+		{"string truncated", wrapReader(readString), []byte{0, 4, 'A', 'l'}, "", 0, errShortBody},
+		{"empty", wrapReader(readByte), nil, byte(0), 0, errShortBody},
+		{"var short", wrapReader(readVarShort), []byte{0xac, 0x02}, int16(300), 2, nil},
+		{"var int", wrapReader(readVarInt), []byte{0x96, 0x01}, int32(150), 2, nil},
+		{"var int negative", wrapReader(readVarInt), []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, int32(-1), 5, nil},
+		{"var int truncated", wrapReader(readVarInt), []byte{0x96}, int32(0), 0, errShortBody},
+		{"var int too long", wrapReader(readVarInt), []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, int32(0), 0, errLongVarint},
+		{"var long", wrapReader(readVarLong), []byte{0x80, 0x80, 0x80, 0x80, 0x10}, int64(1 << 32), 5, nil},
+		{"var long truncated", wrapReader(readVarLong), []byte{0x80, 0x80}, int64(0), 0, errShortBody},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, size, err := test.read(test.data)
+			if err != test.wantErr {
+				t.Fatalf("error %v, want %v", err, test.wantErr)
+			}
+			if value != test.want || size != test.wantSize {
+				t.Errorf("read %v (%T) in %d bytes, want %v (%T) in %d bytes", value, value, size, test.want, test.want, test.wantSize)
+			}
+		})
+	}
+}
+
+func wrapReader[T any](read func(data []byte) (T, int, error)) func(data []byte) (interface{}, int, error) {
+	return func(data []byte) (interface{}, int, error) {
+		value, size, err := read(data)
+		return value, size, err
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body *bodyEncoder
+		want string
+	}{
+		{
+			name: "HouseBuyResultMessage",
+			// bought is the second flag of the box
+			body: new(bodyEncoder).byte(0b10).varint(1234).int(7).varint(5000000),
+			want: `{"bought": true, "secondHand": false, "houseId": 1234, "instanceId": 7, "realPrice": 5000000}`,
+		},
+		{
+			name: "BasicWhoIsNoMatchMessage",
+			body: new(bodyEncoder).short(8303).utf("Aled"),
+			want: `{"target": {"name": "Aled"}}`,
+		},
+		{
+			name: "ExchangeStartedBidSellerMessage",
+			body: new(bodyEncoder).short(1).varint(1).short(1).varint(48).float(2.5).float(0).byte(200).varint(100).int(-1).varint(672).
+				short(1).varint(421).short(0).varint(9001).varint(100).varint(4500).int(100),
+			want: `{"sellerDescriptor": {"quantities": [1], "types": [48], "taxPercentage": 2.5, "taxModificationPercentage": 0,
+				"maxItemLevel": 200, "maxItemPerAccount": 100, "npcContextualId": -1, "unsoldDelay": 672},
+				"objectsInfos": [{"objectGID": 421, "effects": [], "objectUID": 9001, "quantity": 100, "objectPrice": 4500, "unsoldDelay": 100}]}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			msg := dofusMsg{ProtocolId: nameIdMap[test.name], body: test.body.Bytes()}
+			body, err := msg.JSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %s", body)
+			}
+
+			// Every truncation fails instead of reading past the body
+			for n := 0; n < len(msg.body); n++ {
+				truncated := dofusMsg{ProtocolId: msg.ProtocolId, body: msg.body[:n]}
+				if _, err := truncated.Fields(); err == nil {
+					t.Errorf("decoded %d bytes out of %d", n, len(msg.body))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var replaySpeed = flag.String("replay-speed", "max", "Pace of packets read with -r according to their capture time: 1x, 10x, 0.5x... or max")
+var replayPaused = flag.Bool("replay-paused", false, "Start the replay paused, to be resumed or stepped from the API, needs -api")
+
+// Parses a -replay-speed value, 0 means as fast as possible
+func parseReplaySpeed(s string) (float64, error) {
+	if s == "max" {
+		return 0, nil
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("invalid replay speed %q", s)
+	}
+	return speed, nil
+}
+
+// replayClock paces the packets of a capture file as if they were captured
+// live. It can be paused, stepped packet by packet and have its speed
+// changed while running.
+type replayClock struct {
+	mu      sync.Mutex
+	speed   float64 // 0 for no pacing
+	paused  bool
+	steps   int           // Packets allowed through while paused
+	changed chan struct{} // Closed and replaced on every change
+
+	// The capture time origin is played at the wall time origin
+	captureOrigin time.Time
+	wallOrigin    time.Time
+	last          time.Time // Capture time of the last packet let through
+	packets       uint64
+}
+
+// The clock of the current replay, nil when capturing live
+var replay *replayClock
+
+func newReplayClock(speed float64, paused bool) *replayClock {
+	return &replayClock{
+		speed:   speed,
+		paused:  paused,
+		changed: make(chan struct{}),
+	}
+}
+
+// Must be called with the lock held
+func (rc *replayClock) notify() {
+	close(rc.changed)
+	rc.changed = make(chan struct{})
+}
+
+// Makes the packet captured at timestamp due now. Must be called with the
+// lock held.
+func (rc *replayClock) rebase(timestamp time.Time) {
+	rc.captureOrigin = timestamp
+	rc.wallOrigin = time.Now()
+}
+
+// Wait blocks until the packet captured at timestamp is due, or ctx is done
+func (rc *replayClock) Wait(ctx context.Context, timestamp time.Time) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.captureOrigin.IsZero() {
+		rc.rebase(timestamp)
+	}
+	for {
+		changed := rc.changed
+		var timer *time.Timer
+		var due <-chan time.Time
+		switch {
+		case rc.paused && rc.steps > 0:
+			rc.steps--
+			rc.rebase(timestamp)
+			return rc.pass(timestamp)
+		case rc.paused:
+		case rc.speed == 0:
+			return rc.pass(timestamp)
+		default:
+			delay := time.Duration(float64(timestamp.Sub(rc.captureOrigin))/rc.speed) - time.Since(rc.wallOrigin)
+			if delay <= 0 {
+				return rc.pass(timestamp)
+			}
+			timer = time.NewTimer(delay)
+			due = timer.C
+		}
+
+		rc.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			rc.mu.Lock()
+			return ctx.Err()
+		case <-changed:
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		rc.mu.Lock()
+	}
+}
+
+func (rc *replayClock) pass(timestamp time.Time) error {
+	rc.last = timestamp
+	rc.packets++
+	return nil
+}
+
+// Pause stops letting packets through
+func (rc *replayClock) Pause() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.paused = true
+	rc.notify()
+}
+
+// Resume goes on from the last packet, without catching up on the time spent
+// paused
+func (rc *replayClock) Resume() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.paused && !rc.last.IsZero() {
+		rc.rebase(rc.last)
+	}
+	rc.paused = false
+	rc.steps = 0
+	rc.notify()
+}
+
+// Step lets n more packets through while paused
+func (rc *replayClock) Step(n int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.paused = true
+	rc.steps += n
+	rc.notify()
+}
+
+// SetSpeed changes the pace, 0 for as fast as possible
+func (rc *replayClock) SetSpeed(speed float64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.last.IsZero() {
+		rc.rebase(rc.last)
+	}
+	rc.speed = speed
+	rc.notify()
+}
+
+type replayStatus struct {
+	Speed       string    `json:"speed"`
+	Paused      bool      `json:"paused"`
+	Steps       int       `json:"steps"`
+	Packets     uint64    `json:"packets"`
+	CaptureTime time.Time `json:"captureTime"` // Of the last packet let through
+}
+
+func (rc *replayClock) Status() replayStatus {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	speed := "max"
+	if rc.speed > 0 {
+		speed = strconv.FormatFloat(rc.speed, 'g', -1, 64) + "x"
+	}
+	return replayStatus{
+		Speed:       speed,
+		Paused:      rc.paused,
+		Steps:       rc.steps,
+		Packets:     rc.packets,
+		CaptureTime: rc.last,
+	}
+}
+
+var errNoReplay = errors.New("not replaying a capture file")
+
+func init() {
+	// GET /replay returns the status, POST /replay/pause, /replay/resume,
+	// /replay/step?n=1 and /replay/speed?value=10x drive the replay
+	apiMux.HandleFunc("/replay", func(w http.ResponseWriter, r *http.Request) {
+		if replay == nil {
+			writeError(w, http.StatusNotFound, errNoReplay)
+			return
+		}
+		writeJSON(w, replay.Status())
+	})
+	apiMux.HandleFunc("/replay/", func(w http.ResponseWriter, r *http.Request) {
+		if replay == nil {
+			writeError(w, http.StatusNotFound, errNoReplay)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("POST required"))
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/replay/") {
+		case "pause":
+			replay.Pause()
+		case "resume":
+			replay.Resume()
+		case "step":
+			n := 1
+			if value := r.URL.Query().Get("n"); value != "" {
+				var err error
+				if n, err = strconv.Atoi(value); err != nil || n < 1 {
+					writeError(w, http.StatusBadRequest, fmt.Errorf("invalid step count %q", value))
+					return
+				}
+			}
+			replay.Step(n)
+		case "speed":
+			speed, err := parseReplaySpeed(r.URL.Query().Get("value"))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+			replay.SetSpeed(speed)
+		default:
+			writeError(w, http.StatusNotFound, fmt.Errorf("unknown replay action %q", r.URL.Path))
+			return
+		}
+		writeJSON(w, replay.Status())
+	})
+}
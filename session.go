@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/gob"
+	"sync"
+
+	"github.com/google/gopacket"
+)
+
+// Why a session ended, see dofusMsg.Ending
+const (
+	endClosed   = "closed"   // FIN or RST
+	endShutdown = "shutdown" // rps stopped or the capture is over
+	endIdle     = "idle"     // No traffic for too long
+)
+
+// segmentInfo is attached to the CaptureInfo of every assembled packet (in
+// AncillaryData), so decoded messages know the TCP segment completing them
+type segmentInfo struct {
+	Seq    uint32
+	Ack    uint32
+	Packet uint64 // Index of the packet in the capture, starting at 1
+}
+
+func init() {
+	// Chunks spilled to disk carry it in their CaptureInfo
+	gob.Register(segmentInfo{})
+}
+
+// Returns the segment information attached to ci, if any
+func segmentOf(ci gopacket.CaptureInfo) (segmentInfo, bool) {
+	for _, data := range ci.AncillaryData {
+		if segment, ok := data.(segmentInfo); ok {
+			return segment, true
+		}
+	}
+	return segmentInfo{}, false
+}
+
+// Tells if the TCP sequence number a is after b, wrapping included
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// Ordering of the session timeline: capture time first, then, for messages
+// captured at the same time in both directions, the one acknowledged by the
+// other comes first.
+func timelineBefore(a, b *dofusMsg) bool {
+	if !a.Timestamp.Equal(b.Timestamp) {
+		return a.Timestamp.Before(b.Timestamp)
+	}
+	if a.Direction != b.Direction {
+		if seqAfter(b.TCPAck, a.TCPSeq) {
+			return true
+		}
+		if seqAfter(a.TCPAck, b.TCPSeq) {
+			return false
+		}
+	}
+	return a.order < b.order
+}
+
+type timelineHeap []*dofusMsg
+
+func (th timelineHeap) Len() int            { return len(th) }
+func (th timelineHeap) Less(i, j int) bool  { return timelineBefore(th[i], th[j]) }
+func (th timelineHeap) Swap(i, j int)       { th[i], th[j] = th[j], th[i] }
+func (th *timelineHeap) Push(x interface{}) { *th = append(*th, x.(*dofusMsg)) }
+func (th *timelineHeap) Pop() interface{} {
+	old := *th
+	msg := old[len(old)-1]
+	old[len(old)-1] = nil
+	*th = old[:len(old)-1]
+	return msg
+}
+
+// sessionSide is what the merger knows about one direction of the session
+type sessionSide struct {
+	queue  *boundedQueue[streamChunk]
+	closed bool
+}
+
+// caughtUp tells that every message this side could produce before now has
+// been handed to the merger: its reader is waiting for data, or is gone.
+func (side *sessionSide) caughtUp() bool {
+	return side.closed || side.queue == nil || side.queue.Idle()
+}
+
+// sessionMerger orders the messages of both directions of a session into a
+// single timeline before publishing them.
+//
+// Both readers are fed by the assembler in capture order. A message can be
+// published once the reader of the other direction has nothing older left
+// to decode, that is when it is waiting for data or has already produced a
+// message captured later.
+type sessionMerger struct {
+	mu      sync.Mutex
+	sides   [2]sessionSide // Indexed by msgDirection
+	last    [2]*dofusMsg   // Last message received from each side
+	pending timelineHeap
+	order   uint64
+	seq     uint64
+	ended   bool   // The end of the session was published
+	ending  string // Why the session ended, see Done
+	publish func(msg dofusMsg)
+
+	// Messages released but not published yet, and whether a caller is
+	// publishing them
+	ready      []dofusMsg
+	publishing bool
+}
+
+func newSessionMerger(client, server *boundedQueue[streamChunk], publish func(msg dofusMsg)) *sessionMerger {
+	sM := &sessionMerger{publish: publish}
+	sM.sides[dirClientToServer].queue = client
+	sM.sides[dirServerToClient].queue = server
+	return sM
+}
+
+// Add queues a message decoded by one of the readers
+func (sM *sessionMerger) Add(msg *dofusMsg) {
+	sM.mu.Lock()
+	sM.order++
+	msg.order = sM.order
+	sM.last[msg.Direction] = msg
+	heap.Push(&sM.pending, msg)
+	sM.release()
+	sM.flush()
+}
+
+// Idle is called when a reader starts waiting for data
+func (sM *sessionMerger) Idle() {
+	sM.mu.Lock()
+	sM.release()
+	sM.flush()
+}
+
+// Done is called when the reader of a direction is finished, with the
+// reason the stream ended
+func (sM *sessionMerger) Done(dir msgDirection, ending string) {
+	sM.mu.Lock()
+	sM.sides[dir].closed = true
+	if ending != "" {
+		sM.ending = ending
+	}
+	sM.release()
+	sM.flush()
+}
+
+// Publishes the released messages. mu is held when called and released on
+// return, it is not held while publishing as that may block on a full
+// queue. Only one caller publishes at a time, the others leave their
+// messages to it, so that the timeline keeps its order.
+func (sM *sessionMerger) flush() {
+	if sM.publishing {
+		sM.mu.Unlock()
+		return
+	}
+	sM.publishing = true
+	for len(sM.ready) > 0 {
+		ready := sM.ready
+		sM.ready = nil
+		sM.mu.Unlock()
+		for _, msg := range ready {
+			sM.publish(msg)
+		}
+		sM.mu.Lock()
+	}
+	sM.publishing = false
+	sM.mu.Unlock()
+}
+
+// Releases the pending messages that can no longer be preceded by a
+// message of the other direction
+func (sM *sessionMerger) release() {
+	for len(sM.pending) > 0 {
+		msg := sM.pending[0]
+		other := msg.Direction ^ 1
+		last := sM.last[other]
+		if !sM.sides[other].caughtUp() && (last == nil || timelineBefore(last, msg)) {
+			return
+		}
+		heap.Pop(&sM.pending)
+		sM.seq++
+		msg.Seq = sM.seq
+		sM.ready = append(sM.ready, *msg)
+	}
+	if len(sM.pending) == 0 && sM.sides[0].closed && sM.sides[1].closed {
+		sM.publishEnd()
+	}
+}
+
+// Releases the message marking the end of the session, after its last
+// message. Nothing is published for a session without messages.
+func (sM *sessionMerger) publishEnd() {
+	last := sM.last[dirClientToServer]
+	if other := sM.last[dirServerToClient]; last == nil || (other != nil && timelineBefore(last, other)) {
+		last = other
+	}
+	if sM.ended || last == nil {
+		return
+	}
+	sM.ended = true
+	sM.seq++
+	sM.ready = append(sM.ready, dofusMsg{
+		Timestamp: last.Timestamp,
+		Direction: last.Direction,
+		Client:    last.Client,
+		Server:    last.Server,
+		Stream:    last.Stream,
+		Seq:       sM.seq,
+		Attached:  last.Attached,
+		Source:    last.Source,
+		Closed:    true,
+		Ending:    sM.ending,
+		decoded:   new(decodedBody),
+	})
+}
+
+// Session identifies the game session of the message: the client endpoint,
+// prefixed by the agent it was received from if any
+func (dM *dofusMsg) Session() string {
+	if dM.Source != "" {
+		return dM.Source + "/" + dM.Client
+	}
+	return dM.Client
+}
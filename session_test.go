@@ -0,0 +1,180 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimelineBefore(t *testing.T) {
+	at := func(ms int) time.Time { return testEpoch.Add(time.Duration(ms) * time.Millisecond) }
+	tests := []struct {
+		name string
+		a, b dofusMsg
+		want bool
+	}{
+		{
+			name: "earlier capture",
+			a:    dofusMsg{Timestamp: at(0), Direction: dirServerToClient, order: 2},
+			b:    dofusMsg{Timestamp: at(1), Direction: dirClientToServer, order: 1},
+			want: true,
+		},
+		{
+			name: "later capture",
+			a:    dofusMsg{Timestamp: at(1), Direction: dirClientToServer, order: 1},
+			b:    dofusMsg{Timestamp: at(0), Direction: dirServerToClient, order: 2},
+			want: false,
+		},
+		{
+			name: "acknowledged by the other",
+			a:    dofusMsg{Timestamp: at(0), Direction: dirServerToClient, TCPSeq: 100, order: 2},
+			b:    dofusMsg{Timestamp: at(0), Direction: dirClientToServer, TCPAck: 101, order: 1},
+			want: true,
+		},
+		{
+			name: "acknowledging the other",
+			a:    dofusMsg{Timestamp: at(0), Direction: dirClientToServer, TCPAck: 101, order: 1},
+			b:    dofusMsg{Timestamp: at(0), Direction: dirServerToClient, TCPSeq: 100, order: 2},
+			want: false,
+		},
+		{
+			name: "acknowledged across the wrap",
+			a:    dofusMsg{Timestamp: at(0), Direction: dirServerToClient, TCPSeq: 0xfffffff0, order: 2},
+			b:    dofusMsg{Timestamp: at(0), Direction: dirClientToServer, TCPAck: 0x10, order: 1},
+			want: true,
+		},
+		{
+			name: "same direction in arrival order",
+			a:    dofusMsg{Timestamp: at(0), Direction: dirClientToServer, TCPSeq: 200, order: 1},
+			b:    dofusMsg{Timestamp: at(0), Direction: dirClientToServer, TCPSeq: 100, order: 2},
+			want: true,
+		},
+		{
+			name: "unrelated segments in arrival order",
+			a:    dofusMsg{Timestamp: at(0), Direction: dirClientToServer, TCPSeq: 100, TCPAck: 500, order: 2},
+			b:    dofusMsg{Timestamp: at(0), Direction: dirServerToClient, TCPSeq: 600, TCPAck: 50, order: 1},
+			want: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := timelineBefore(&test.a, &test.b); got != test.want {
+				t.Errorf("timelineBefore is %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSessionMerger(t *testing.T) {
+	// Messages are told apart by their protocol id
+	type added struct {
+		dir      msgDirection
+		ms       int
+		seq, ack uint32
+		id       uint16
+	}
+	type done struct {
+		dir    msgDirection
+		ending string
+	}
+	tests := []struct {
+		name       string
+		added      []added
+		done       []done
+		want       []uint16
+		wantEnding string
+	}{
+		{
+			name: "interleaved by capture time",
+			added: []added{
+				{dir: dirClientToServer, ms: 0, id: 1},
+				{dir: dirClientToServer, ms: 20, id: 3},
+				{dir: dirServerToClient, ms: 10, id: 2},
+				{dir: dirServerToClient, ms: 30, id: 4},
+			},
+			done:       []done{{dirClientToServer, endClosed}, {dirServerToClient, endClosed}},
+			want:       []uint16{1, 2, 3, 4},
+			wantEnding: endClosed,
+		},
+		{
+			name: "same capture time ordered by acknowledgment",
+			added: []added{
+				{dir: dirClientToServer, ms: 0, seq: 10, ack: 101, id: 2},
+				{dir: dirServerToClient, ms: 0, seq: 100, ack: 10, id: 1},
+			},
+			done:       []done{{dirServerToClient, endIdle}, {dirClientToServer, endIdle}},
+			want:       []uint16{1, 2},
+			wantEnding: endIdle,
+		},
+		{
+			name: "one direction only",
+			added: []added{
+				{dir: dirServerToClient, ms: 0, id: 1},
+				{dir: dirServerToClient, ms: 5, id: 2},
+			},
+			done:       []done{{dirClientToServer, ""}, {dirServerToClient, endShutdown}},
+			want:       []uint16{1, 2},
+			wantEnding: endShutdown,
+		},
+		{
+			name:  "no messages",
+			added: nil,
+			done:  []done{{dirClientToServer, endClosed}, {dirServerToClient, endClosed}},
+			want:  nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var published []dofusMsg
+			// Nobody reads the queues, so the readers never catch up
+			// before they are done
+			stage := pipelineStage("test-merger")
+			client := newBoundedQueue[streamChunk](stage, queueOptions{size: 1})
+			server := newBoundedQueue[streamChunk](stage, queueOptions{size: 1})
+			merger := newSessionMerger(client, server, func(msg dofusMsg) { published = append(published, msg) })
+
+			for _, a := range test.added {
+				merger.Add(&dofusMsg{
+					ProtocolId: a.id,
+					Timestamp:  testEpoch.Add(time.Duration(a.ms) * time.Millisecond),
+					Direction:  a.dir,
+					Client:     "192.168.1.142:57148",
+					TCPSeq:     a.seq,
+					TCPAck:     a.ack,
+				})
+			}
+			for i, d := range test.done {
+				if i == len(test.done)-1 && len(published) > 0 && published[len(published)-1].Closed {
+					t.Errorf("ended before the last reader is done")
+				}
+				merger.Done(d.dir, d.ending)
+			}
+
+			var got []uint16
+			for i, msg := range published {
+				if msg.Seq != uint64(i+1) {
+					t.Errorf("message %d has seq %d", i, msg.Seq)
+				}
+				if !msg.Closed {
+					got = append(got, msg.ProtocolId)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("published %v, want %v", got, test.want)
+			}
+			if len(test.want) == 0 {
+				if len(published) != 0 {
+					t.Errorf("published %d messages for an empty session", len(published))
+				}
+				return
+			}
+			end := published[len(published)-1]
+			if !end.Closed || end.Ending != test.wantEnding {
+				t.Errorf("ended with %+v, want a %s end", end, test.wantEnding)
+			}
+			if end.Client != "192.168.1.142:57148" {
+				t.Errorf("end of session %q", end.Client)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerCommand("standin", runStandin)
+}
+
+// standinPeer plays one side of a recorded session over a connection: it
+// sends the frames of its side in the recorded order, waiting for the other
+// side to have sent what it sent before each of them.
+type standinPeer struct {
+	conn     net.Conn
+	side     msgDirection // Direction of the frames this peer sends
+	messages []dofusMsg
+	timeout  time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	received int
+	eof      bool
+}
+
+// Counts the bytes sent by the other side, they are not checked
+func (sP *standinPeer) receive() {
+	buffer := make([]byte, proxyBufferSize)
+	for {
+		n, err := sP.conn.Read(buffer)
+		sP.mu.Lock()
+		sP.received += n
+		sP.eof = err != nil
+		sP.cond.Broadcast()
+		sP.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Waits for the other side to have sent expected bytes, within the timeout
+// and as long as the connection is open. Returns the bytes received.
+func (sP *standinPeer) waitReceived(expected int) int {
+	timer := time.AfterFunc(sP.timeout, func() {
+		sP.mu.Lock()
+		defer sP.mu.Unlock()
+		sP.cond.Broadcast()
+	})
+	defer timer.Stop()
+	deadline := time.Now().Add(sP.timeout)
+
+	sP.mu.Lock()
+	defer sP.mu.Unlock()
+	for sP.received < expected && !sP.eof && time.Now().Before(deadline) {
+		sP.cond.Wait()
+	}
+	return sP.received
+}
+
+// play sends the frames of the session, then waits for the other side to
+// close the connection
+func (sP *standinPeer) play() error {
+	sP.cond = sync.NewCond(&sP.mu)
+	go sP.receive()
+
+	expected, sent := 0, 0
+	for i := range sP.messages {
+		msg := &sP.messages[i]
+		frame := msg.frame()
+		if msg.Direction != sP.side {
+			expected += len(frame)
+			continue
+		}
+		if received := sP.waitReceived(expected); received < expected {
+			log.Printf("standin: peer sent %d of the %d bytes expected before %s, going on", received, expected, msg.Name())
+		}
+		if _, err := sP.conn.Write(frame); err != nil {
+			return err
+		}
+		sent++
+	}
+	log.Printf("standin: sent %d messages as the %s side", sent, sideName(sP.side))
+
+	if tcp, ok := sP.conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	sP.waitReceived(expected)
+	return nil
+}
+
+func sideName(side msgDirection) string {
+	if side == dirClientToServer {
+		return "client"
+	}
+	return "server"
+}
+
+// rps standin: plays a recorded session over TCP, as the game server with
+// -listen or as the client with -connect, to exercise the proxy mode
+// without the game. Run both sides against a proxy in between:
+//
+//	rps standin -r chat_messages.pcap -listen 127.0.0.1:5556
+//	rps -proxy-listen 127.0.0.1:5555 -proxy-target 127.0.0.1:5556 -modules timeline
+//	rps standin -r chat_messages.pcap -connect 127.0.0.1:5555
+func runStandin(args []string) int {
+	flags := flag.NewFlagSet("standin", flag.ExitOnError)
+	var inputs captureFiles
+	flags.Var(&inputs, "r", "Pcap file holding the session to play, can be repeated or a glob like for capturing")
+	bpf := flags.String("f", *filter, "BPF filter for pcap")
+	listen := flags.String("listen", "", "Play the server side for the connections accepted on this address")
+	connect := flags.String("connect", "", "Play the client side, connecting to this address")
+	session := flags.String("session", "", "Client endpoint (ip:port) of the session to play, the first one by default")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for the other side before sending anyway")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s standin -r capture.pcap (-listen addr | -connect addr)\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if len(inputs) == 0 || (*listen == "") == (*connect == "") {
+		flags.Usage()
+		return 2
+	}
+
+	if err := loadProtocol(); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+
+	messages, err := decodeCapture(ctx, inputs, *bpf)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	messages = sessionMessages(messages, *session)
+	if len(messages) == 0 {
+		log.Printf("no session found in %s", inputs.String())
+		return 1
+	}
+	log.Printf("standin: playing session of %s, %d messages", messages[0].Client, len(messages))
+
+	if *connect != "" {
+		err = standinConnect(ctx, *connect, messages, *timeout)
+	} else {
+		err = standinListen(ctx, *listen, messages, *timeout)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// Returns the messages of the session of client, or of the first session
+func sessionMessages(messages []dofusMsg, client string) []dofusMsg {
+	if client == "" && len(messages) > 0 {
+		client = messages[0].Client
+	}
+	var session []dofusMsg
+	for _, msg := range messages {
+		if msg.Client == client {
+			session = append(session, msg)
+		}
+	}
+	return session
+}
+
+func standinConnect(ctx context.Context, address string, messages []dofusMsg, timeout time.Duration) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	peer := &standinPeer{conn: conn, side: dirClientToServer, messages: messages, timeout: timeout}
+	return peer.play()
+}
+
+// Plays the session for every accepted connection, one at a time, until ctx
+// is cancelled
+func standinListen(ctx context.Context, address string, messages []dofusMsg, timeout time.Duration) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return standinServe(ctx, listener, messages, timeout)
+}
+
+// Plays the session for the connections accepted on listener, see
+// standinListen
+func standinServe(ctx context.Context, listener net.Listener, messages []dofusMsg, timeout time.Duration) error {
+	log.Printf("standin: listening on %s", listener.Addr())
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		log.Printf("standin: %s connected", conn.RemoteAddr())
+		closeConn := context.AfterFunc(ctx, func() { conn.Close() })
+		peer := &standinPeer{conn: conn, side: dirServerToClient, messages: messages, timeout: timeout}
+		if err := peer.play(); err != nil && !errors.Is(err, io.EOF) {
+			log.Printf("standin: %s", err)
+		}
+		closeConn()
+		conn.Close()
+	}
+}
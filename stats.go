@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var statsInterval = flag.Duration("stats-interval", time.Minute, "Interval between two statistics reports in the log, 0 to only report on exit")
+
+// captureCounters are the statistics of the capture source itself, as
+// reported by libpcap
+type captureCounters struct {
+	Received  int `json:"received"`
+	Dropped   int `json:"dropped"`
+	IfDropped int `json:"ifDropped"`
+}
+
+// pipelineStats counts what goes through the capture pipeline, from the
+// packets to the decoded frames. Updated from the capture loop, the stream
+// callbacks and the readers.
+type pipelineStats struct {
+	start time.Time
+
+	packets    atomic.Uint64 // Packets read from the capture
+	tcpPackets atomic.Uint64 // Packets handed to the reassembler
+
+	streams           atomic.Int64  // Streams currently reassembled
+	streamsTotal      atomic.Uint64 // Streams seen since the start
+	outOfOrderPackets atomic.Uint64 // Packets queued until the data before them arrived
+	outOfOrderBytes   atomic.Uint64
+	overlapPackets    atomic.Uint64 // Packets carrying data already seen
+	overlapBytes      atomic.Uint64
+	gaps              atomic.Uint64 // Holes given up on by the reassembler
+	missingBytes      atomic.Uint64 // Size of those holes, when known
+
+	frames       [2]atomic.Uint64 // Decoded frames, by msgDirection
+	bytes        [2]atomic.Uint64 // Reassembled bytes, by msgDirection
+	resyncs      atomic.Uint64    // Times a reader lost the frame boundaries
+	skippedBytes atomic.Uint64    // Bytes discarded to find them again
+	unknown      atomic.Uint64    // Frames of messages missing from the protocol
+
+	mu         sync.Mutex
+	capture    func() (captureCounters, error)
+	lastReport time.Time
+	lastFrames uint64
+	recentRate float64
+}
+
+var stats = &pipelineStats{start: time.Now()}
+
+// setCaptureSource registers the function reading the statistics of the
+// capture, nil when the capture is over
+func (ps *pipelineStats) setCaptureSource(capture func() (captureCounters, error)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.capture = capture
+}
+
+// statsSnapshot is a copy of the statistics at a given time, as logged and
+// served by the API
+type statsSnapshot struct {
+	Time    time.Time        `json:"time"`
+	Uptime  string           `json:"uptime"`
+	Capture *captureCounters `json:"capture,omitempty"`
+
+	Packets    uint64 `json:"packets"`
+	TCPPackets uint64 `json:"tcpPackets"`
+
+	Reassembly struct {
+		ActiveStreams     int64  `json:"activeStreams"`
+		Streams           uint64 `json:"streams"`
+		OutOfOrderPackets uint64 `json:"outOfOrderPackets"`
+		OutOfOrderBytes   uint64 `json:"outOfOrderBytes"`
+		OverlapPackets    uint64 `json:"overlapPackets"`
+		OverlapBytes      uint64 `json:"overlapBytes"`
+		Gaps              uint64 `json:"gaps"`
+		MissingBytes      uint64 `json:"missingBytes"`
+	} `json:"reassembly"`
+
+	Decoding struct {
+		Frames         map[string]uint64 `json:"frames"`
+		Bytes          map[string]uint64 `json:"bytes"`
+		Resyncs        uint64            `json:"resyncs"`
+		SkippedBytes   uint64            `json:"skippedBytes"`
+		UnknownFrames  uint64            `json:"unknownFrames"`
+		MessagesPerSec float64           `json:"messagesPerSec"` // Since the previous report
+		AveragePerSec  float64           `json:"averagePerSec"`  // Since the start
+	} `json:"decoding"`
+
+	Queues []queueSnapshot `json:"queues"`
+}
+
+type queueSnapshot struct {
+	Stage   string `json:"stage"`
+	Queues  int64  `json:"queues"`
+	Depth   int64  `json:"depth"`
+	Pushed  uint64 `json:"pushed"`
+	Dropped uint64 `json:"dropped"`
+	Spilled uint64 `json:"spilled"`
+
+	SpillErrors uint64 `json:"spillErrors"` // Spill files that could not be written or read
+}
+
+// Snapshot copies the current statistics. The message rate is the one of
+// the last report.
+func (ps *pipelineStats) Snapshot() statsSnapshot {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.snapshot(time.Now())
+}
+
+func (ps *pipelineStats) snapshot(now time.Time) statsSnapshot {
+	var s statsSnapshot
+	s.Time = now
+	s.Uptime = now.Sub(ps.start).Round(time.Second).String()
+	if ps.capture != nil {
+		if counters, err := ps.capture(); err == nil {
+			s.Capture = &counters
+		}
+	}
+
+	s.Packets = ps.packets.Load()
+	s.TCPPackets = ps.tcpPackets.Load()
+
+	s.Reassembly.ActiveStreams = ps.streams.Load()
+	s.Reassembly.Streams = ps.streamsTotal.Load()
+	s.Reassembly.OutOfOrderPackets = ps.outOfOrderPackets.Load()
+	s.Reassembly.OutOfOrderBytes = ps.outOfOrderBytes.Load()
+	s.Reassembly.OverlapPackets = ps.overlapPackets.Load()
+	s.Reassembly.OverlapBytes = ps.overlapBytes.Load()
+	s.Reassembly.Gaps = ps.gaps.Load()
+	s.Reassembly.MissingBytes = ps.missingBytes.Load()
+
+	s.Decoding.Frames = make(map[string]uint64, 2)
+	s.Decoding.Bytes = make(map[string]uint64, 2)
+	for _, dir := range []msgDirection{dirClientToServer, dirServerToClient} {
+		s.Decoding.Frames[dir.String()] = ps.frames[dir].Load()
+		s.Decoding.Bytes[dir.String()] = ps.bytes[dir].Load()
+	}
+	s.Decoding.Resyncs = ps.resyncs.Load()
+	s.Decoding.SkippedBytes = ps.skippedBytes.Load()
+	s.Decoding.UnknownFrames = ps.unknown.Load()
+	s.Decoding.MessagesPerSec = ps.recentRate
+	if elapsed := now.Sub(ps.start).Seconds(); elapsed > 0 {
+		s.Decoding.AveragePerSec = float64(ps.totalFrames()) / elapsed
+	}
+
+	for _, stage := range pipelineStages() {
+		s.Queues = append(s.Queues, queueSnapshot{
+			Stage:   stage.name,
+			Queues:  stage.queues.Load(),
+			Depth:   stage.depth.Load(),
+			Pushed:  stage.pushed.Load(),
+			Dropped: stage.dropped.Load(),
+			Spilled: stage.spilled.Load(),
+
+			SpillErrors: stage.spillErrors.Load(),
+		})
+	}
+	return s
+}
+
+func (ps *pipelineStats) totalFrames() uint64 {
+	return ps.frames[dirClientToServer].Load() + ps.frames[dirServerToClient].Load()
+}
+
+// report updates the message rate and takes a snapshot
+func (ps *pipelineStats) report() statsSnapshot {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	now := time.Now()
+	last := ps.lastReport
+	if last.IsZero() {
+		last = ps.start
+	}
+	frames := ps.totalFrames()
+	if elapsed := now.Sub(last).Seconds(); elapsed > 0 {
+		ps.recentRate = float64(frames-ps.lastFrames) / elapsed
+	}
+	ps.lastReport, ps.lastFrames = now, frames
+	return ps.snapshot(now)
+}
+
+// logStats writes a report to the log
+func logStats(s statsSnapshot) {
+	if s.Capture != nil {
+		log.Printf("stats: capture received %d, dropped %d, dropped by interface %d",
+			s.Capture.Received, s.Capture.Dropped, s.Capture.IfDropped)
+	}
+	log.Printf("stats: %d packets, %d tcp, %d streams (%d active)",
+		s.Packets, s.TCPPackets, s.Reassembly.Streams, s.Reassembly.ActiveStreams)
+	log.Printf("stats: reassembly %d out of order (%d bytes), %d overlaps (%d bytes), %d gaps (%d bytes missing)",
+		s.Reassembly.OutOfOrderPackets, s.Reassembly.OutOfOrderBytes,
+		s.Reassembly.OverlapPackets, s.Reassembly.OverlapBytes,
+		s.Reassembly.Gaps, s.Reassembly.MissingBytes)
+	for _, dir := range []msgDirection{dirClientToServer, dirServerToClient} {
+		log.Printf("stats: %s %d frames, %d bytes", dir, s.Decoding.Frames[dir.String()], s.Decoding.Bytes[dir.String()])
+	}
+	log.Printf("stats: %.1f messages/s (%.1f on average), %d resyncs, %d bytes skipped, %d unknown messages",
+		s.Decoding.MessagesPerSec, s.Decoding.AveragePerSec, s.Decoding.Resyncs, s.Decoding.SkippedBytes, s.Decoding.UnknownFrames)
+	for _, queue := range s.Queues {
+		log.Printf("stats: queues %s: %d queues, depth %d, pushed %d, dropped %d, spilled %d, spill errors %d",
+			queue.Stage, queue.Queues, queue.Depth, queue.Pushed, queue.Dropped, queue.Spilled, queue.SpillErrors)
+	}
+}
+
+// reportStats logs the statistics every -stats-interval until ctx is done
+func reportStats(ctx context.Context) {
+	if *statsInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logStats(stats.report())
+		}
+	}
+}
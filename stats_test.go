@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns the snapshot served on /stats
+func getStats(t *testing.T, url string) (statsSnapshot, map[string]json.RawMessage) {
+	t.Helper()
+	response, err := http.Get(url + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("%s, %s", response.Status, response.Header.Get("Content-Type"))
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snapshot statsSnapshot
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot, raw
+}
+
+// /stats counts what a capture went through
+func TestStatsAPI(t *testing.T) {
+	const client, server = "192.168.1.5:50000", "172.65.0.1:5555"
+	fromServer := testFrame(t, "ChatServerMessage", dirServerToClient, 12)
+	fromClient := append(testFrame(t, "ChatClientMultiMessage", dirClientToServer, 20), testFrame(t, "ChatClientMultiMessage", dirClientToServer, 0)...)
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	writeTestCapture(t, path, []testSegment{
+		{at: 0, src: server, dst: client, seq: 1000, ack: true, payload: fromServer},
+		{at: time.Second, src: client, dst: server, seq: 5000, ack: true, payload: fromClient},
+		// Not a game connection
+		{at: 2 * time.Second, src: client, dst: "172.65.0.1:443", seq: 7000, ack: true, payload: []byte("hello")},
+	})
+
+	api := httptest.NewServer(apiMux)
+	defer api.Close()
+	before, _ := getStats(t, api.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := decodeCapture(ctx, []string{path}, "tcp"); err != nil {
+		t.Fatal(err)
+	}
+	after, raw := getStats(t, api.URL)
+
+	for _, key := range []string{"time", "uptime", "packets", "tcpPackets", "reassembly", "decoding", "queues"} {
+		if _, ok := raw[key]; !ok {
+			t.Errorf("no %s in the snapshot", key)
+		}
+	}
+	counters := []struct {
+		name          string
+		before, after uint64
+		want          uint64
+	}{
+		{"packets", before.Packets, after.Packets, 3},
+		{"tcp packets", before.TCPPackets, after.TCPPackets, 2},
+		{"streams", before.Reassembly.Streams, after.Reassembly.Streams, 1},
+		{"client frames", before.Decoding.Frames["client->server"], after.Decoding.Frames["client->server"], 2},
+		{"server frames", before.Decoding.Frames["server->client"], after.Decoding.Frames["server->client"], 1},
+		{"client bytes", before.Decoding.Bytes["client->server"], after.Decoding.Bytes["client->server"], uint64(len(fromClient))},
+		{"server bytes", before.Decoding.Bytes["server->client"], after.Decoding.Bytes["server->client"], uint64(len(fromServer))},
+		// Both directions are picked up mid-stream, already aligned
+		{"resyncs", before.Decoding.Resyncs, after.Decoding.Resyncs, 2},
+		{"skipped bytes", before.Decoding.SkippedBytes, after.Decoding.SkippedBytes, 0},
+	}
+	for _, counter := range counters {
+		if counter.after-counter.before != counter.want {
+			t.Errorf("%s: %d more, want %d", counter.name, counter.after-counter.before, counter.want)
+		}
+	}
+	if after.Reassembly.ActiveStreams != before.Reassembly.ActiveStreams {
+		t.Errorf("%d active streams, was %d", after.Reassembly.ActiveStreams, before.Reassembly.ActiveStreams)
+	}
+	var readers *queueSnapshot
+	for i := range after.Queues {
+		if after.Queues[i].Stage == "reader" {
+			readers = &after.Queues[i]
+		}
+	}
+	if readers == nil || readers.Depth != 0 {
+		t.Errorf("reader queues %+v", readers)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func init() {
+	registerModule("summary", func() Module { return new(summaryModule) })
+}
+
+// Values of FightOutcomeEnum
+const (
+	fightOutcomeLost    = 0
+	fightOutcomeVictory = 2
+)
+
+// sessionSummary is what a character did during a game session
+type sessionSummary struct {
+	Session      string           `json:"session"`
+	Server       string           `json:"server"`
+	Character    string           `json:"character"`
+	Start        time.Time        `json:"start"`
+	End          time.Time        `json:"end"`
+	Duration     int64            `json:"duration"` // In seconds
+	Ending       string           `json:"ending"`   // closed, shutdown, idle or switched (to another character)
+	Experience   uint64           `json:"experience"`
+	LevelStart   uint64           `json:"levelStart"`
+	LevelEnd     uint64           `json:"levelEnd"`
+	Kamas        int64            `json:"kamas"`       // Gained, negative when spent
+	ItemsGained  map[uint64]int64 `json:"itemsGained"` // Quantity by GID
+	ItemsLost    map[uint64]int64 `json:"itemsLost"`
+	FightsWon    int              `json:"fightsWon"`
+	FightsLost   int              `json:"fightsLost"`
+	FightsOther  int              `json:"fightsOther"` // Draws, fights of the perceptors...
+	Maps         int              `json:"maps"`        // Distinct maps visited
+	Quests       []uint64         `json:"quests"`
+	Achievements []uint64         `json:"achievements"`
+	// The character was chosen before the capture started: its name, level
+	// and fights are unknown, the summary starts at its first message
+	Partial bool `json:"partial,omitempty"`
+}
+
+// characterSession follows a character through a game session
+type characterSession struct {
+	summary    sessionSummary
+	id         uint64
+	kamas      int64
+	kamasKnown bool
+	bag        map[uint64]bagItem // By object UID, known once the inventory is received
+	items      map[uint64]int64   // Quantity gained by GID
+	maps       map[uint64]bool
+}
+
+func newCharacterSession(session string, server string, start time.Time) *characterSession {
+	return &characterSession{
+		summary: sessionSummary{
+			Session:      session,
+			Server:       server,
+			Start:        start,
+			Quests:       []uint64{},
+			Achievements: []uint64{},
+		},
+		items: make(map[uint64]int64),
+		maps:  make(map[uint64]bool),
+	}
+}
+
+type bagItem struct {
+	gid      uint64
+	quantity uint64
+}
+
+type summaryOptions struct {
+	Path  string `json:"path"`  // Summaries are appended to it as JSON lines, not stored if empty
+	Print bool   `json:"print"` // Print them on the standard output
+}
+
+// summaryModule sums up what each character did once its game session ends:
+// the connection is closed, another character is chosen, or rps stops.
+// Items are counted as they enter and leave the bag, those stored in the
+// bank count as lost. A session picked up once its character was chosen
+// gets a partial summary.
+type summaryModule struct {
+	baseModule
+	options  summaryOptions
+	servers  *gameServerTracker
+	sessions map[string]*characterSession
+}
+
+func (sm *summaryModule) Name() string {
+	return "summary"
+}
+
+func (sm *summaryModule) Subscriptions() []messageFilter {
+	return []messageFilter{byName(
+		"ServerSelectionMessage", "SelectedServerDataMessage", "CharacterSelectedSuccessMessage",
+		"CharacterExperienceGainMessage", "CharacterLevelUpMessage", "KamasUpdateMessage",
+		"InventoryContentMessage", "ObjectAddedMessage", "ObjectsAddedMessage", "ObjectQuantityMessage",
+		"ObjectsQuantityMessage", "ObjectDeletedMessage", "ObjectsDeletedMessage",
+		"GameFightEndMessage", "CurrentMapMessage", "QuestValidatedMessage", "AchievementFinishedMessage",
+	)}
+}
+
+func (sm *summaryModule) subscribeSessionEnds() {}
+
+func (sm *summaryModule) Start(ctx context.Context, env *moduleEnv) error {
+	sm.options = summaryOptions{Path: "rps-sessions.ndjson", Print: true}
+	if err := env.decodeOptions(&sm.options); err != nil {
+		return err
+	}
+	sm.servers = newGameServerTracker()
+	sm.sessions = make(map[string]*characterSession)
+	sm.run(env, sm.observe)
+	return nil
+}
+
+func (sm *summaryModule) Stop() error {
+	sm.baseModule.Stop()
+	sessions := make([]string, 0, len(sm.sessions))
+	for session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Strings(sessions)
+	for _, session := range sessions {
+		sm.finish(session, time.Time{}, endShutdown)
+	}
+	return nil
+}
+
+func (sm *summaryModule) observe(msg dofusMsg) {
+	session := msg.Session()
+	if msg.Closed {
+		ending := msg.Ending
+		if ending == "" {
+			ending = endClosed
+		}
+		sm.finish(session, msg.Timestamp, ending)
+		sm.servers.Forget(session)
+		return
+	}
+	server := sm.servers.Observe(&msg)
+	body, err := msg.JSON()
+	if err != nil {
+		return
+	}
+	fields := gjson.ParseBytes(body)
+
+	switch msg.Name() {
+	case "CharacterSelectedSuccessMessage":
+		sm.finish(session, msg.Timestamp, "switched")
+		cs := newCharacterSession(session, server, msg.Timestamp)
+		cs.summary.Character = fields.Get("infos.name").String()
+		cs.summary.LevelStart = fields.Get("infos.level").Uint()
+		cs.summary.LevelEnd = cs.summary.LevelStart
+		cs.id = fields.Get("infos.id").Uint()
+		sm.sessions[session] = cs
+		return
+	case "ServerSelectionMessage", "SelectedServerDataMessage":
+		return
+	}
+	cs, ok := sm.sessions[session]
+	if !ok {
+		sm.env.Log.Printf("session %s started before the capture, its summary is partial", session)
+		cs = newCharacterSession(session, server, msg.Timestamp)
+		cs.summary.Partial = true
+		sm.sessions[session] = cs
+	}
+	summary := &cs.summary
+	summary.End = msg.Timestamp
+
+	switch msg.Name() {
+	case "CharacterExperienceGainMessage":
+		summary.Experience += fields.Get("experienceCharacter").Uint()
+	case "CharacterLevelUpMessage":
+		summary.LevelEnd = fields.Get("newLevel").Uint()
+	case "KamasUpdateMessage":
+		cs.setKamas(fields.Get("kamasTotal").Int())
+	case "InventoryContentMessage":
+		cs.setKamas(fields.Get("kamas").Int())
+		cs.bag = make(map[uint64]bagItem)
+		for _, object := range fields.Get("objects").Array() {
+			cs.bag[object.Get("objectUID").Uint()] = bagItem{gid: object.Get("objectGID").Uint(), quantity: object.Get("quantity").Uint()}
+		}
+	case "ObjectAddedMessage":
+		cs.addObject(fields.Get("object"))
+	case "ObjectsAddedMessage":
+		for _, object := range fields.Get("object").Array() {
+			cs.addObject(object)
+		}
+	case "ObjectQuantityMessage":
+		cs.setQuantity(fields.Get("objectUID").Uint(), fields.Get("quantity").Uint())
+	case "ObjectsQuantityMessage":
+		for _, object := range fields.Get("objectsUIDAndQty").Array() {
+			cs.setQuantity(object.Get("objectUID").Uint(), object.Get("quantity").Uint())
+		}
+	case "ObjectDeletedMessage":
+		cs.setQuantity(fields.Get("objectUID").Uint(), 0)
+	case "ObjectsDeletedMessage":
+		for _, uid := range fields.Get("objectUID").Array() {
+			cs.setQuantity(uid.Uint(), 0)
+		}
+	case "GameFightEndMessage":
+		for _, result := range fields.Get("results").Array() {
+			if result.Get("id").Uint() != cs.id {
+				continue
+			}
+			switch result.Get("outcome").Int() {
+			case fightOutcomeVictory:
+				summary.FightsWon++
+			case fightOutcomeLost:
+				summary.FightsLost++
+			default:
+				summary.FightsOther++
+			}
+		}
+	case "CurrentMapMessage":
+		cs.maps[fields.Get("mapId").Uint()] = true
+	case "QuestValidatedMessage":
+		summary.Quests = append(summary.Quests, fields.Get("questId").Uint())
+	case "AchievementFinishedMessage":
+		summary.Achievements = append(summary.Achievements, fields.Get("achievement.id").Uint())
+	}
+}
+
+// The first amount known is the reference for the kamas gained
+func (cs *characterSession) setKamas(kamas int64) {
+	if !cs.kamasKnown {
+		cs.kamas, cs.kamasKnown = kamas, true
+	}
+	cs.summary.Kamas = kamas - cs.kamas
+}
+
+func (cs *characterSession) addObject(object gjson.Result) {
+	if cs.bag == nil {
+		return
+	}
+	uid := object.Get("objectUID").Uint()
+	if _, ok := cs.bag[uid]; !ok {
+		cs.bag[uid] = bagItem{gid: object.Get("objectGID").Uint()}
+	}
+	cs.setQuantity(uid, object.Get("quantity").Uint())
+}
+
+func (cs *characterSession) setQuantity(uid uint64, quantity uint64) {
+	item, ok := cs.bag[uid]
+	if !ok {
+		return
+	}
+	cs.items[item.gid] += int64(quantity) - int64(item.quantity)
+	if quantity == 0 {
+		delete(cs.bag, uid)
+		return
+	}
+	item.quantity = quantity
+	cs.bag[uid] = item
+}
+
+// Completes the summary of the character played in session, if any, and
+// stores it. end is the time of the last message seen if zero.
+func (sm *summaryModule) finish(session string, end time.Time, ending string) {
+	cs, ok := sm.sessions[session]
+	if !ok {
+		return
+	}
+	delete(sm.sessions, session)
+
+	summary := &cs.summary
+	if !end.IsZero() {
+		summary.End = end
+	}
+	if summary.End.Before(summary.Start) {
+		summary.End = summary.Start
+	}
+	summary.Duration = int64(summary.End.Sub(summary.Start) / time.Second)
+	summary.Ending = ending
+	summary.Maps = len(cs.maps)
+	summary.ItemsGained = make(map[uint64]int64)
+	summary.ItemsLost = make(map[uint64]int64)
+	for gid, quantity := range cs.items {
+		if quantity > 0 {
+			summary.ItemsGained[gid] = quantity
+		} else if quantity < 0 {
+			summary.ItemsLost[gid] = -quantity
+		}
+	}
+
+	if sm.options.Print {
+		fmt.Print(summary.String())
+	}
+	if sm.options.Path != "" {
+		if err := appendJSONLine(sm.options.Path, summary); err != nil {
+			sm.env.Log.Printf("could not store the summary of %s - %s", summary.Character, err)
+		}
+	}
+}
+
+func (ss *sessionSummary) String() string {
+	var b strings.Builder
+	character := ss.Character
+	if ss.Partial {
+		character = "unknown character (partial)"
+	}
+	if ss.Server != "" {
+		character += " (server " + ss.Server + ")"
+	}
+	fmt.Fprintf(&b, "== %s, %s to %s, %v, %s\n", character,
+		ss.Start.Local().Format(time.DateTime), ss.End.Local().Format(time.TimeOnly),
+		time.Duration(ss.Duration)*time.Second, ss.Ending)
+	fmt.Fprintf(&b, "   experience %d, level %d -> %d, kamas %+d\n", ss.Experience, ss.LevelStart, ss.LevelEnd, ss.Kamas)
+	fmt.Fprintf(&b, "   fights won %d, lost %d, other %d, maps %d\n", ss.FightsWon, ss.FightsLost, ss.FightsOther, ss.Maps)
+	fmt.Fprintf(&b, "   items gained %s\n", formatItemCounts(ss.ItemsGained))
+	fmt.Fprintf(&b, "   items lost %s\n", formatItemCounts(ss.ItemsLost))
+	fmt.Fprintf(&b, "   quests %v, achievements %v\n", ss.Quests, ss.Achievements)
+	return b.String()
+}
+
+// Formats quantities by GID as "421 x100, 422 x3"
+func formatItemCounts(items map[uint64]int64) string {
+	if len(items) == 0 {
+		return "none"
+	}
+	gids := make([]uint64, 0, len(items))
+	for gid := range items {
+		gids = append(gids, gid)
+	}
+	sort.Slice(gids, func(i, j int) bool { return gids[i] < gids[j] })
+	parts := make([]string, len(gids))
+	for i, gid := range gids {
+		parts[i] = fmt.Sprintf("%d x%d", gid, items[gid])
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Appends v to the file at path as a JSON line
+func appendJSONLine(path string, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
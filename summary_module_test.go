@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Reads the summaries stored at path
+func readSummaries(t *testing.T, path string) []sessionSummary {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var summaries []sessionSummary
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var summary sessionSummary
+		if err := json.Unmarshal(scanner.Bytes(), &summary); err != nil {
+			t.Fatal(err)
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return summaries
+}
+
+func TestSummaryAccounting(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	message := func(name string, second int, body *bodyEncoder) dofusMsg {
+		return testMessage(t, name, dirServerToClient, game, second, body)
+	}
+	inventory := new(bodyEncoder).short(1)
+	encodeObjectItem(inventory, 421, 1, 10)
+	added := new(bodyEncoder)
+	encodeObjectItem(added, 422, 2, 3)
+	// The character, whose id is 1, and another fighter
+	fightEnd := func(second int, outcome uint64) dofusMsg {
+		body := new(bodyEncoder).int(30).varint(0).short(0).short(2)
+		body.short(8223).varint(outcome).byte(0).short(0).varint(0).double(1).boolean(true)
+		body.short(8223).varint(2).byte(0).short(0).varint(0).double(-5).boolean(false)
+		return message("GameFightEndMessage", second, body.short(0))
+	}
+
+	path := filepath.Join(t.TempDir(), "sessions.ndjson")
+	runModule(t, new(summaryModule), `{"path": "`+path+`", "print": false}`, []dofusMsg{
+		testMessage(t, "ServerSelectionMessage", dirClientToServer, game, 0, new(bodyEncoder).varint(291)),
+		characterSelected(t, game, "Aled"),
+		message("InventoryContentMessage", 1, inventory.varint(1000)),
+		message("CharacterExperienceGainMessage", 2, new(bodyEncoder).varint(500).varint(0).varint(0).varint(0)),
+		message("CharacterLevelUpMessage", 3, new(bodyEncoder).varint(201)),
+		message("KamasUpdateMessage", 4, new(bodyEncoder).varint(1500)),
+		message("KamasUpdateMessage", 5, new(bodyEncoder).varint(800)),
+		message("ObjectAddedMessage", 6, added.byte(0)),
+		message("ObjectQuantityMessage", 7, new(bodyEncoder).varint(1).varint(4).byte(0)),
+		message("ObjectQuantityMessage", 8, new(bodyEncoder).varint(2).varint(5).byte(0)),
+		message("ObjectDeletedMessage", 9, new(bodyEncoder).varint(1)),
+		fightEnd(10, fightOutcomeVictory),
+		fightEnd(11, fightOutcomeLost),
+		fightEnd(12, 1),
+		message("CurrentMapMessage", 13, new(bodyEncoder).double(154010883)),
+		message("CurrentMapMessage", 14, new(bodyEncoder).double(154010884)),
+		message("CurrentMapMessage", 15, new(bodyEncoder).double(154010883)),
+		message("QuestValidatedMessage", 16, new(bodyEncoder).varint(1629)),
+		{Timestamp: testEpoch.Add(20 * time.Second), Client: game, Closed: true, Ending: endClosed},
+	})
+
+	summaries := readSummaries(t, path)
+	if len(summaries) != 1 {
+		t.Fatalf("%d summaries", len(summaries))
+	}
+	got := summaries[0]
+	want := sessionSummary{
+		Session:      got.Session,
+		Server:       "291",
+		Character:    "Aled",
+		Start:        testEpoch,
+		End:          testEpoch.Add(20 * time.Second),
+		Duration:     20,
+		Ending:       endClosed,
+		Experience:   500,
+		LevelStart:   200,
+		LevelEnd:     201,
+		Kamas:        -200,
+		ItemsGained:  map[uint64]int64{422: 5},
+		ItemsLost:    map[uint64]int64{421: 10},
+		FightsWon:    1,
+		FightsLost:   1,
+		FightsOther:  1,
+		Maps:         2,
+		Quests:       []uint64{1629},
+		Achievements: []uint64{},
+	}
+	if !got.Start.Equal(want.Start) || !got.End.Equal(want.End) {
+		t.Errorf("from %v to %v, want %v to %v", got.Start, got.End, want.Start, want.End)
+	}
+	got.Start, got.End = want.Start, want.End
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("summary\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestSummaryEndings(t *testing.T) {
+	const game = "10.0.0.1:4001"
+	mapChanged := func(second int) dofusMsg {
+		return testMessage(t, "CurrentMapMessage", dirServerToClient, game, second, new(bodyEncoder).double(154010883))
+	}
+	ended := func(second int, ending string) dofusMsg {
+		return dofusMsg{Timestamp: testEpoch.Add(time.Duration(second) * time.Second), Client: game, Closed: true, Ending: ending}
+	}
+	switched := characterSelected(t, game, "Yokoo")
+	switched.Timestamp = testEpoch.Add(4 * time.Second)
+	type ending struct {
+		character string
+		ending    string
+		duration  int64
+		partial   bool
+	}
+	tests := []struct {
+		name     string
+		messages []dofusMsg
+		want     []ending
+	}{
+		{"closed", []dofusMsg{characterSelected(t, game, "Aled"), mapChanged(3), ended(10, endClosed)},
+			[]ending{{"Aled", endClosed, 10, false}}},
+		{"closed without a reason", []dofusMsg{characterSelected(t, game, "Aled"), ended(10, "")},
+			[]ending{{"Aled", endClosed, 10, false}}},
+		{"idle", []dofusMsg{characterSelected(t, game, "Aled"), mapChanged(3), ended(300, endIdle)},
+			[]ending{{"Aled", endIdle, 300, false}}},
+		// Until the last message seen
+		{"shutdown", []dofusMsg{characterSelected(t, game, "Aled"), mapChanged(3)},
+			[]ending{{"Aled", endShutdown, 3, false}}},
+		{"switched", []dofusMsg{characterSelected(t, game, "Aled"), mapChanged(3), switched, mapChanged(5)},
+			[]ending{{"Aled", "switched", 4, false}, {"Yokoo", endShutdown, 1, false}}},
+		{"selected before the capture", []dofusMsg{mapChanged(3), mapChanged(5), ended(10, endClosed)},
+			[]ending{{"", endClosed, 7, true}}},
+		{"nothing but the end", []dofusMsg{ended(10, endClosed)}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sessions.ndjson")
+			runModule(t, new(summaryModule), `{"path": "`+path+`", "print": false}`, test.messages)
+			var got []ending
+			if test.want != nil {
+				for _, summary := range readSummaries(t, path) {
+					got = append(got, ending{summary.Character, summary.Ending, summary.Duration, summary.Partial})
+				}
+			} else if _, err := os.Stat(path); err == nil {
+				t.Error("summary stored")
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("summaries %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
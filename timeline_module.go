@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+func init() {
+	registerModule("timeline", func() Module { return new(timelineModule) })
+}
+
+// timelineModule prints one line per message, in the order of the session
+// timeline
+type timelineModule struct {
+	baseModule
+}
+
+func (tm *timelineModule) Name() string {
+	return "timeline"
+}
+
+func (tm *timelineModule) Subscriptions() []messageFilter {
+	return nil
+}
+
+func (tm *timelineModule) Start(ctx context.Context, env *moduleEnv) error {
+	tm.run(env, tm.print)
+	return nil
+}
+
+func (tm *timelineModule) print(msg dofusMsg) {
+	name := msg.Name()
+	if name == "" {
+		name = fmt.Sprintf("<unknown %v>", msg.ProtocolId)
+	}
+	fmt.Printf("%s %-21s #%-5d %-14s %s (%d bytes)\n",
+		msg.Timestamp.Format("15:04:05.000000"), msg.Session(), msg.Seq, msg.Direction, name, len(msg.body))
+}
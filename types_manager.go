@@ -6,18 +6,21 @@ import (
 	"log"
 	"reflect"
 	"strings"
+	"sync"
 
 	"github.com/tidwall/gjson"
 )
 
 // Define structs representing fields and ChatServerMessage
 type MessageField struct {
-	IsVector         bool   `json:"isVector"`
-	Name             string `json:"name"`
-	PrefixedByTypeID bool   `json:"prefixedByTypeID"`
-	Type             string `json:"type"`
-	ReadFunc         string `json:"readFunc"`
-	ConstantLength   int    `json:"constantLength"`
+	IsVector               bool   `json:"isVector"`
+	Name                   string `json:"name"`
+	PrefixedByTypeID       bool   `json:"prefixedByTypeID"`
+	Type                   string `json:"type"`
+	ReadFunc               string `json:"readFunc"`
+	LengthFunc             string `json:"lengthFunc"`
+	ConstantLength         int    `json:"constantLength"`
+	BooleanWrapperPosition int    `json:"booleanWrapperPosition"`
 }
 
 type MessageSchema struct {
@@ -26,6 +29,71 @@ type MessageSchema struct {
 }
 
 var fieldTypesMap map[string]reflect.Type
+var messageTypesMap map[uint16]reflect.Type
+
+// Types being created, used to break recursive definitions
+// (EntityLook -> SubEntity -> EntityLook)
+var pendingTypes map[string]bool
+
+// Readers decode messages concurrently, the maps above are guarded by this
+var typesMutex sync.Mutex
+
+// Returns the struct type of the message with the given protocol id
+func messageStruct(protocolId uint16) (reflect.Type, error) {
+	typesMutex.Lock()
+	defer typesMutex.Unlock()
+
+	if messageType := messageTypesMap[protocolId]; messageType != nil {
+		return messageType, nil
+	}
+
+	schemaBytes := gjson.GetBytes(messagesJson, fmt.Sprintf("%v", protocolId))
+	if !schemaBytes.Exists() {
+		return nil, fmt.Errorf("unknown message %v", protocolId)
+	}
+
+	var schema MessageSchema
+	if err := json.Unmarshal([]byte(schemaBytes.Raw), &schema); err != nil {
+		return nil, err
+	}
+
+	messageType := reflect.StructOf(schemaFields(schema))
+	messageTypesMap[protocolId] = messageType
+	return messageType, nil
+}
+
+// Returns the struct type of the type with the given name
+func typeStruct(name string) (reflect.Type, error) {
+	typesMutex.Lock()
+	defer typesMutex.Unlock()
+
+	if _, ok := nameIdMap[name]; !ok {
+		return nil, fmt.Errorf("unknown type %v", name)
+	}
+	return createFieldType(MessageField{Type: name}), nil
+}
+
+// Returns the name of the type with the given protocol id, used to resolve
+// fields prefixed by their type id
+func typeName(protocolId uint16) (string, error) {
+	schemaName := gjson.GetBytes(typesJson, fmt.Sprintf("%v.name", protocolId))
+	if !schemaName.Exists() {
+		return "", fmt.Errorf("unknown type id %v", protocolId)
+	}
+	return schemaName.String(), nil
+}
+
+func schemaFields(schema MessageSchema) (fields []reflect.StructField) {
+	for _, field := range schema.Fields {
+		fields = append(fields, reflect.StructField{
+			Name: strings.Title(field.Name),
+			Type: getFieldType(field),
+			Tag: reflect.StructTag(fmt.Sprintf("json:\"%v\" type:\"%v\" prefixed:\"%v\" readfunc:\"%v\" lengthfunc:\"%v\" constlen:\"%v\" wrapper:\"%v\"",
+				field.Name, field.Type, field.PrefixedByTypeID, field.ReadFunc, field.LengthFunc, field.ConstantLength, field.BooleanWrapperPosition)),
+		})
+	}
+	return
+}
 
 func createFieldType(field MessageField) (fieldType reflect.Type) {
 	schemaBytes := gjson.GetBytes(typesJson, fmt.Sprintf("%v", nameIdMap[field.Type]))
@@ -40,18 +108,15 @@ func createFieldType(field MessageField) (fieldType reflect.Type) {
 		return fieldTypesMap[schema.Name]
 	}
 
-	// Dynamically create Message struct using reflection
-	var fields []reflect.StructField
-	//var fieldIndexMethodMap map[int]string
-	for _, field := range schema.Fields {
-		fields = append(fields, reflect.StructField{
-			Name: strings.Title(field.Name),
-			Type: getFieldType(field),
-			Tag:  reflect.StructTag(fmt.Sprintf("type:\"%v\" prefixed:\"%v\"", field.Type, field.PrefixedByTypeID)),
-		})
+	// The type is referencing itself, it will be decoded by name
+	if pendingTypes[schema.Name] {
+		return reflect.TypeOf((*interface{})(nil)).Elem()
 	}
+	pendingTypes[schema.Name] = true
+	defer delete(pendingTypes, schema.Name)
 
-	messageType := reflect.StructOf(fields)
+	// Dynamically create Message struct using reflection
+	messageType := reflect.StructOf(schemaFields(schema))
 	fieldTypesMap[schema.Name] = messageType
 
 	return messageType
@@ -110,7 +175,12 @@ func getFieldType(field MessageField) (fieldType reflect.Type) {
 			log.Fatalf("Unsupported readFunc : %s for type %s field %s", field.ReadFunc, field.Type, field.Name)
 		}
 	default:
-		fieldType = createFieldType(field)
+		// Polymorphic fields are resolved while decoding
+		if field.PrefixedByTypeID {
+			fieldType = reflect.TypeOf((*interface{})(nil)).Elem()
+		} else {
+			fieldType = createFieldType(field)
+		}
 	}
 
 	if field.IsVector {